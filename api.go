@@ -9,6 +9,8 @@ This part of the service runs on the client or the app.
 */
 
 import (
+	"math/rand"
+
 	"gopkg.in/dedis/onet.v1"
 	"gopkg.in/dedis/onet.v1/log"
 	"gopkg.in/dedis/onet.v1/network"
@@ -30,10 +32,26 @@ func NewClient() *Client {
 
 // Clock will return the time in seconds it took to run the protocol.
 func (c *Client) Clock(r *onet.Roster) (*ClockResponse, onet.ClientError) {
-	dst := r.RandomServerIdentity()
+	return c.ClockRequest(nil, &ClockRequest{Roster: r})
+}
+
+// ClockRequest sends req to dst, which becomes the root of the tree. If dst
+// is nil, a random node of the subset in req is chosen.
+func (c *Client) ClockRequest(dst *network.ServerIdentity, req *ClockRequest) (*ClockResponse, onet.ClientError) {
+	if dst == nil {
+		if len(req.Subset) == 0 {
+			dst = req.Roster.RandomServerIdentity()
+		} else {
+			i := req.Subset[rand.Intn(len(req.Subset))]
+			if i < 0 || i >= len(req.Roster.List) {
+				return nil, onet.NewClientErrorCode(ErrorParse, "subset index out of roster")
+			}
+			dst = req.Roster.List[i]
+		}
+	}
 	log.Lvl4("Sending message to", dst)
 	reply := &ClockResponse{}
-	err := c.SendProtobuf(dst, &ClockRequest{r}, reply)
+	err := c.SendProtobuf(dst, req, reply)
 	if err != nil {
 		return nil, err
 	}
@@ -6,8 +6,11 @@ package main
 
 import (
 	"os"
+	"strconv"
+	"strings"
 
 	template "github.com/dedis/cothority_template"
+	"github.com/dedis/cothority_template/ots/util"
 
 	"gopkg.in/dedis/onet.v1/app"
 
@@ -27,18 +30,114 @@ func main() {
 			Usage:     "measure the time to contact all nodes",
 			Aliases:   []string{"t"},
 			ArgsUsage: groupsDef,
-			Action:    cmdTime,
+			Action:    withOutput("time", cmdTime),
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "bf",
+					Usage: "branching factor of the tree (default 2)",
+				},
+				cli.IntFlag{
+					Name:  "depth",
+					Usage: "maximum depth of the tree, leaving out the nodes that don't fit",
+				},
+				cli.StringFlag{
+					Name:  "subset",
+					Usage: "comma-separated indexes of the nodes in the group file to use",
+				},
+				cli.Float64Flag{
+					Name:  "timeout",
+					Usage: "seconds a node waits for each level of its subtree (default 5)",
+				},
+			},
 		},
 		{
 			Name:      "counter",
 			Usage:     "return the counter",
 			Aliases:   []string{"t"},
 			ArgsUsage: groupsDef,
-			Action:    cmdCounter,
+			Action:    withOutput("counter", cmdCounter),
+		},
+		{
+			Name:      "check",
+			Usage:     "check the health of every node",
+			ArgsUsage: groupsDef,
+			Action:    withOutput("check", cmdCheck),
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "threshold",
+					Usage: "minimum number of healthy nodes (default all)",
+				},
+				cli.StringFlag{
+					Name:  "require",
+					Usage: "comma-separated services a healthy node must run",
+				},
+			},
+		},
+		{
+			Name:   "bench",
+			Usage:  "run OTS rounds and write their timings as CSV",
+			Action: withOutput("bench", cmdBench),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "ac",
+					Usage: "group-definition-file of the access-control cothority",
+				},
+				cli.StringFlag{
+					Name:  "sc",
+					Usage: "group-definition-file of the secret-management cothority",
+				},
+				cli.StringFlag{
+					Name:  "suite",
+					Value: util.SuiteEd25519,
+					Usage: "cryptographic suite of the write transactions",
+				},
+				cli.IntFlag{
+					Name:  "rounds",
+					Value: 10,
+					Usage: "number of rounds",
+				},
+				cli.IntFlag{
+					Name:  "size",
+					Value: 1024 * 1024,
+					Usage: "size of the message in bytes",
+				},
+				cli.StringFlag{
+					Name:  "csv",
+					Usage: "output file, instead of the standard output",
+				},
+			},
+		},
+		{
+			Name:        "ots",
+			Usage:       "write, read and decrypt one-time secrets",
+			Subcommands: otsCommands(),
+		},
+		{
+			Name:        "key",
+			Usage:       "manage the keys of OTS writers and readers",
+			Subcommands: keyCommands(),
+		},
+		{
+			Name:        "storage",
+			Usage:       "back up and restore the data of the services of a conode",
+			Subcommands: storageCommands(),
 		},
 	}
 	cliApp.Flags = []cli.Flag{
 		app.FlagDebug,
+		cli.StringFlag{
+			Name:  "format",
+			Value: "text",
+			Usage: "output format, text or json",
+		},
+		cli.StringFlag{
+			Name:  "keystore",
+			Usage: "keystore file (default ~/.ots/keystore.json)",
+		},
+		cli.StringFlag{
+			Name:  "passphrase-file",
+			Usage: "file holding the passphrase of the keystore",
+		},
 	}
 	cliApp.Before = func(c *cli.Context) error {
 		log.SetDebugVisible(c.Int("debug"))
@@ -48,43 +147,109 @@ func main() {
 }
 
 // Returns the time needed to contact all nodes.
-func cmdTime(c *cli.Context) error {
-	log.Info("Time command")
-	group := readGroup(c)
-	client := template.NewClient()
-	resp, err := client.Clock(group.Roster)
+func cmdTime(c *cli.Context, out *output) error {
+	out.info("Time command")
+	group, err := readGroup(c)
 	if err != nil {
-		log.Fatal("When asking the time:", err)
+		return err
+	}
+	req := &template.ClockRequest{
+		Roster:          group.Roster,
+		BranchingFactor: c.Int("bf"),
+		MaxDepth:        c.Int("depth"),
+		Timeout:         c.Float64("timeout"),
+	}
+	if c.String("subset") != "" {
+		for _, idx := range strings.Split(c.String("subset"), ",") {
+			i, err := strconv.Atoi(strings.TrimSpace(idx))
+			if err != nil || i < 0 || i >= len(group.Roster.List) {
+				return cli.NewExitError("Invalid index in subset: "+idx, exitUsage)
+			}
+			req.Subset = append(req.Subset, i)
+		}
+	}
+	client := template.NewClient()
+	resp, cerr := client.ClockRequest(nil, req)
+	if cerr != nil {
+		return cli.NewExitError("When asking the time: "+cerr.Error(), exitNetwork)
+	}
+	out.Result = map[string]interface{}{
+		"children":         resp.Children,
+		"time":             resp.Time,
+		"branching_factor": resp.BranchingFactor,
+		"depth":            resp.Depth,
+		"missing":          resp.Missing,
+	}
+	out.infof("Children: %d - Time spent: %f", resp.Children, resp.Time)
+	out.infof("Tree with branching factor %d and depth %d:", resp.BranchingFactor, resp.Depth)
+	out.infof("%-24s %-30s %12s %12s %12s", "node", "address", "announce[ms]", "process[ms]", "reply[ms]")
+	for _, n := range resp.Tree {
+		if n.Index < 0 || n.Index >= len(group.Roster.List) {
+			continue
+		}
+		si := group.Roster.List[n.Index]
+		node := out.node(si.Address.String(), si.Public.String())
+		node.Details["index"] = n.Index
+		node.Details["parent"] = n.Parent
+		node.Details["depth"] = n.Depth
+		node.Details["announce"] = n.Announce
+		node.Details["processing"] = n.Processing
+		node.Details["reply"] = n.Reply
+		out.infof("%-24s %-30s %12.3f %12.3f %12.3f", strings.Repeat("  ", n.Depth)+strconv.Itoa(n.Index),
+			si.Address, n.Announce*1000, n.Processing*1000, n.Reply*1000)
+	}
+	for _, i := range resp.Missing {
+		if i < 0 || i >= len(group.Roster.List) {
+			continue
+		}
+		si := group.Roster.List[i]
+		node := out.node(si.Address.String(), si.Public.String())
+		node.Error = "no answer in time"
+		node.Details["index"] = i
+		out.infof("Missing: %d: %s", i, si.Address)
 	}
-	log.Infof("Children: %d - Time spent: %f", resp.Children, resp.Time)
 	return nil
 }
 
 // Returns the number of calls.
-func cmdCounter(c *cli.Context) error {
-	log.Info("Counter command")
-	group := readGroup(c)
-	client := template.NewClient()
-	counter, err := client.Count(group.Roster.RandomServerIdentity())
+func cmdCounter(c *cli.Context, out *output) error {
+	out.info("Counter command")
+	group, err := readGroup(c)
 	if err != nil {
-		log.Fatal("When asking for counter:", err)
+		return err
 	}
-	log.Info("Number of requests:", counter)
+	client := template.NewClient()
+	si := group.Roster.RandomServerIdentity()
+	counter, cerr := client.Count(si)
+	node := out.node(si.Address.String(), si.Public.String())
+	if cerr != nil {
+		node.Error = cerr.Error()
+		return cli.NewExitError("When asking for counter: "+cerr.Error(), exitNetwork)
+	}
+	node.Details["counter"] = counter
+	out.Result = map[string]interface{}{
+		"counter": counter,
+	}
+	out.info("Number of requests:", counter)
 	return nil
 }
 
-func readGroup(c *cli.Context) *app.Group {
+func readGroup(c *cli.Context) (*app.Group, error) {
 	if c.NArg() != 1 {
-		log.Fatal("Please give the group-file as argument")
+		return nil, cli.NewExitError("Please give the group-file as argument", exitUsage)
 	}
 	name := c.Args().First()
 	f, err := os.Open(name)
-	log.ErrFatal(err, "Couldn't open group definition file")
+	if err != nil {
+		return nil, cli.NewExitError("Couldn't open group definition file: "+err.Error(), exitUsage)
+	}
+	defer f.Close()
 	group, err := app.ReadGroupDescToml(f)
-	log.ErrFatal(err, "Error while reading group definition file", err)
-	if len(group.Roster.List) == 0 {
-		log.ErrFatalf(err, "Empty entity or invalid group defintion in: %s",
-			name)
+	if err != nil {
+		return nil, cli.NewExitError("Error while reading group definition file: "+err.Error(), exitUsage)
+	}
+	if group.Roster == nil || len(group.Roster.List) == 0 {
+		return nil, cli.NewExitError("Empty entity or invalid group defintion in: "+name, exitUsage)
 	}
-	return group
+	return group, nil
 }
@@ -1,11 +1,44 @@
 package main
 
 import (
+	"io/ioutil"
+	"strings"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"gopkg.in/dedis/onet.v1/log"
 )
 
 func TestMain(m *testing.M) {
 	log.MainTest(m)
 }
+
+func TestBenchStats_csv(t *testing.T) {
+	buf, err := ioutil.ReadFile("../otssc/simulation/data_backup/backup.csv")
+	require.Nil(t, err)
+	want := strings.Split(strings.SplitN(string(buf), "\n", 2)[0], ",")
+
+	bs := benchStats{"DecReq_wall": {1, 3}, "DecReq_allocs": {10}, "ValidateWriteTxn_wall": {1}}
+	header, row := bs.csv([]int{4, 3, 1, 2, 0, 1})
+	// The backup predates the DecryptMessage and ValidateWriteTxn measures.
+	var old []string
+	for _, name := range header {
+		if !strings.HasPrefix(name, "DecryptMessage_") &&
+			!strings.HasPrefix(name, "ValidateWriteTxn_") {
+			old = append(old, name)
+		}
+	}
+	assert.Equal(t, want, old)
+	require.Equal(t, len(header), len(row))
+	for i, name := range header {
+		switch name {
+		case "DecReq_wall_avg":
+			assert.Equal(t, "2.000000", row[i])
+		case "ValidateWriteTxn_wall_avg":
+			assert.Equal(t, "1.000000", row[i])
+		case "ChildrenWait_wall_min", "bandwidth_tx_sum":
+			assert.Equal(t, "NaN", row[i])
+		}
+	}
+}
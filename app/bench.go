@@ -0,0 +1,313 @@
+package main
+
+/*
+The bench-command runs full OTS rounds against a live roster and writes the
+timings in the CSV format of the onet simulations, so that they can be
+compared with otssc/simulation/data_backup.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/cothority_template/measure"
+	"github.com/dedis/cothority_template/ots"
+	"github.com/dedis/cothority_template/ots/keystore"
+	"github.com/dedis/cothority_template/ots/util"
+	ocs "github.com/dedis/onchain-secrets"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/crypto.v0/random"
+	"gopkg.in/dedis/crypto.v0/share/pvss"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// benchColumns are the columns written before the measures, as in the
+// simulation output.
+var benchColumns = []string{"hosts", "bf", "depth", "rounds", "runwait", "servers"}
+
+// benchPhases are the measures of the simulation output, in its order.
+// ChildrenWait and SimulSyncWait are waits of the simulation framework, so
+// bench leaves them at NaN.
+var benchPhases = []string{"ChildrenWait", measure.CreateReadTxn, measure.CreateWriteTxn,
+	measure.DecReq, measure.DecryptMessage, measure.GetUpdatedWriteSB, measure.GetWriteTxnSB,
+	measure.RecoverSecret, "SimulSyncWait", measure.ValidateWriteTxn, measure.WriteTxnPrep}
+
+// benchTimes are the values of each phase in the simulation output.
+var benchTimes = []string{measure.SuffixSystem, measure.SuffixUser, measure.SuffixWall}
+
+// benchBandwidth are the bandwidth columns of the simulation output. They
+// are counted on the conodes, so bench can't measure them and leaves them at
+// NaN.
+var benchBandwidth = []string{"bandwidth_root_rx", "bandwidth_root_tx", "bandwidth_rx", "bandwidth_tx"}
+
+// benchStats collects the values of the measures, indexed by names like
+// "DecReq_wall".
+type benchStats map[string][]float64
+
+// measure runs f as the phase name and records its sample, with the same
+// names as in the simulations. The bytes are those of the clients of the
+// ots package, as bench can't count the traffic of the conodes.
+func (bs benchStats) measure(name string, f func() error) error {
+	p := measure.Start(name, ots.Traffic)
+	err := f()
+	sample := p.Stop()
+	if err != nil {
+		return errors.New(name + ": " + err.Error())
+	}
+	for n, v := range sample.Values() {
+		bs[n] = append(bs[n], v)
+	}
+	return nil
+}
+
+// summary returns min, max, avg, sum and the sample standard deviation of
+// values, which is NaN for a single value.
+func summary(values []float64) []float64 {
+	if len(values) == 0 {
+		nan := math.NaN()
+		return []float64{nan, nan, nan, nan, nan}
+	}
+	min, max, sum := values[0], values[0], 0.0
+	for _, v := range values {
+		min = math.Min(min, v)
+		max = math.Max(max, v)
+		sum += v
+	}
+	n := float64(len(values))
+	avg := sum / n
+	sq := 0.0
+	for _, v := range values {
+		sq += (v - avg) * (v - avg)
+	}
+	return []float64{min, max, avg, sum, math.Sqrt(sq / (n - 1))}
+}
+
+// csv returns the header and the line of the statistics, with the columns
+// of the simulation output in the same order. The columns bench doesn't
+// measure are NaN, and its other measures are left out.
+func (bs benchStats) csv(params []int) ([]string, []string) {
+	header := append([]string{}, benchColumns...)
+	row := make([]string, len(params))
+	for i, p := range params {
+		row[i] = strconv.Itoa(p)
+	}
+	var names []string
+	for _, phase := range benchPhases {
+		for _, suffix := range benchTimes {
+			names = append(names, phase+suffix)
+		}
+	}
+	names = append(names, benchBandwidth...)
+	for _, name := range names {
+		for i, s := range summary(bs[name]) {
+			header = append(header, name+"_"+[]string{"min", "max", "avg", "sum", "dev"}[i])
+			row = append(row, fmt.Sprintf("%f", s))
+		}
+	}
+	return header, row
+}
+
+// traffic returns the average bytes the client sent and received in every
+// phase. They aren't part of the simulation output, so they are only in
+// the result of the command.
+func (bs benchStats) traffic(out *output) map[string]float64 {
+	t := map[string]float64{}
+	for _, phase := range benchPhases {
+		for _, suffix := range []string{measure.SuffixTx, measure.SuffixRx} {
+			if values, ok := bs[phase+suffix]; ok {
+				t[phase+suffix] = summary(values)[2]
+			}
+		}
+		if _, ok := t[phase+measure.SuffixTx]; ok {
+			out.infof("%s: %.0f bytes sent, %.0f received", phase,
+				t[phase+measure.SuffixTx], t[phase+measure.SuffixRx])
+		}
+	}
+	return t
+}
+
+// Runs OTS rounds on a live roster and writes their timings as CSV.
+func cmdBench(c *cli.Context, out *output) error {
+	acRoster, err := readRoster(c, "ac")
+	if err != nil {
+		return err
+	}
+	scRoster, err := readRoster(c, "sc")
+	if err != nil {
+		return err
+	}
+	rounds := c.Int("rounds")
+	if rounds <= 0 {
+		return cli.NewExitError("Please give a positive number of rounds", exitUsage)
+	}
+	mesg := random.Bytes(c.Int("size"), random.Stream)
+	scurl, err := ots.CreateSkipchain(acRoster)
+	if err != nil {
+		return cli.NewExitError("Could not create skipchain: "+err.Error(), exitNetwork)
+	}
+
+	bs := benchStats{}
+	for round := 0; round < rounds; round++ {
+		out.info("Round:", round)
+		if err := benchRound(bs, scurl, scRoster, c.String("suite"), mesg); err != nil {
+			return cli.NewExitError("Round "+strconv.Itoa(round)+" failed: "+err.Error(), exitNetwork)
+		}
+	}
+
+	n := len(scRoster.List)
+	header, row := bs.csv([]int{n, n - 1, 1, rounds, 0, countHosts(scRoster)})
+	out.Result = map[string]interface{}{
+		"header":  header,
+		"row":     row,
+		"traffic": bs.traffic(out),
+	}
+	var w io.Writer
+	switch {
+	case c.String("csv") != "":
+		f, err := os.Create(c.String("csv"))
+		if err != nil {
+			return cli.NewExitError(err, exitError)
+		}
+		defer f.Close()
+		w = f
+	case out.json:
+		return nil
+	default:
+		w = os.Stdout
+	}
+	if _, err := fmt.Fprintf(w, "%s\n%s\n", strings.Join(header, ","), strings.Join(row, ",")); err != nil {
+		return cli.NewExitError(err, exitError)
+	}
+	return nil
+}
+
+// benchRound measures the phases of one write and read of mesg.
+func benchRound(bs benchStats, scurl *ocs.SkipChainURL, scRoster *onet.Roster, suiteID string, mesg []byte) error {
+	dp, err := util.NewDataPVSS(suiteID, scRoster.Publics(), len(scRoster.List))
+	if err != nil {
+		return err
+	}
+	wrKey, err := keystore.NewKey(dp.SuiteID)
+	if err != nil {
+		return err
+	}
+	key, err := keystore.NewKey(dp.SuiteID)
+	if err != nil {
+		return err
+	}
+	store := ots.NewMemStorage()
+
+	var encMesg, hashEnc []byte
+	err = bs.measure(measure.WriteTxnPrep, func() error {
+		if err := ots.SetupPVSS(dp, key.Public); err != nil {
+			return err
+		}
+		encMesg, hashEnc, err = ots.EncryptMessage(dp, mesg, nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if _, err = ots.UploadEnvelope(store, encMesg); err != nil {
+		return err
+	}
+	var att *util.WriteAttestation
+	err = bs.measure(measure.ValidateWriteTxn, func() error {
+		att, err = ots.ValidateWriteTxn(scRoster, dp, key.Public)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	var writeID []byte
+	err = bs.measure(measure.CreateWriteTxn, func() error {
+		sb, err := ots.CreateWriteTxn(scurl, dp, att, hashEnc, key.Public, wrKey)
+		if err == nil {
+			writeID = sb.Hash
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	var wtd *util.WriteTxnData
+	err = bs.measure(measure.GetWriteTxnSB, func() error {
+		_, wtd, _, err = ots.GetWriteTxnSB(scurl, writeID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	var readSB *skipchain.SkipBlock
+	err = bs.measure(measure.CreateReadTxn, func() error {
+		readSB, err = ots.CreateReadTxn(scurl, writeID, key)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	var updWriteSB *skipchain.SkipBlock
+	err = bs.measure(measure.GetUpdatedWriteSB, func() error {
+		updWriteSB, err = ots.GetUpdatedWriteTxnSB(scurl, writeID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	var decShares []*pvss.PubVerShare
+	err = bs.measure(measure.DecReq, func() error {
+		decShares, err = ots.GetDecryptedShares(scurl, scRoster, updWriteSB, readSB.SkipBlockFix,
+			updWriteSB.Roster.Publics(), wtd.SCPublicKeys, key, readSB.Index)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	var recSecret abstract.Point
+	err = bs.measure(measure.RecoverSecret, func() error {
+		recSecret, err = ots.RecoverSecret(dp.Suite, wtd, decShares, dp.Threshold)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	env, err := ots.FetchEnvelope(store, wtd)
+	if err != nil {
+		return err
+	}
+	var recvMesg []byte
+	err = bs.measure(measure.DecryptMessage, func() error {
+		recvMesg, err = ots.DecryptMessage(recSecret, env, wtd)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(recvMesg, mesg) {
+		return errors.New("decrypted message differs")
+	}
+	return nil
+}
+
+// countHosts returns the number of distinct hosts in the roster, which is
+// what the simulations call servers.
+func countHosts(r *onet.Roster) int {
+	hosts := map[string]bool{}
+	for _, si := range r.List {
+		host, _, err := net.SplitHostPort(si.Address.NetworkAddress())
+		if err != nil {
+			host = si.Address.NetworkAddress()
+		}
+		hosts[host] = true
+	}
+	return len(hosts)
+}
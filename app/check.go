@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dedis/cothority/skipchain"
+	status "github.com/dedis/cothority/status/service"
+	template "github.com/dedis/cothority_template"
+	otssc "github.com/dedis/cothority_template/otssc/service"
+	ocs "github.com/dedis/onchain-secrets"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/network"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// checkedServices are the services whose presence check reports for every
+// node.
+var checkedServices = []string{
+	template.ServiceName,
+	otssc.ServiceName,
+	ocs.ServiceName,
+	skipchain.ServiceName,
+}
+
+// nodeHealth is what check found out about one node.
+type nodeHealth struct {
+	si        *network.ServerIdentity
+	rtt       time.Duration
+	services  []string
+	keyMatch  bool
+	err       error
+	reachable bool
+}
+
+// healthy returns true if the node answered with the public key of the
+// group file and runs all the required services.
+func (h *nodeHealth) healthy(required []string) bool {
+	if !h.reachable || !h.keyMatch {
+		return false
+	}
+	for _, r := range required {
+		if !h.runs(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func (h *nodeHealth) runs(service string) bool {
+	for _, s := range h.services {
+		if s == service {
+			return true
+		}
+	}
+	return false
+}
+
+// Contacts every node of the roster and reports its health.
+func cmdCheck(c *cli.Context, out *output) error {
+	group, err := readGroup(c)
+	if err != nil {
+		return err
+	}
+	list := group.Roster.List
+	threshold := len(list)
+	if c.IsSet("threshold") {
+		threshold = c.Int("threshold")
+		if threshold < 1 || threshold > len(list) {
+			return cli.NewExitError("Threshold must be between 1 and "+strconv.Itoa(len(list)), exitUsage)
+		}
+	}
+	var required []string
+	if c.String("require") != "" {
+		required = strings.Split(c.String("require"), ",")
+	}
+
+	health := make([]*nodeHealth, len(list))
+	var wg sync.WaitGroup
+	for i, si := range list {
+		wg.Add(1)
+		go func(i int, si *network.ServerIdentity) {
+			defer wg.Done()
+			health[i] = checkNode(si)
+		}(i, si)
+	}
+	wg.Wait()
+
+	healthy := 0
+	for _, h := range health {
+		node := out.node(h.si.Address.String(), h.si.Public.String())
+		node.Details["reachable"] = h.reachable
+		ok := h.healthy(required)
+		node.Details["healthy"] = ok
+		if ok {
+			healthy++
+		}
+		if !h.reachable {
+			node.Error = h.err.Error()
+			out.infof("%s: unreachable: %s", h.si.Address, h.err)
+			continue
+		}
+		if h.err != nil {
+			node.Error = h.err.Error()
+		}
+		node.Details["rtt_ms"] = float64(h.rtt) / float64(time.Millisecond)
+		node.Details["key_match"] = h.keyMatch
+		node.Details["services"] = h.services
+		running := map[string]bool{}
+		for _, s := range checkedServices {
+			running[s] = h.runs(s)
+		}
+		node.Details["checked_services"] = running
+
+		state := "OK"
+		if !ok {
+			state = "UNHEALTHY"
+		}
+		out.infof("%s: %s rtt=%s key-match=%t services=%s", h.si.Address, state,
+			h.rtt, h.keyMatch, strings.Join(h.services, ","))
+	}
+
+	out.Result = map[string]interface{}{
+		"healthy":   healthy,
+		"total":     len(list),
+		"threshold": threshold,
+	}
+	out.infof("Healthy nodes: %d/%d - threshold: %d", healthy, len(list), threshold)
+	if healthy < threshold {
+		return cli.NewExitError("Only "+strconv.Itoa(healthy)+" healthy nodes", exitNetwork)
+	}
+	return nil
+}
+
+// checkNode asks si for its status. The public key is compared to the one
+// that si reports, which shows a misconfigured group file, but doesn't
+// prove that si holds the private key.
+func checkNode(si *network.ServerIdentity) *nodeHealth {
+	h := &nodeHealth{si: si}
+	cl := status.NewClient()
+	defer cl.Close()
+	start := time.Now()
+	resp, cerr := cl.Request(si)
+	h.rtt = time.Since(start)
+	if cerr != nil {
+		h.err = cerr
+		return h
+	}
+	h.reachable = true
+	if resp.ServerIdentity != nil && resp.ServerIdentity.Public != nil {
+		h.keyMatch = resp.ServerIdentity.Public.Equal(si.Public)
+	}
+	h.services = availableServices(resp.Msg)
+	if h.services == nil {
+		h.err = errors.New("no list of services in the status")
+	}
+	return h
+}
+
+// availableServices returns the sorted services of a status response.
+func availableServices(msg map[string]*onet.Status) []string {
+	for _, st := range msg {
+		if st == nil {
+			continue
+		}
+		if list, ok := st.Field["Available_Services"]; ok {
+			services := strings.Split(list, ",")
+			sort.Strings(services)
+			return services
+		}
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+/*
+The key-commands manage the keystore holding the keys of OTS writers and
+readers. The passphrase of the keystore is read from the OTS_PASSPHRASE
+environment variable, from the file given with --passphrase-file or else
+from the terminal, without echo.
+*/
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dedis/cothority_template/ots/keystore"
+	"github.com/dedis/cothority_template/ots/util"
+	"golang.org/x/crypto/ssh/terminal"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// passphraseEnv is the environment variable holding the passphrase of the
+// keystore.
+const passphraseEnv = "OTS_PASSPHRASE"
+
+// stdin is shared by everything reading lines from the standard input.
+var stdin = bufio.NewReader(os.Stdin)
+
+func keyCommands() []cli.Command {
+	suiteFlag := cli.StringFlag{
+		Name:  "suite",
+		Value: util.SuiteEd25519,
+		Usage: "cryptographic suite of the key",
+	}
+	return []cli.Command{
+		{
+			Name:      "create",
+			Usage:     "create a new key",
+			ArgsUsage: "name",
+			Action:    withOutput("key create", cmdKeyCreate),
+			Flags:     []cli.Flag{suiteFlag},
+		},
+		{
+			Name:      "import",
+			Usage:     "import a base64-encoded private key read from a file",
+			ArgsUsage: "name keyfile",
+			Action:    withOutput("key import", cmdKeyImport),
+			Flags:     []cli.Flag{suiteFlag},
+		},
+		{
+			Name:      "export",
+			Usage:     "print the base64-encoded private key",
+			ArgsUsage: "name",
+			Action:    withOutput("key export", cmdKeyExport),
+		},
+		{
+			Name:   "list",
+			Usage:  "list the names and public keys",
+			Action: withOutput("key list", cmdKeyList),
+		},
+		{
+			Name:      "delete",
+			Usage:     "delete a key",
+			ArgsUsage: "name",
+			Action:    withOutput("key delete", cmdKeyDelete),
+		},
+	}
+}
+
+// Creates a key and prints its public key.
+func cmdKeyCreate(c *cli.Context, out *output) error {
+	if c.NArg() != 1 {
+		return cli.NewExitError("Please give the name of the key", exitUsage)
+	}
+	ks, err := openKeystore(c)
+	if err != nil {
+		return err
+	}
+	key, err := ks.Create(c.Args().First(), c.String("suite"))
+	if err != nil {
+		return cli.NewExitError("Could not create key: "+err.Error(), exitError)
+	}
+	return printPublicKey(out, key)
+}
+
+// Imports a private key from a file. The standard input is left for the
+// passphrase.
+func cmdKeyImport(c *cli.Context, out *output) error {
+	if c.NArg() != 2 {
+		return cli.NewExitError("Please give the name of the key and the file holding it", exitUsage)
+	}
+	suite, err := util.GetSuite(c.String("suite"))
+	if err != nil {
+		return cli.NewExitError(err, exitUsage)
+	}
+	buf, err := ioutil.ReadFile(c.Args().Get(1))
+	if err != nil {
+		return cli.NewExitError("Could not read private key: "+err.Error(), exitUsage)
+	}
+	priv, err := util.String64ToScalar(suite, strings.TrimSpace(string(buf)))
+	if err != nil {
+		return cli.NewExitError("Invalid private key: "+err.Error(), exitUsage)
+	}
+	ks, err := openKeystore(c)
+	if err != nil {
+		return err
+	}
+	key, err := ks.Import(c.Args().First(), c.String("suite"), priv)
+	if err != nil {
+		return cli.NewExitError("Could not import key: "+err.Error(), exitError)
+	}
+	return printPublicKey(out, key)
+}
+
+// Prints the private key of a key.
+func cmdKeyExport(c *cli.Context, out *output) error {
+	if c.NArg() != 1 {
+		return cli.NewExitError("Please give the name of the key", exitUsage)
+	}
+	ks, err := openKeystore(c)
+	if err != nil {
+		return err
+	}
+	key, err := ks.Get(c.Args().First())
+	if err != nil {
+		return cli.NewExitError("Could not get key: "+err.Error(), exitError)
+	}
+	priv, err := util.ScalarToString64(key.Private())
+	if err != nil {
+		return cli.NewExitError(err, exitError)
+	}
+	out.Result = map[string]interface{}{
+		"name":    key.Name,
+		"suite":   key.SuiteID,
+		"private": priv,
+	}
+	if !out.json {
+		fmt.Println(priv)
+	}
+	return nil
+}
+
+// Lists the keys without decrypting them.
+func cmdKeyList(c *cli.Context, out *output) error {
+	ks, err := keystore.Open(keystorePath(c), nil)
+	if err != nil {
+		return cli.NewExitError("Could not open keystore: "+err.Error(), exitError)
+	}
+	keys := []map[string]interface{}{}
+	for _, e := range ks.List() {
+		keys = append(keys, map[string]interface{}{
+			"name":   e.Name,
+			"suite":  e.Suite,
+			"public": e.Public,
+		})
+		out.infof("%s\t%s\t%s", e.Name, e.Suite, e.Public)
+	}
+	out.Result = keys
+	return nil
+}
+
+// Deletes a key.
+func cmdKeyDelete(c *cli.Context, out *output) error {
+	if c.NArg() != 1 {
+		return cli.NewExitError("Please give the name of the key", exitUsage)
+	}
+	ks, err := keystore.Open(keystorePath(c), nil)
+	if err != nil {
+		return cli.NewExitError("Could not open keystore: "+err.Error(), exitError)
+	}
+	if err := ks.Delete(c.Args().First()); err != nil {
+		return cli.NewExitError("Could not delete key: "+err.Error(), exitError)
+	}
+	return nil
+}
+
+func printPublicKey(out *output, key *keystore.Key) error {
+	pub, err := util.PointToString64(key.Public)
+	if err != nil {
+		return cli.NewExitError(err, exitError)
+	}
+	out.Result = map[string]interface{}{
+		"name":   key.Name,
+		"suite":  key.SuiteID,
+		"public": pub,
+	}
+	out.info("Public key:", pub)
+	return nil
+}
+
+// keystorePath returns the keystore given with --keystore, or the default
+// one in the home directory.
+func keystorePath(c *cli.Context) string {
+	if path := c.GlobalString("keystore"); path != "" {
+		return path
+	}
+	return filepath.Join(os.Getenv("HOME"), ".ots", "keystore.json")
+}
+
+// openKeystore opens the keystore with its passphrase.
+func openKeystore(c *cli.Context) (*keystore.Keystore, error) {
+	passphrase, err := readPassphrase(c)
+	if err != nil {
+		return nil, cli.NewExitError("Could not read passphrase: "+err.Error(), exitUsage)
+	}
+	ks, err := keystore.Open(keystorePath(c), passphrase)
+	if err != nil {
+		return nil, cli.NewExitError("Could not open keystore: "+err.Error(), exitError)
+	}
+	return ks, nil
+}
+
+func readPassphrase(c *cli.Context) ([]byte, error) {
+	if p := os.Getenv(passphraseEnv); p != "" {
+		return []byte(p), nil
+	}
+	if fname := c.GlobalString("passphrase-file"); fname != "" {
+		buf, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strings.TrimRight(string(buf), "\r\n")), nil
+	}
+	fmt.Fprint(os.Stderr, "Passphrase: ")
+	if fd := int(os.Stdin.Fd()); terminal.IsTerminal(fd) {
+		p, err := terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{}, p...), nil
+	}
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		return nil, err
+	}
+	return []byte(strings.TrimRight(line, "\r\n")), nil
+}
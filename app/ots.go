@@ -0,0 +1,654 @@
+package main
+
+/*
+The ots-commands are the front end of the one-time secrets: a writer stores
+an encrypted file for a reader on the access-control skipchain, the reader
+logs its read on the skipchain and gets the secret from the
+secret-management cothority to decrypt the file.
+*/
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/cothority_template/ots"
+	"github.com/dedis/cothority_template/ots/keystore"
+	"github.com/dedis/cothority_template/ots/util"
+	otsstore "github.com/dedis/cothority_template/otsstore/service"
+	ocs "github.com/dedis/onchain-secrets"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/crypto.v0/share/pvss"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/crypto"
+	"gopkg.in/dedis/onet.v1/network"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// Exit codes of the ots-commands.
+const (
+	// exitError is used for errors not covered below, e.g. local files.
+	exitError = 1
+	// exitUsage is used for missing or malformed arguments.
+	exitUsage = 2
+	// exitNetwork is used when the cothority can't be reached or refuses
+	// a request.
+	exitNetwork = 3
+	// exitVerify is used when a signature, proof or hash doesn't verify.
+	exitVerify = 4
+)
+
+func otsCommands() []cli.Command {
+	acFlag := cli.StringFlag{
+		Name:  "ac",
+		Usage: "group-definition-file of the access-control cothority",
+	}
+	scFlag := cli.StringFlag{
+		Name:  "sc",
+		Usage: "group-definition-file of the secret-management cothority",
+	}
+	chainFlag := cli.StringFlag{
+		Name:  "chain",
+		Usage: "hex-encoded ID of the access-control skipchain",
+	}
+	keyFlag := cli.StringFlag{
+		Name:  "key",
+		Usage: "name of the reader's key in the keystore",
+	}
+	storeFlag := cli.StringFlag{
+		Name:  "store",
+		Usage: "directory holding the encrypted files",
+	}
+	suiteFlag := cli.StringFlag{
+		Name:  "suite",
+		Value: util.SuiteEd25519,
+		Usage: "cryptographic suite of the write transaction",
+	}
+	return []cli.Command{
+		{
+			Name:      "write",
+			Usage:     "encrypt a file for a reader and log it on the skipchain",
+			ArgsUsage: "file",
+			Action:    withOutput("ots write", cmdOTSWrite),
+			Flags: []cli.Flag{
+				acFlag, scFlag, chainFlag, storeFlag, suiteFlag,
+				cli.StringFlag{
+					Name:  "key",
+					Usage: "name of the writer's key in the keystore",
+				},
+				cli.StringFlag{
+					Name:  "reader",
+					Usage: "name of the reader's key in the keystore, or its base64-encoded public key",
+				},
+				cli.IntFlag{
+					Name:  "erasure",
+					Usage: "store the encrypted file on the secret-management cothority, any `k` of whose conodes can rebuild it",
+				},
+				cli.IntFlag{
+					Name:  "threshold",
+					Usage: "number of trustees needed to recover the secret (default 2n/3+1)",
+				},
+				cli.IntFlag{
+					Name:  "chunk",
+					Value: ots.DefaultChunkSize,
+					Usage: "chunk size of the encrypted file",
+				},
+				cli.BoolFlag{
+					Name:  "pad",
+					Usage: "pad the file to a multiple of the chunk size",
+				},
+			},
+		},
+		{
+			Name:      "read",
+			Usage:     "log a read request for a write transaction on the skipchain",
+			ArgsUsage: "writeID",
+			Action:    withOutput("ots read", cmdOTSRead),
+			Flags:     []cli.Flag{acFlag, chainFlag, keyFlag},
+		},
+		{
+			Name:      "decrypt",
+			Usage:     "get the secret of a write transaction and decrypt its file",
+			ArgsUsage: "writeID",
+			Action:    withOutput("ots decrypt", cmdOTSDecrypt),
+			Flags: []cli.Flag{
+				acFlag, scFlag, chainFlag, keyFlag, storeFlag,
+				cli.StringFlag{
+					Name:  "read",
+					Usage: "hex-encoded ID of the read transaction",
+				},
+				cli.StringFlag{
+					Name:  "writer",
+					Usage: "base64-encoded public key of the writer, to verify the write transaction",
+				},
+				cli.BoolFlag{
+					Name:  "no-verify-writer",
+					Usage: "decrypt without a --writer to check the write transaction against",
+				},
+				cli.StringFlag{
+					Name:  "o",
+					Usage: "output file, instead of the standard output",
+				},
+				cli.StringFlag{
+					Name:  "transcript",
+					Usage: "file to write the transcript of the decryption to, for 'ots verify' - it discloses the secret",
+				},
+			},
+		},
+		{
+			Name:      "verify",
+			Usage:     "check the signatures and proofs of a decryption transcript against the --ac roster, or the genesis roster of the --chain",
+			ArgsUsage: "transcript",
+			Action:    withOutput("ots verify", cmdOTSVerify),
+			Flags: []cli.Flag{
+				acFlag, chainFlag,
+				cli.StringFlag{
+					Name:  "writer",
+					Usage: "base64-encoded public key of the writer, to verify the write transaction",
+				},
+				cli.BoolFlag{
+					Name:  "no-verify-writer",
+					Usage: "verify without a --writer to check the write transaction against",
+				},
+			},
+		},
+		{
+			Name:      "inspect",
+			Usage:     "show the content of an access-control skipblock",
+			ArgsUsage: "blockID",
+			Action:    withOutput("ots inspect", cmdOTSInspect),
+			Flags:     []cli.Flag{acFlag},
+		},
+	}
+}
+
+// Encrypts a file and stores the write transaction.
+func cmdOTSWrite(c *cli.Context, out *output) error {
+	if c.NArg() != 1 {
+		return cli.NewExitError("Please give the file to write", exitUsage)
+	}
+	acRoster, err := readRoster(c, "ac")
+	if err != nil {
+		return err
+	}
+	scRoster, err := readRoster(c, "sc")
+	if err != nil {
+		return err
+	}
+	suite, err := util.GetSuite(c.String("suite"))
+	if err != nil {
+		return cli.NewExitError(err, exitUsage)
+	}
+	ks, err := openKeystore(c)
+	if err != nil {
+		return err
+	}
+	wrKey, err := readKey(c, ks)
+	if err != nil {
+		return err
+	}
+	readerPk, err := readPublicKey(ks, suite, c.String("reader"))
+	if err != nil {
+		return err
+	}
+	if c.Int("erasure") == 0 && c.String("store") == "" {
+		return cli.NewExitError("Please give either --store or --erasure", exitUsage)
+	}
+	mesg, err := ioutil.ReadFile(c.Args().First())
+	if err != nil {
+		return cli.NewExitError(err, exitError)
+	}
+	scurl, err := readChain(c, acRoster, true)
+	if err != nil {
+		return err
+	}
+
+	dp, err := util.NewDataPVSS(c.String("suite"), scRoster.Publics(), len(scRoster.List))
+	if err != nil {
+		return cli.NewExitError(err, exitUsage)
+	}
+	dp.Threshold = c.Int("threshold")
+	if err = ots.SetupPVSS(dp, readerPk); err != nil {
+		return cli.NewExitError("Could not setup PVSS: "+err.Error(), exitError)
+	}
+	opts := &ots.EnvelopeOptions{ChunkSize: c.Int("chunk")}
+	if c.Bool("pad") {
+		opts.Padding = ots.PaddingChunk
+	}
+	encMesg, hashEnc, err := ots.EncryptMessage(dp, mesg, opts)
+	if err != nil {
+		return cli.NewExitError("Could not encrypt file: "+err.Error(), exitError)
+	}
+	att, err := ots.ValidateWriteTxn(scRoster, dp, readerPk)
+	if err != nil {
+		return cli.NewExitError("Trustees did not attest the write transaction: "+err.Error(), exitVerify)
+	}
+	wtd := ots.NewWriteTxnData(dp, att, hashEnc, nil, readerPk)
+
+	var frags []*otsstore.Fragment
+	if k := c.Int("erasure"); k > 0 {
+		var root []byte
+		frags, root, err = ots.FragmentEnvelope(encMesg, len(scRoster.List), k)
+		if err != nil {
+			return cli.NewExitError("Could not encode encrypted file: "+err.Error(), exitUsage)
+		}
+		wtd.MerkleRoot = root
+		if err = ots.StoreEnvelope(scRoster, frags, wtd, wrKey); err != nil {
+			return cli.NewExitError("Could not store encrypted file: "+err.Error(), exitNetwork)
+		}
+	} else {
+		store, err := ots.NewDirStorage(c.String("store"))
+		if err != nil {
+			return cli.NewExitError(err, exitError)
+		}
+		if _, err = ots.UploadEnvelope(store, encMesg); err != nil {
+			return cli.NewExitError("Could not store encrypted file: "+err.Error(), exitError)
+		}
+	}
+
+	writeSB, err := ots.AppendWriteTxn(scurl, wtd, wrKey)
+	if err != nil {
+		return cli.NewExitError("Could not create write transaction: "+err.Error(), exitNetwork)
+	}
+	if frags != nil {
+		if err = ots.ConfirmEnvelope(scRoster, frags, scurl, writeSB); err != nil {
+			return cli.NewExitError("Could not confirm encrypted file: "+err.Error(), exitNetwork)
+		}
+	}
+	out.Result = map[string]interface{}{
+		"chain":    hex.EncodeToString(scurl.Genesis),
+		"write_id": hex.EncodeToString(writeSB.Hash),
+	}
+	out.info("Chain:", hex.EncodeToString(scurl.Genesis))
+	out.info("Write ID:", hex.EncodeToString(writeSB.Hash))
+	return nil
+}
+
+// Logs a read request on the skipchain.
+func cmdOTSRead(c *cli.Context, out *output) error {
+	writeID, err := readBlockID(c)
+	if err != nil {
+		return err
+	}
+	acRoster, err := readRoster(c, "ac")
+	if err != nil {
+		return err
+	}
+	scurl, err := readChain(c, acRoster, false)
+	if err != nil {
+		return err
+	}
+	ks, err := openKeystore(c)
+	if err != nil {
+		return err
+	}
+	key, err := readKey(c, ks)
+	if err != nil {
+		return err
+	}
+	readSB, err := ots.CreateReadTxn(scurl, writeID, key)
+	if err != nil {
+		return cli.NewExitError("Could not create read transaction: "+err.Error(), exitNetwork)
+	}
+	out.Result = map[string]interface{}{
+		"read_id": hex.EncodeToString(readSB.Hash),
+	}
+	out.info("Read ID:", hex.EncodeToString(readSB.Hash))
+	return nil
+}
+
+// Recovers the secret of a write transaction and decrypts its file.
+func cmdOTSDecrypt(c *cli.Context, out *output) error {
+	writeID, err := readBlockID(c)
+	if err != nil {
+		return err
+	}
+	readID, err := hex.DecodeString(c.String("read"))
+	if err != nil || len(readID) == 0 {
+		return cli.NewExitError("Please give the hex-encoded ID of the read transaction", exitUsage)
+	}
+	if c.String("writer") == "" && !c.Bool("no-verify-writer") {
+		return cli.NewExitError("Please give the public key of the writer with --writer, or --no-verify-writer to skip the check", exitUsage)
+	}
+	acRoster, err := readRoster(c, "ac")
+	if err != nil {
+		return err
+	}
+	scRoster, err := readRoster(c, "sc")
+	if err != nil {
+		return err
+	}
+	scurl, err := readChain(c, acRoster, false)
+	if err != nil {
+		return err
+	}
+	ks, err := openKeystore(c)
+	if err != nil {
+		return err
+	}
+	key, err := readKey(c, ks)
+	if err != nil {
+		return err
+	}
+
+	_, writeTxnData, sig, err := ots.GetWriteTxnSB(scurl, writeID)
+	if err != nil {
+		return cli.NewExitError("Could not get write transaction: "+err.Error(), exitNetwork)
+	}
+	suite, err := util.GetSuite(writeTxnData.SuiteID)
+	if err != nil {
+		return cli.NewExitError("Could not use the suite of the write transaction: "+err.Error(), exitVerify)
+	}
+	if c.String("writer") != "" {
+		wrPubKey, err := crypto.String64ToPoint(suite, c.String("writer"))
+		if err != nil {
+			return cli.NewExitError("Please give a valid writer public key: "+err.Error(), exitUsage)
+		}
+		if err = ots.VerifyTxnSignature(suite, writeTxnData, sig, wrPubKey); err != nil {
+			return cli.NewExitError("Invalid signature on the write transaction: "+err.Error(), exitVerify)
+		}
+	}
+	updWriteSB, err := ots.GetUpdatedWriteTxnSB(scurl, writeID)
+	if err != nil {
+		return cli.NewExitError("Could not get write transaction: "+err.Error(), exitNetwork)
+	}
+	readSB, err := ots.GetReadTxnSB(scurl, readID)
+	if err != nil {
+		return cli.NewExitError("Could not get read transaction: "+err.Error(), exitNetwork)
+	}
+
+	var decShares []*pvss.PubVerShare
+	if c.String("transcript") != "" {
+		t, err := ots.GetTranscript(scRoster, updWriteSB, readSB, key)
+		if err != nil {
+			return cli.NewExitError("Could not get the decrypted shares: "+err.Error(), exitNetwork)
+		}
+		buf, err := t.Export()
+		if err != nil {
+			return cli.NewExitError(err, exitError)
+		}
+		if err = ioutil.WriteFile(c.String("transcript"), buf, 0600); err != nil {
+			return cli.NewExitError(err, exitError)
+		}
+		decShares = t.DecShares
+	} else {
+		decShares, err = ots.GetDecryptedShares(scurl, scRoster, updWriteSB, readSB.SkipBlockFix,
+			updWriteSB.Roster.Publics(), writeTxnData.SCPublicKeys, key, readSB.Index)
+		if err != nil {
+			return cli.NewExitError("Could not get the decrypted shares: "+err.Error(), exitNetwork)
+		}
+	}
+	recSecret, err := ots.RecoverSecret(suite, writeTxnData, decShares, 0)
+	if err != nil {
+		return cli.NewExitError("Could not recover secret: "+err.Error(), exitVerify)
+	}
+
+	var encMesg []byte
+	if writeTxnData.MerkleRoot != nil {
+		encMesg, err = ots.RetrieveEnvelope(scRoster, writeTxnData)
+		if err != nil {
+			return cli.NewExitError("Could not retrieve encrypted file: "+err.Error(), exitNetwork)
+		}
+	} else {
+		if c.String("store") == "" {
+			return cli.NewExitError("Please give the --store holding the encrypted file", exitUsage)
+		}
+		store, err := ots.NewDirStorage(c.String("store"))
+		if err != nil {
+			return cli.NewExitError(err, exitError)
+		}
+		encMesg, err = ots.FetchEnvelope(store, writeTxnData)
+		if err == ots.ErrNotFound {
+			return cli.NewExitError(err, exitError)
+		} else if err != nil {
+			return cli.NewExitError(err, exitVerify)
+		}
+	}
+	mesg, err := ots.DecryptMessage(recSecret, encMesg, writeTxnData)
+	if err != nil {
+		return cli.NewExitError("Could not decrypt file: "+err.Error(), exitVerify)
+	}
+
+	result := map[string]interface{}{
+		"size": len(mesg),
+	}
+	out.Result = result
+	switch {
+	case c.String("o") != "":
+		result["output"] = c.String("o")
+		err = ioutil.WriteFile(c.String("o"), mesg, 0600)
+	case out.json:
+		result["data"] = mesg
+	default:
+		_, err = os.Stdout.Write(mesg)
+	}
+	if err != nil {
+		return cli.NewExitError(err, exitError)
+	}
+	return nil
+}
+
+// Checks a transcript written by 'ots decrypt --transcript' against the
+// access-control roster given with --ac and the writer given with --writer,
+// without contacting the cothority. With --chain instead, the roster of the
+// genesis block of the skipchain is fetched from the conodes named in the
+// transcript.
+func cmdOTSVerify(c *cli.Context, out *output) error {
+	if c.NArg() < 1 {
+		return cli.NewExitError("Please give the transcript to verify", exitUsage)
+	}
+	if c.String("writer") == "" && !c.Bool("no-verify-writer") {
+		return cli.NewExitError("Please give the public key of the writer with --writer, or --no-verify-writer to skip the check", exitUsage)
+	}
+	buf, err := ioutil.ReadFile(c.Args().First())
+	if err != nil {
+		return cli.NewExitError(err, exitError)
+	}
+	t, err := ots.ImportTranscript(buf)
+	if err != nil {
+		return cli.NewExitError("Could not read transcript: "+err.Error(), exitUsage)
+	}
+
+	var acRoster *onet.Roster
+	switch {
+	case c.String("ac") != "" && c.String("chain") != "":
+		return cli.NewExitError("Please give either --ac or --chain", exitUsage)
+	case c.String("ac") != "":
+		acRoster, err = readRoster(c, "ac")
+		if err != nil {
+			return err
+		}
+	case c.String("chain") != "":
+		genesis, err := hex.DecodeString(c.String("chain"))
+		if err != nil || len(genesis) == 0 {
+			return cli.NewExitError("Invalid skipchain ID", exitUsage)
+		}
+		acRoster, err = ots.GenesisRoster(t, genesis)
+		if err == ots.ErrOtherChain {
+			return cli.NewExitError(err, exitVerify)
+		} else if err != nil {
+			return cli.NewExitError("Could not get the genesis block: "+err.Error(), exitNetwork)
+		}
+	default:
+		return cli.NewExitError("Please give the access-control roster to trust with --ac or --chain", exitUsage)
+	}
+
+	var writer abstract.Point
+	if c.String("writer") != "" {
+		wtd, _, err := t.WriteTxn()
+		if err != nil {
+			return cli.NewExitError("Could not read the write transaction: "+err.Error(), exitVerify)
+		}
+		suite, err := util.GetSuite(wtd.SuiteID)
+		if err != nil {
+			return cli.NewExitError("Could not use the suite of the write transaction: "+err.Error(), exitVerify)
+		}
+		writer, err = crypto.String64ToPoint(suite, c.String("writer"))
+		if err != nil {
+			return cli.NewExitError("Please give a valid writer public key: "+err.Error(), exitUsage)
+		}
+	}
+
+	report := ots.VerifyTranscript(t, acRoster, writer)
+	checks := []map[string]interface{}{}
+	for _, check := range report {
+		res := map[string]interface{}{
+			"name":   check.Name,
+			"detail": check.Detail,
+			"passed": check.Err == nil,
+		}
+		if check.Err != nil {
+			res["error"] = check.Err.Error()
+			out.info("FAIL", check.Name+":", check.Detail+":", check.Err)
+		} else {
+			out.info("PASS", check.Name+":", check.Detail)
+		}
+		checks = append(checks, res)
+	}
+	out.Result = map[string]interface{}{
+		"checks": checks,
+		"passed": report.Passed(),
+	}
+	if !report.Passed() {
+		return cli.NewExitError("Transcript does not verify", exitVerify)
+	}
+	return nil
+}
+
+// Shows the write or read transaction stored in a skipblock.
+func cmdOTSInspect(c *cli.Context, out *output) error {
+	blockID, err := readBlockID(c)
+	if err != nil {
+		return err
+	}
+	acRoster, err := readRoster(c, "ac")
+	if err != nil {
+		return err
+	}
+	cl := skipchain.NewClient()
+	defer cl.Close()
+	sb, cerr := cl.GetSingleBlock(acRoster, blockID)
+	if cerr != nil {
+		return cli.NewExitError("Could not get block: "+cerr.Error(), exitNetwork)
+	}
+
+	result := map[string]interface{}{
+		"block":         hex.EncodeToString(sb.Hash),
+		"index":         sb.Index,
+		"forward_links": len(sb.ForwardLink),
+		"type":          "none",
+	}
+	out.Result = result
+	out.info("Block:", hex.EncodeToString(sb.Hash))
+	out.info("Index:", sb.Index)
+	out.info("Forward-links:", len(sb.ForwardLink))
+	_, msg, err := network.Unmarshal(sb.Data)
+	data, ok := msg.(*ocs.DataOCS)
+	if err != nil || !ok {
+		out.info("Type: no OTS transaction")
+		return nil
+	}
+	if data.WriteTxn != nil {
+		wtd := data.WriteTxn.Data
+		if wtd == nil {
+			result["type"] = "invalid"
+			out.info("Type: write transaction without data")
+			return cli.NewExitError("Block holds a write transaction without data", exitVerify)
+		}
+		reader, _ := util.PointToString64(wtd.ReaderPk)
+		result["type"] = "write"
+		result["reader"] = reader
+		result["trustees"] = len(wtd.SCPublicKeys)
+		result["threshold"] = wtd.Threshold
+		result["hash"] = hex.EncodeToString(wtd.HashEnc)
+		out.info("Type: write transaction")
+		out.info("Reader:", reader)
+		out.info("Trustees:", len(wtd.SCPublicKeys))
+		out.info("Threshold:", wtd.Threshold)
+		out.info("Encrypted file hash:", hex.EncodeToString(wtd.HashEnc))
+		if wtd.MerkleRoot != nil {
+			result["merkle_root"] = hex.EncodeToString(wtd.MerkleRoot)
+			out.info("Stored on the cothority, Merkle root:", hex.EncodeToString(wtd.MerkleRoot))
+		}
+	}
+	if data.Read != nil {
+		result["type"] = "read"
+		result["write_id"] = hex.EncodeToString(data.Read.DataID)
+		out.info("Type: read transaction")
+		out.info("Write ID:", hex.EncodeToString(data.Read.DataID))
+	}
+	return nil
+}
+
+// readRoster reads the group-definition-file given in the flag name.
+func readRoster(c *cli.Context, name string) (*onet.Roster, error) {
+	if c.String(name) == "" {
+		return nil, cli.NewExitError("Please give the group-definition-file with --"+name, exitUsage)
+	}
+	el, err := util.ReadRoster(c.String(name))
+	if err != nil {
+		return nil, cli.NewExitError(err, exitUsage)
+	}
+	return el, nil
+}
+
+// readChain returns the skipchain given with --chain. If create is true and
+// no chain is given, a new skipchain is created on roster.
+func readChain(c *cli.Context, roster *onet.Roster, create bool) (*ocs.SkipChainURL, error) {
+	if c.String("chain") == "" {
+		if !create {
+			return nil, cli.NewExitError("Please give the skipchain with --chain", exitUsage)
+		}
+		scurl, err := ots.CreateSkipchain(roster)
+		if err != nil {
+			return nil, cli.NewExitError("Could not create skipchain: "+err.Error(), exitNetwork)
+		}
+		return scurl, nil
+	}
+	genesis, err := hex.DecodeString(c.String("chain"))
+	if err != nil {
+		return nil, cli.NewExitError("Invalid skipchain ID: "+err.Error(), exitUsage)
+	}
+	return &ocs.SkipChainURL{Roster: roster, Genesis: genesis}, nil
+}
+
+// readBlockID returns the hex-encoded block ID given as argument.
+func readBlockID(c *cli.Context) (skipchain.SkipBlockID, error) {
+	if c.NArg() != 1 {
+		return nil, cli.NewExitError("Please give the block ID as argument", exitUsage)
+	}
+	id, err := hex.DecodeString(c.Args().First())
+	if err != nil || len(id) == 0 {
+		return nil, cli.NewExitError("Invalid block ID", exitUsage)
+	}
+	return id, nil
+}
+
+// readKey returns the key named with --key.
+func readKey(c *cli.Context, ks *keystore.Keystore) (*keystore.Key, error) {
+	if c.String("key") == "" {
+		return nil, cli.NewExitError("Please give the name of a key with --key", exitUsage)
+	}
+	key, err := ks.Get(c.String("key"))
+	if err != nil {
+		return nil, cli.NewExitError("Could not get key: "+err.Error(), exitUsage)
+	}
+	return key, nil
+}
+
+// readPublicKey returns the public key of the keystore entry name, or parses
+// name as a base64-encoded public key of suite.
+func readPublicKey(ks *keystore.Keystore, suite abstract.Suite, name string) (abstract.Point, error) {
+	for _, e := range ks.List() {
+		if e.Name == name {
+			name = e.Public
+			break
+		}
+	}
+	pub, err := crypto.String64ToPoint(suite, name)
+	if err != nil || name == "" {
+		return nil, cli.NewExitError("Please give the reader's key name or public key with --reader", exitUsage)
+	}
+	return pub, nil
+}
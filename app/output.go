@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// outputVersion is the version of the JSON document of the commands. It is
+// increased whenever a field changes its meaning or goes away.
+const outputVersion = 1
+
+// output collects what a command reports. With --format text it is printed
+// through the log as it comes in, with --format json all of it is printed as
+// one document once the command is done:
+//
+//	{
+//	  "version": 1,
+//	  "command": "counter",
+//	  "result": {...},
+//	  "nodes": [{"address": "tcp://...", "public": "...", ...}],
+//	  "errors": ["..."]
+//	}
+//
+// The fields of "result" and of the nodes depend on the command; "nodes"
+// and "errors" are always present, possibly empty. With --format json the
+// document is the only thing on the standard output: the log of onet goes
+// to the standard error.
+type output struct {
+	Version int           `json:"version"`
+	Command string        `json:"command"`
+	Result  interface{}   `json:"result"`
+	Nodes   []*nodeOutput `json:"nodes"`
+	Errors  []string      `json:"errors"`
+	json    bool
+}
+
+// nodeOutput is the part of the output about one server.
+type nodeOutput struct {
+	Address string `json:"address"`
+	Public  string `json:"public,omitempty"`
+	// Error is set if the server failed.
+	Error   string                 `json:"error,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// withOutput returns the action running cmd. It reports the errors of cmd
+// in the JSON document, but keeps its exit code.
+func withOutput(command string, cmd func(c *cli.Context, out *output) error) func(c *cli.Context) error {
+	return func(c *cli.Context) error {
+		out := &output{
+			Version: outputVersion,
+			Command: command,
+			Nodes:   []*nodeOutput{},
+			Errors:  []string{},
+		}
+		switch c.GlobalString("format") {
+		case "text":
+		case "json":
+			out.json = true
+		default:
+			return cli.NewExitError("Unknown format: "+c.GlobalString("format"), exitUsage)
+		}
+		if !out.json {
+			return cmd(c, out)
+		}
+		stdout := os.Stdout
+		os.Stdout = os.Stderr
+		log.OutputToOs()
+		err := cmd(c, out)
+		os.Stdout = stdout
+		log.OutputToOs()
+		code := 0
+		if err != nil {
+			out.Errors = append(out.Errors, err.Error())
+			code = exitError
+			if ec, ok := err.(cli.ExitCoder); ok {
+				code = ec.ExitCode()
+			}
+		}
+		buf, jerr := json.MarshalIndent(out, "", "  ")
+		if jerr != nil {
+			return cli.NewExitError(jerr, exitError)
+		}
+		fmt.Fprintln(stdout, string(buf))
+		if code != 0 {
+			return cli.NewExitError("", code)
+		}
+		return nil
+	}
+}
+
+// info prints a line of the text output.
+func (o *output) info(args ...interface{}) {
+	if !o.json {
+		log.Info(args...)
+	}
+}
+
+// infof prints a formatted line of the text output.
+func (o *output) infof(format string, args ...interface{}) {
+	if !o.json {
+		log.Infof(format, args...)
+	}
+}
+
+// node adds a server to the output and returns it for filling in details.
+func (o *output) node(address, public string) *nodeOutput {
+	n := &nodeOutput{
+		Address: address,
+		Public:  public,
+		Details: map[string]interface{}{},
+	}
+	o.Nodes = append(o.Nodes, n)
+	return n
+}
+
+// warn records an error that doesn't stop the command.
+func (o *output) warn(err error) {
+	o.Errors = append(o.Errors, err.Error())
+	if !o.json {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+/*
+The storage-commands back up and restore the data a service keeps on a
+conode. The data isn't meant for clients, so the requests are signed with
+the private key of the conode, read from its private.toml.
+*/
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/BurntSushi/toml"
+	template "github.com/dedis/cothority_template"
+	"github.com/dedis/cothority_template/persist"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/onet.v1/app"
+	"gopkg.in/dedis/onet.v1/crypto"
+	"gopkg.in/dedis/onet.v1/network"
+	"gopkg.in/urfave/cli.v1"
+)
+
+func storageCommands() []cli.Command {
+	serviceFlag := cli.StringFlag{
+		Name:  "service",
+		Value: template.ServiceName,
+		Usage: "name of the service, such as OTSStoreService",
+	}
+	return []cli.Command{
+		{
+			Name:      "export",
+			Usage:     "write the data of a service to a file",
+			ArgsUsage: "private.toml file",
+			Action:    withOutput("storage export", cmdStorageExport),
+			Flags:     []cli.Flag{serviceFlag},
+		},
+		{
+			Name:      "import",
+			Usage:     "replace the data of a service with an exported file",
+			ArgsUsage: "private.toml file",
+			Action:    withOutput("storage import", cmdStorageImport),
+			Flags:     []cli.Flag{serviceFlag},
+		},
+	}
+}
+
+// Writes the data of a service of the conode to a file.
+func cmdStorageExport(c *cli.Context, out *output) error {
+	si, priv, err := readConode(c)
+	if err != nil {
+		return err
+	}
+	buf, err := persist.NewClient(c.String("service")).Export(si, priv)
+	if err != nil {
+		return cli.NewExitError("Could not export: "+err.Error(), exitNetwork)
+	}
+	if buf == nil {
+		return cli.NewExitError("The service has no data to export", exitError)
+	}
+	if err := ioutil.WriteFile(c.Args().Get(1), buf, 0600); err != nil {
+		return cli.NewExitError(err, exitError)
+	}
+	out.Result = map[string]interface{}{
+		"service": c.String("service"),
+		"bytes":   len(buf),
+	}
+	out.infof("Exported %d bytes of %s", len(buf), c.String("service"))
+	return nil
+}
+
+// Replaces the data of a service of the conode with an exported file.
+func cmdStorageImport(c *cli.Context, out *output) error {
+	si, priv, err := readConode(c)
+	if err != nil {
+		return err
+	}
+	buf, err := ioutil.ReadFile(c.Args().Get(1))
+	if err != nil {
+		return cli.NewExitError(err, exitUsage)
+	}
+	if err := persist.NewClient(c.String("service")).Import(si, priv, buf); err != nil {
+		return cli.NewExitError("Could not import: "+err.Error(), exitNetwork)
+	}
+	out.Result = map[string]interface{}{
+		"service": c.String("service"),
+		"bytes":   len(buf),
+	}
+	out.infof("Imported %d bytes of %s", len(buf), c.String("service"))
+	return nil
+}
+
+// readConode returns the identity and the private key of the conode in the
+// private.toml given as first argument.
+func readConode(c *cli.Context) (*network.ServerIdentity, abstract.Scalar, error) {
+	if c.NArg() != 2 {
+		return nil, nil, cli.NewExitError("Please give the private.toml of the conode and the file", exitUsage)
+	}
+	conf := &app.CothorityConfig{}
+	if _, err := toml.DecodeFile(c.Args().First(), conf); err != nil {
+		return nil, nil, cli.NewExitError("Could not read conode configuration: "+err.Error(), exitUsage)
+	}
+	priv, err := crypto.StringHexToScalar(network.Suite, conf.Private)
+	if err != nil {
+		return nil, nil, cli.NewExitError("Invalid private key: "+err.Error(), exitUsage)
+	}
+	pub, err := crypto.StringHexToPoint(network.Suite, conf.Public)
+	if err != nil {
+		return nil, nil, cli.NewExitError("Invalid public key: "+err.Error(), exitUsage)
+	}
+	if !pub.Equal(network.Suite.Point().Mul(nil, priv)) {
+		return nil, nil, cli.NewExitError(fmt.Sprintf("The keys of %s don't match", c.Args().First()), exitUsage)
+	}
+	return network.NewServerIdentity(pub, conf.Address), priv, nil
+}
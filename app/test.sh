@@ -11,6 +11,8 @@ main(){
     buildConode
 	test Count
 	test Time
+	test Check
+	test Storage
     stopTest
 }
 
@@ -21,6 +23,8 @@ testCount(){
        testGrep ": 0" runTmpl counter public.toml
        runTmpl time public.toml
        testGrep ": 1" runTmpl counter public.toml
+       testGrep '"counter": 1' runTmpl --format json counter public.toml
+       testFail runTmpl --format yaml counter public.toml
 }
 
 testTime(){
@@ -28,6 +32,27 @@ testTime(){
        testFail runTmpl time
        testOK runTmpl time public.toml
        testGrep Time runTmpl time public.toml
+       testGrep '"announce"' runTmpl --format json time public.toml
+}
+
+testCheck(){
+       runCoBG 1 2
+       testFail runTmpl check
+       testOK runTmpl check public.toml
+       testGrep "Healthy nodes: 2/2" runTmpl check public.toml
+       testGrep '"key_match": true' runTmpl --format json check public.toml
+       testFail runTmpl check --require NoSuchService public.toml
+       testFail runTmpl check --threshold 3 public.toml
+       testOK runTmpl check --threshold 1 public.toml
+}
+
+testStorage(){
+       runCoBG 1 2
+       testFail runTmpl storage export co1/private.toml
+       runTmpl time public.toml
+       testOK runTmpl storage export co1/private.toml backup.bin
+       testOK runTmpl storage import co1/private.toml backup.bin
+       testFail runTmpl storage import co2/private.toml public.toml
 }
 
 testBuild(){
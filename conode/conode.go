@@ -17,6 +17,7 @@ import (
 	_ "github.com/dedis/cothority/cosi/service"
 	_ "github.com/dedis/cothority/status/service"
 	_ "github.com/dedis/cothority_template/otssc/service"
+	_ "github.com/dedis/cothority_template/otsstore/service"
 	_ "github.com/dedis/onchain-secrets/service"
 	"gopkg.in/dedis/onet.v1/app"
 )
@@ -0,0 +1,35 @@
+//go:build linux
+// +build linux
+
+package measure
+
+import (
+	"runtime"
+	"syscall"
+
+	"gopkg.in/dedis/onet.v1/log"
+)
+
+// rusageThread is RUSAGE_THREAD, which the syscall package only defines for
+// some architectures.
+const rusageThread = 0x1
+
+// CPUTime returns the CPU seconds that f used. The goroutine is locked to its
+// thread, so that only the time of f is counted, even if other requests are
+// handled at the same time.
+func CPUTime(f func()) float64 {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	start := threadCPU()
+	f()
+	return threadCPU() - start
+}
+
+func threadCPU() float64 {
+	rusage := &syscall.Rusage{}
+	if err := syscall.Getrusage(rusageThread, rusage); err != nil {
+		log.Error("Couldn't get rusage time:", err)
+		return 0
+	}
+	return seconds(rusage.Utime) + seconds(rusage.Stime)
+}
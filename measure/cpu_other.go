@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package measure
+
+// CPUTime returns the CPU seconds that the process used while f ran. Unlike
+// on Linux, this includes the work of all other goroutines.
+func CPUTime(f func()) float64 {
+	user, system := Rusage()
+	f()
+	u, s := Rusage()
+	return u - user + s - system
+}
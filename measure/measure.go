@@ -0,0 +1,174 @@
+// Package measure records what a phase of an OTS exchange costs: its
+// wall-clock time, the user and system CPU time of the process, the bytes
+// sent and received if a counter is given and, with CountAllocs, its heap
+// allocations.
+//
+// The simulations send the samples to the onet monitor and the bench command
+// writes them to its CSV, so both use the phase names and the suffixes
+// below, and the results of one can be compared to the other.
+package measure
+
+import (
+	"runtime"
+	"syscall"
+	"time"
+
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/simul/monitor"
+)
+
+// The phases of an OTS exchange.
+const (
+	WriteTxnPrep      = "WriteTxnPrep"
+	ValidateWriteTxn  = "ValidateWriteTxn"
+	CreateWriteTxn    = "CreateWriteTxn"
+	GetWriteTxnSB     = "GetWriteTxnSB"
+	CreateReadTxn     = "CreateReadTxn"
+	GetUpdatedWriteSB = "GetUpdatedWriteSB"
+	DecReq            = "DecReq"
+	RecoverSecret     = "RecoverSecret"
+	DecryptMessage    = "DecryptMessage"
+)
+
+// The suffixes added to the name of a phase for each of its values. Wall,
+// user and system are named as by a monitor.TimeMeasure.
+const (
+	// SuffixWall is the wall-clock time in seconds.
+	SuffixWall = "_wall"
+	// SuffixUser is the user CPU time of the process in seconds.
+	SuffixUser = "_user"
+	// SuffixSystem is the system CPU time of the process in seconds.
+	SuffixSystem = "_system"
+	// SuffixAllocs is the number of heap allocations.
+	SuffixAllocs = "_allocs"
+	// SuffixAllocBytes is the number of bytes allocated on the heap.
+	SuffixAllocBytes = "_alloc_bytes"
+	// SuffixTx is the number of bytes sent.
+	SuffixTx = "_tx"
+	// SuffixRx is the number of bytes received.
+	SuffixRx = "_rx"
+)
+
+// CountAllocs makes the phases count the heap allocations. Reading them
+// stops the world, which delays all goroutines - in a local simulation, all
+// nodes - at the start and the end of every phase, so it is off by default.
+var CountAllocs = false
+
+// Sample is the cost of one run of a phase. The CPU time and the
+// allocations are those of the whole process, so they include the work of
+// other goroutines running at the same time.
+type Sample struct {
+	Name       string
+	Wall       float64
+	User       float64
+	System     float64
+	Allocs     uint64
+	AllocBytes uint64
+	// Tx and Rx are only set if the phase was started with a counter.
+	Tx      uint64
+	Rx      uint64
+	counted bool
+	// allocs is true if Allocs and AllocBytes are set.
+	allocs bool
+}
+
+// Values returns the values of s indexed by the name of the phase with
+// their suffix, such as "DecReq_wall".
+func (s *Sample) Values() map[string]float64 {
+	v := map[string]float64{
+		s.Name + SuffixWall:   s.Wall,
+		s.Name + SuffixUser:   s.User,
+		s.Name + SuffixSystem: s.System,
+	}
+	if s.allocs {
+		v[s.Name+SuffixAllocs] = float64(s.Allocs)
+		v[s.Name+SuffixAllocBytes] = float64(s.AllocBytes)
+	}
+	if s.counted {
+		v[s.Name+SuffixTx] = float64(s.Tx)
+		v[s.Name+SuffixRx] = float64(s.Rx)
+	}
+	return v
+}
+
+// Record sends the values of s to the monitor.
+func (s *Sample) Record() {
+	for name, v := range s.Values() {
+		monitor.RecordSingleMeasure(name, v)
+	}
+}
+
+// Phase is a running measurement.
+type Phase struct {
+	name        string
+	counter     monitor.CounterIO
+	start       time.Time
+	user        float64
+	system      float64
+	countAllocs bool
+	allocs      uint64
+	allocBytes  uint64
+	tx          uint64
+	rx          uint64
+}
+
+// Start starts measuring the phase name. If counter is not nil, the bytes
+// it sent and received during the phase are part of the sample; an
+// *onet.Server counts all the messages of a node.
+func Start(name string, counter monitor.CounterIO) *Phase {
+	p := &Phase{name: name, counter: counter, countAllocs: CountAllocs}
+	if counter != nil {
+		p.tx, p.rx = counter.Tx(), counter.Rx()
+	}
+	if p.countAllocs {
+		p.allocs, p.allocBytes = memStats()
+	}
+	p.user, p.system = Rusage()
+	p.start = time.Now()
+	return p
+}
+
+// Stop returns the sample of the phase since Start.
+func (p *Phase) Stop() *Sample {
+	s := &Sample{Name: p.name, Wall: time.Since(p.start).Seconds()}
+	user, system := Rusage()
+	s.User, s.System = user-p.user, system-p.system
+	if p.countAllocs {
+		allocs, allocBytes := memStats()
+		s.Allocs, s.AllocBytes = allocs-p.allocs, allocBytes-p.allocBytes
+		s.allocs = true
+	}
+	if p.counter != nil {
+		s.Tx, s.Rx = p.counter.Tx()-p.tx, p.counter.Rx()-p.rx
+		s.counted = true
+	}
+	return s
+}
+
+// Record stops the phase and sends its sample to the monitor.
+func (p *Phase) Record() *Sample {
+	s := p.Stop()
+	s.Record()
+	return s
+}
+
+// Rusage returns the user and the system CPU time used by the process so
+// far, in seconds.
+func Rusage() (user, system float64) {
+	rusage := &syscall.Rusage{}
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, rusage); err != nil {
+		log.Error("Couldn't get rusage time:", err)
+		return 0, 0
+	}
+	return seconds(rusage.Utime), seconds(rusage.Stime)
+}
+
+func seconds(tv syscall.Timeval) float64 {
+	return float64(tv.Sec) + float64(tv.Usec)/1000000.0
+}
+
+func memStats() (allocs, bytes uint64) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.Mallocs, ms.TotalAlloc
+}
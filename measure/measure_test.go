@@ -0,0 +1,68 @@
+package measure
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/dedis/onet.v1/log"
+)
+
+func TestMain(m *testing.M) {
+	log.MainTest(m)
+}
+
+type counter struct {
+	rx, tx uint64
+}
+
+func (c *counter) Rx() uint64 { return c.rx }
+func (c *counter) Tx() uint64 { return c.tx }
+
+var sink [][]byte
+
+func TestPhase(t *testing.T) {
+	defer func(b bool) { CountAllocs = b }(CountAllocs)
+	CountAllocs = true
+	c := &counter{rx: 10, tx: 20}
+	p := Start(DecReq, c)
+	for i := 0; i < 100; i++ {
+		sink = append(sink, make([]byte, 1024))
+	}
+	c.rx, c.tx = 110, 1020
+	s := p.Stop()
+	sink = nil
+
+	assert.Equal(t, DecReq, s.Name)
+	assert.True(t, s.Wall > 0)
+	assert.True(t, s.Allocs >= 100)
+	assert.True(t, s.AllocBytes >= 100*1024)
+	assert.Equal(t, uint64(100), s.Rx)
+	assert.Equal(t, uint64(1000), s.Tx)
+
+	v := s.Values()
+	assert.Equal(t, 7, len(v))
+	assert.Equal(t, s.Wall, v["DecReq_wall"])
+	assert.Equal(t, 1000.0, v["DecReq_tx"])
+	assert.Equal(t, float64(s.AllocBytes), v["DecReq_alloc_bytes"])
+
+	// Without a counter there are no bytes sent or received, and without
+	// CountAllocs no allocations.
+	CountAllocs = false
+	v = Start(RecoverSecret, nil).Stop().Values()
+	assert.Equal(t, 3, len(v))
+	_, ok := v["RecoverSecret_tx"]
+	assert.False(t, ok)
+	_, ok = v["RecoverSecret_user"]
+	assert.True(t, ok)
+}
+
+func TestCPUTime(t *testing.T) {
+	cpu := CPUTime(func() {
+		x := 0
+		for i := 0; i < 50000000; i++ {
+			x += i
+		}
+		log.Lvl5(x)
+	})
+	assert.True(t, cpu > 0)
+}
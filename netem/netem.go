@@ -0,0 +1,239 @@
+// Package netem emulates a wide-area network between the nodes of a
+// simulation running on one machine. The protocols send their messages
+// through SendTo, which delays them as if they went over a link with the
+// configured latency, jitter, bandwidth and packet loss.
+//
+// Only the messages of the protocols that use SendTo are delayed; the
+// messages between clients and services, and those of protocols from other
+// repositories, go out directly.
+package netem
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// PacketSize is the payload of one emulated packet in bytes.
+const PacketSize = 1460
+
+// RetransmitTimeout is the delay added for every lost packet, which TCP
+// sends again after its retransmission timeout.
+var RetransmitTimeout = 200 * time.Millisecond
+
+// Config describes every link between two nodes. The fields can be set in
+// the TOML file of a simulation that embeds Config.
+type Config struct {
+	// Latency is the one-way latency in milliseconds.
+	Latency int
+	// Jitter is the maximum deviation of the latency in milliseconds.
+	// Messages on a link still arrive in order, as with TCP.
+	Jitter int
+	// Bandwidth is the bandwidth of every link in Mbit/s, unlimited if 0.
+	Bandwidth float64
+	// Loss is the probability that a packet is lost, between 0 and 1.
+	Loss float64
+}
+
+// Enabled returns true if c emulates anything.
+func (c Config) Enabled() bool {
+	return c.Latency > 0 || c.Jitter > 0 || c.Bandwidth > 0 || c.Loss > 0
+}
+
+// Validate returns an error if a field of c is out of range.
+func (c Config) Validate() error {
+	if c.Latency < 0 || c.Jitter < 0 || c.Bandwidth < 0 {
+		return errors.New("Negative latency, jitter or bandwidth")
+	}
+	if c.Jitter > c.Latency {
+		return errors.New("Jitter is bigger than the latency")
+	}
+	if c.Loss < 0 || c.Loss >= 1 {
+		return errors.New("Loss must be at least 0 and smaller than 1")
+	}
+	return nil
+}
+
+// delivery is a message waiting on a link.
+type delivery struct {
+	at   time.Time
+	send func() error
+}
+
+// link is the emulated connection from one node to another. Its worker
+// delivers the messages in order, until the link is stopped and has no
+// message left.
+type link struct {
+	// busy is when the link is done transmitting the messages so far.
+	busy time.Time
+	// last is when the last message is delivered.
+	last time.Time
+	// The lock of the link protects pending, which holds the messages not
+	// delivered yet. It has no bound, so that SendTo never waits for a
+	// link with the emulation locked.
+	sync.Mutex
+	pending []delivery
+	// wake tells the worker that pending isn't empty anymore.
+	wake chan struct{}
+	// quit is closed to stop the worker.
+	quit chan struct{}
+}
+
+// newLink returns a link and starts its worker.
+func newLink() *link {
+	l := &link{wake: make(chan struct{}, 1), quit: make(chan struct{})}
+	go l.deliver()
+	return l
+}
+
+var emulation = struct {
+	sync.Mutex
+	config Config
+	links  map[[2]network.ServerIdentityID]*link
+}{links: map[[2]network.ServerIdentityID]*link{}}
+
+// Set turns on the emulation of c for all messages sent from now on. If c
+// emulates nothing, the workers of the links stop once they delivered the
+// messages already waiting.
+func Set(c Config) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	emulation.Lock()
+	defer emulation.Unlock()
+	emulation.config = c
+	if !c.Enabled() {
+		for _, l := range emulation.links {
+			close(l.quit)
+		}
+		emulation.links = map[[2]network.ServerIdentityID]*link{}
+	}
+	return nil
+}
+
+// Reset turns off the emulation. Messages already waiting are still
+// delivered, then the workers of the links stop.
+func Reset() {
+	Set(Config{})
+}
+
+// SendTo sends msg from n to the node to. With the emulation turned on, it
+// returns at once and the message is sent once it went over the emulated
+// link; errors are then only logged, so the protocols have to rely on their
+// timeouts.
+func SendTo(n *onet.TreeNodeInstance, to *onet.TreeNode, msg interface{}) error {
+	emulation.Lock()
+	c := emulation.config
+	if !c.Enabled() {
+		emulation.Unlock()
+		return n.SendTo(to, msg)
+	}
+	size := 0
+	if buf, err := network.Marshal(msg); err == nil {
+		size = len(buf)
+	}
+	key := [2]network.ServerIdentityID{n.ServerIdentity().ID, to.ServerIdentity.ID}
+	l, ok := emulation.links[key]
+	if !ok {
+		l = newLink()
+		emulation.links[key] = l
+	}
+	// The message is queued with the lock held, so that the link sends
+	// the messages in the order of their schedule.
+	at := l.schedule(time.Now(), size, c, rand.Float64)
+	l.push(delivery{at, func() error { return n.SendTo(to, msg) }})
+	emulation.Unlock()
+	return nil
+}
+
+// push adds d to the messages of the link and wakes up its worker.
+func (l *link) push(d delivery) {
+	l.Lock()
+	l.pending = append(l.pending, d)
+	l.Unlock()
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pop returns the next message of the link, waiting for one if there is
+// none. It returns false once the link is stopped and has no message left.
+func (l *link) pop() (delivery, bool) {
+	for {
+		l.Lock()
+		if len(l.pending) > 0 {
+			d := l.pending[0]
+			l.pending[0] = delivery{}
+			l.pending = l.pending[1:]
+			l.Unlock()
+			return d, true
+		}
+		l.Unlock()
+		select {
+		case <-l.wake:
+		case <-l.quit:
+			// The messages pushed before the stop are still
+			// delivered.
+			l.Lock()
+			empty := len(l.pending) == 0
+			l.Unlock()
+			if empty {
+				return delivery{}, false
+			}
+		}
+	}
+}
+
+// schedule returns when a message of size bytes sent at now arrives, and
+// reserves the link for its transmission. rnd returns random numbers in
+// [0, 1).
+func (l *link) schedule(now time.Time, size int, c Config, rnd func() float64) time.Time {
+	start := now
+	if l.busy.After(start) {
+		start = l.busy
+	}
+	var tx time.Duration
+	if c.Bandwidth > 0 {
+		tx = time.Duration(float64(size*8) / (c.Bandwidth * 1e6) * float64(time.Second))
+	}
+	l.busy = start.Add(tx)
+
+	delay := time.Duration(c.Latency) * time.Millisecond
+	if c.Jitter > 0 {
+		delay += time.Duration((2*rnd() - 1) * float64(c.Jitter) * float64(time.Millisecond))
+	}
+	if c.Loss > 0 {
+		for p := 0; p <= size/PacketSize; p++ {
+			if rnd() < c.Loss {
+				delay += RetransmitTimeout
+			}
+		}
+	}
+	at := l.busy.Add(delay)
+	if at.Before(l.last) {
+		at = l.last
+	}
+	l.last = at
+	return at
+}
+
+// deliver sends the messages of the link once they are due, until the link
+// is stopped.
+func (l *link) deliver() {
+	for {
+		d, ok := l.pop()
+		if !ok {
+			return
+		}
+		time.Sleep(d.at.Sub(time.Now()))
+		if err := d.send(); err != nil {
+			log.Lvl2("Couldn't send emulated message:", err)
+		}
+	}
+}
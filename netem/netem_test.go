@@ -0,0 +1,114 @@
+package netem
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+func TestMain(m *testing.M) {
+	log.MainTest(m)
+}
+
+func TestConfig_Validate(t *testing.T) {
+	assert.Nil(t, Config{}.Validate())
+	assert.Nil(t, Config{Latency: 50, Jitter: 10, Bandwidth: 10, Loss: 0.01}.Validate())
+	assert.NotNil(t, Config{Latency: -1}.Validate())
+	assert.NotNil(t, Config{Latency: 5, Jitter: 10}.Validate())
+	assert.NotNil(t, Config{Loss: 1}.Validate())
+	assert.False(t, Config{}.Enabled())
+	assert.True(t, Config{Loss: 0.1}.Enabled())
+}
+
+func TestLink_Schedule(t *testing.T) {
+	now := time.Now()
+	half := func() float64 { return 0.5 }
+
+	// Latency only.
+	l := &link{}
+	assert.Equal(t, now.Add(50*time.Millisecond), l.schedule(now, 1000, Config{Latency: 50}, half))
+
+	// 1 MB at 8 Mbit/s takes one second, and the next message waits for it.
+	l = &link{}
+	c := Config{Latency: 10, Bandwidth: 8}
+	assert.Equal(t, now.Add(1010*time.Millisecond), l.schedule(now, 1000000, c, half))
+	assert.Equal(t, now.Add(1010*time.Millisecond), l.schedule(now, 0, c, half))
+
+	// Jitter never reorders the messages.
+	l = &link{}
+	c = Config{Latency: 50, Jitter: 40}
+	first := l.schedule(now, 0, c, func() float64 { return 0.99 })
+	second := l.schedule(now, 0, c, func() float64 { return 0 })
+	assert.Equal(t, first, second)
+
+	// Every lost packet costs a retransmission.
+	l = &link{}
+	lost := func() float64 { return 0 }
+	assert.Equal(t, now.Add(3*RetransmitTimeout), l.schedule(now, 2*PacketSize, Config{Loss: 0.1}, lost))
+}
+
+func TestLink_Deliver(t *testing.T) {
+	l := &link{wake: make(chan struct{}, 1)}
+	got := make(chan int, 5000)
+	// More messages than any fixed queue would hold, pushed before the
+	// worker starts.
+	for i := 0; i < 5000; i++ {
+		i := i
+		l.push(delivery{time.Now(), func() error {
+			got <- i
+			return nil
+		}})
+	}
+	go l.deliver()
+	for i := 0; i < 5000; i++ {
+		assert.Equal(t, i, <-got)
+	}
+}
+
+func TestLink_Stop(t *testing.T) {
+	l := &link{wake: make(chan struct{}, 1), quit: make(chan struct{})}
+	got := make(chan int, 10)
+	for i := 0; i < 10; i++ {
+		i := i
+		l.push(delivery{time.Now().Add(10 * time.Millisecond), func() error {
+			got <- i
+			return nil
+		}})
+	}
+	done := make(chan struct{})
+	go func() {
+		l.deliver()
+		close(done)
+	}()
+	close(l.quit)
+
+	// The waiting messages are still delivered, then the worker stops.
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Worker didn't stop")
+	}
+	assert.Equal(t, 10, len(got))
+}
+
+func TestReset(t *testing.T) {
+	emulation.Lock()
+	l := newLink()
+	emulation.links[[2]network.ServerIdentityID{}] = l
+	emulation.Unlock()
+	require.Nil(t, Set(Config{Latency: 10}))
+	emulation.Lock()
+	assert.Equal(t, 1, len(emulation.links))
+	emulation.Unlock()
+
+	Reset()
+	emulation.Lock()
+	assert.Equal(t, 0, len(emulation.links))
+	emulation.Unlock()
+	_, ok := <-l.quit
+	assert.False(t, ok)
+}
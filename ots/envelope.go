@@ -0,0 +1,253 @@
+package ots
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+
+	"github.com/dedis/cothority_template/ots/util"
+	"golang.org/x/crypto/hkdf"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/crypto.v0/random"
+)
+
+// The envelope is the self-describing format of the encrypted payload of a
+// write transaction:
+//
+//	magic "OTSE" | version | KDF | AEAD | padding | chunk size (uint32)
+//	| salt (16 bytes) | nonce prefix (7 bytes) | chunk_0 | ... | chunk_n
+//
+// The symmetric key is derived from g^s and the salt. Every chunk is sealed
+// with a nonce made of the prefix, the chunk counter and a flag for the last
+// chunk, so chunks can be neither reordered nor dropped. The header and a
+// digest of the write transaction are the associated data of every chunk.
+//
+// The write block ID can't be used as associated data, as the block itself
+// commits to the hash of the envelope. The digest covers all the other
+// fields of the write transaction instead, so an envelope moved to another
+// write transaction fails to open.
+const (
+	EnvelopeVersion = 1
+
+	KDFHKDFSHA256 = 1
+	AEADAES256GCM = 1
+
+	// PaddingNone leaves the length of the message visible.
+	PaddingNone = 0
+	// PaddingChunk pads the message to a multiple of the chunk size.
+	PaddingChunk = 1
+
+	DefaultChunkSize = 64 * 1024
+	MaxChunkSize     = 16 * 1024 * 1024
+)
+
+var envelopeMagic = []byte("OTSE")
+
+const (
+	envelopeSaltLen   = 16
+	envelopePrefixLen = 7
+	envelopeHeaderLen = 4 + 4 + 4 + envelopeSaltLen + envelopePrefixLen
+	envelopeKDFInfo   = "OTS envelope key"
+)
+
+// EnvelopeOptions chooses how a message is sealed. A nil *EnvelopeOptions
+// stands for DefaultChunkSize without padding.
+type EnvelopeOptions struct {
+	ChunkSize int
+	Padding   byte
+}
+
+// EnvelopeHeader is the clear-text part of an envelope.
+type EnvelopeHeader struct {
+	Version     byte
+	KDF         byte
+	AEAD        byte
+	Padding     byte
+	ChunkSize   int
+	Salt        []byte
+	NoncePrefix []byte
+}
+
+// ParseEnvelopeHeader reads the header of an envelope and checks that this
+// version of the code can open it.
+func ParseEnvelopeHeader(env []byte) (*EnvelopeHeader, error) {
+	if len(env) < envelopeHeaderLen || !bytes.Equal(env[:4], envelopeMagic) {
+		return nil, errors.New("Not an OTS envelope")
+	}
+	hdr := &EnvelopeHeader{
+		Version:     env[4],
+		KDF:         env[5],
+		AEAD:        env[6],
+		Padding:     env[7],
+		ChunkSize:   int(binary.BigEndian.Uint32(env[8:12])),
+		Salt:        env[12 : 12+envelopeSaltLen],
+		NoncePrefix: env[12+envelopeSaltLen : envelopeHeaderLen],
+	}
+	switch {
+	case hdr.Version != EnvelopeVersion:
+		return nil, errors.New("Unsupported envelope version " + strconv.Itoa(int(hdr.Version)))
+	case hdr.KDF != KDFHKDFSHA256:
+		return nil, errors.New("Unsupported envelope KDF " + strconv.Itoa(int(hdr.KDF)))
+	case hdr.AEAD != AEADAES256GCM:
+		return nil, errors.New("Unsupported envelope AEAD " + strconv.Itoa(int(hdr.AEAD)))
+	case hdr.Padding != PaddingNone && hdr.Padding != PaddingChunk:
+		return nil, errors.New("Unsupported envelope padding " + strconv.Itoa(int(hdr.Padding)))
+	case hdr.ChunkSize <= 0 || hdr.ChunkSize > MaxChunkSize:
+		return nil, errors.New("Invalid envelope chunk size " + strconv.Itoa(hdr.ChunkSize))
+	}
+	return hdr, nil
+}
+
+func (hdr *EnvelopeHeader) marshal() []byte {
+	buf := make([]byte, envelopeHeaderLen)
+	copy(buf, envelopeMagic)
+	buf[4] = hdr.Version
+	buf[5] = hdr.KDF
+	buf[6] = hdr.AEAD
+	buf[7] = hdr.Padding
+	binary.BigEndian.PutUint32(buf[8:12], uint32(hdr.ChunkSize))
+	copy(buf[12:], hdr.Salt)
+	copy(buf[12+envelopeSaltLen:], hdr.NoncePrefix)
+	return buf
+}
+
+// sealEnvelope encrypts mesg under the secret point gs and binds it to the
+// write transaction digest.
+func sealEnvelope(gs abstract.Point, digest []byte, mesg []byte, opts *EnvelopeOptions) ([]byte, error) {
+	if opts == nil {
+		opts = &EnvelopeOptions{}
+	}
+	hdr := &EnvelopeHeader{
+		Version:     EnvelopeVersion,
+		KDF:         KDFHKDFSHA256,
+		AEAD:        AEADAES256GCM,
+		Padding:     opts.Padding,
+		ChunkSize:   opts.ChunkSize,
+		Salt:        random.Bytes(envelopeSaltLen, random.Stream),
+		NoncePrefix: random.Bytes(envelopePrefixLen, random.Stream),
+	}
+	if hdr.ChunkSize == 0 {
+		hdr.ChunkSize = DefaultChunkSize
+	}
+	header := hdr.marshal()
+	// Check the options the same way the reader will.
+	if _, err := ParseEnvelopeHeader(header); err != nil {
+		return nil, err
+	}
+
+	aead, err := envelopeAEAD(gs, hdr)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Padding == PaddingChunk {
+		mesg = padMessage(mesg, hdr.ChunkSize)
+	}
+	ad := append(append([]byte{}, header...), digest...)
+	chunks := (len(mesg) + hdr.ChunkSize - 1) / hdr.ChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	env := make([]byte, 0, len(header)+len(mesg)+chunks*aead.Overhead())
+	env = append(env, header...)
+	for i := 0; i < chunks; i++ {
+		end := (i + 1) * hdr.ChunkSize
+		if end > len(mesg) {
+			end = len(mesg)
+		}
+		nonce := chunkNonce(hdr.NoncePrefix, i, i == chunks-1)
+		env = aead.Seal(env, nonce, mesg[i*hdr.ChunkSize:end], ad)
+	}
+	return env, nil
+}
+
+// openEnvelope is the inverse of sealEnvelope. It fails if the envelope has
+// been modified, truncated, or sealed for another write transaction.
+func openEnvelope(gs abstract.Point, digest []byte, env []byte) ([]byte, error) {
+	hdr, err := ParseEnvelopeHeader(env)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := envelopeAEAD(gs, hdr)
+	if err != nil {
+		return nil, err
+	}
+	ad := append(append([]byte{}, env[:envelopeHeaderLen]...), digest...)
+	body := env[envelopeHeaderLen:]
+	sealedSize := hdr.ChunkSize + aead.Overhead()
+	var mesg []byte
+	for i := 0; ; i++ {
+		last := len(body) <= sealedSize
+		end := sealedSize
+		if last {
+			end = len(body)
+		}
+		nonce := chunkNonce(hdr.NoncePrefix, i, last)
+		mesg, err = aead.Open(mesg, nonce, body[:end], ad)
+		if err != nil {
+			return nil, errors.New("Envelope was tampered with or belongs to another write transaction")
+		}
+		body = body[end:]
+		if last {
+			break
+		}
+	}
+	if hdr.Padding == PaddingChunk {
+		return unpadMessage(mesg)
+	}
+	return mesg, nil
+}
+
+func envelopeAEAD(gs abstract.Point, hdr *EnvelopeHeader) (cipher.AEAD, error) {
+	gsBuf, err := gs.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	// AES-256 takes the first 32 bytes of HKDF-SHA256 (RFC 5869).
+	key := make([]byte, 32)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, gsBuf, hdr.Salt, []byte(envelopeKDFInfo)), key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix []byte, counter int, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[envelopePrefixLen:], uint32(counter))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// padMessage appends 0x80 and as many zeros as needed to fill the last
+// chunk.
+func padMessage(mesg []byte, chunkSize int) []byte {
+	padded := append(append([]byte{}, mesg...), 0x80)
+	if rest := len(padded) % chunkSize; rest != 0 {
+		padded = append(padded, make([]byte, chunkSize-rest)...)
+	}
+	return padded
+}
+
+func unpadMessage(mesg []byte) ([]byte, error) {
+	i := bytes.LastIndexByte(mesg, 0x80)
+	if i < 0 || len(bytes.Trim(mesg[i+1:], "\x00")) != 0 {
+		return nil, errors.New("Invalid envelope padding")
+	}
+	return mesg[:i], nil
+}
+
+// writeDigest returns the digest of the write transaction prepared in dp.
+func writeDigest(dp *util.DataPVSS) ([]byte, error) {
+	return util.WriteTxnDigest(dp.G, dp.SCPublicKeys, dp.EncShares, dp.EncProofs, dp.ReaderPk)
+}
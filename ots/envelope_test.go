@@ -0,0 +1,114 @@
+package ots
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dedis/cothority_template/ots/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/crypto.v0/random"
+	"gopkg.in/dedis/onet.v1/log"
+)
+
+func TestMain(m *testing.M) {
+	log.MainTest(m)
+}
+
+// newWrite prepares the PVSS data of a write transaction for n trustees
+// without contacting any conode.
+func newWrite(t *testing.T, n int) (*util.DataPVSS, *util.WriteTxnData, abstract.Point) {
+	suite, err := util.GetSuite(util.SuiteEd25519)
+	require.Nil(t, err)
+	scPubKeys := make([]abstract.Point, n)
+	for i := range scPubKeys {
+		scPubKeys[i] = suite.Point().Mul(nil, suite.Scalar().Pick(random.Stream))
+	}
+	dp, err := util.NewDataPVSS(util.SuiteEd25519, scPubKeys, n)
+	require.Nil(t, err)
+	readerPk := suite.Point().Mul(nil, suite.Scalar().Pick(random.Stream))
+	require.Nil(t, SetupPVSS(dp, readerPk))
+	wtd := &util.WriteTxnData{
+		G:            dp.G,
+		SCPublicKeys: dp.SCPublicKeys,
+		EncShares:    dp.EncShares,
+		EncProofs:    dp.EncProofs,
+		ReaderPk:     readerPk,
+	}
+	return dp, wtd, suite.Point().Mul(nil, dp.Secret)
+}
+
+func TestEnvelope_RoundTrip(t *testing.T) {
+	dp, wtd, secret := newWrite(t, 4)
+	for _, size := range []int{0, 1, 15, 16, 17, 100} {
+		for _, opts := range []*EnvelopeOptions{
+			nil,
+			{ChunkSize: 16},
+			{ChunkSize: 16, Padding: PaddingChunk},
+			{ChunkSize: 7, Padding: PaddingChunk},
+		} {
+			mesg := random.Bytes(size, random.Stream)
+			env, hashEnc, err := EncryptMessage(dp, mesg, opts)
+			require.Nil(t, err)
+			wtd.HashEnc = hashEnc
+			assert.Equal(t, 0, VerifyEncMesg(wtd, env))
+
+			dec, err := DecryptMessage(secret, env, wtd)
+			require.Nil(t, err)
+			assert.True(t, bytes.Equal(mesg, dec), "size %d, options %+v", size, opts)
+		}
+	}
+}
+
+func TestEnvelope_Header(t *testing.T) {
+	dp, _, _ := newWrite(t, 4)
+	env, _, err := EncryptMessage(dp, []byte("On Wisconsin!"), &EnvelopeOptions{ChunkSize: 32, Padding: PaddingChunk})
+	require.Nil(t, err)
+	hdr, err := ParseEnvelopeHeader(env)
+	require.Nil(t, err)
+	assert.Equal(t, byte(EnvelopeVersion), hdr.Version)
+	assert.Equal(t, byte(KDFHKDFSHA256), hdr.KDF)
+	assert.Equal(t, byte(AEADAES256GCM), hdr.AEAD)
+	assert.Equal(t, byte(PaddingChunk), hdr.Padding)
+	assert.Equal(t, 32, hdr.ChunkSize)
+
+	_, _, err = EncryptMessage(dp, nil, &EnvelopeOptions{ChunkSize: MaxChunkSize + 1})
+	assert.NotNil(t, err)
+	_, _, err = EncryptMessage(dp, nil, &EnvelopeOptions{Padding: 2})
+	assert.NotNil(t, err)
+	_, err = ParseEnvelopeHeader(env[:envelopeHeaderLen-1])
+	assert.NotNil(t, err)
+}
+
+func TestEnvelope_Reject(t *testing.T) {
+	dp, wtd, secret := newWrite(t, 4)
+	mesg := random.Bytes(100, random.Stream)
+	env, _, err := EncryptMessage(dp, mesg, &EnvelopeOptions{ChunkSize: 16})
+	require.Nil(t, err)
+
+	// An envelope from another write transaction, even with the same secret.
+	_, otherWtd, _ := newWrite(t, 4)
+	_, err = DecryptMessage(secret, env, otherWtd)
+	assert.NotNil(t, err)
+
+	// Wrong secret.
+	_, err = DecryptMessage(dp.Suite.Point().Base(), env, wtd)
+	assert.NotNil(t, err)
+
+	// Truncated, extended, and modified envelopes.
+	sealed := 16 + 16
+	_, err = DecryptMessage(secret, env[:len(env)-sealed], wtd)
+	assert.NotNil(t, err)
+	_, err = DecryptMessage(secret, append(append([]byte{}, env...), 0), wtd)
+	assert.NotNil(t, err)
+	for _, i := range []int{7, 12, envelopeHeaderLen, len(env) - 1} {
+		tampered := append([]byte{}, env...)
+		tampered[i] ^= 1
+		_, err = DecryptMessage(secret, tampered, wtd)
+		assert.NotNil(t, err, "byte %d", i)
+	}
+
+	_, err = DecryptMessage(secret, env, wtd)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,397 @@
+// Package keystore keeps the named keypairs of OTS writers and readers in a
+// local file. Private keys are encrypted at rest with AES-256-GCM under a key
+// derived from a passphrase with PBKDF2-HMAC-SHA256. The file also holds a
+// verifier of the passphrase, so that a wrong one is refused when opening
+// the keystore.
+package keystore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/dedis/cothority_template/ots/util"
+	"golang.org/x/crypto/pbkdf2"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/crypto.v0/random"
+	"gopkg.in/dedis/onet.v1/crypto"
+)
+
+// Version is the version of the keystore file format. Version 1 had no
+// passphrase verifier; a keystore without one gets it the next time it is
+// saved with a passphrase.
+const Version = 2
+
+// DefaultIterations is the number of PBKDF2 iterations for new keys.
+const DefaultIterations = 100000
+
+const saltSize = 16
+
+var (
+	// ErrNotFound is returned for a name that isn't in the keystore.
+	ErrNotFound = errors.New("Key not found")
+	// ErrExists is returned when creating a key under a name already in
+	// use.
+	ErrExists = errors.New("Key already exists")
+	// ErrPassphrase is returned when a private key can't be decrypted,
+	// either because of a wrong passphrase or a corrupted keystore.
+	ErrPassphrase = errors.New("Wrong passphrase or corrupted key")
+)
+
+// Key is a keypair of a suite. Only the public key can be read directly; the
+// private key is handed to the OTS client functions through the Key.
+type Key struct {
+	Name    string
+	SuiteID string
+	Suite   abstract.Suite
+	Public  abstract.Point
+	private abstract.Scalar
+}
+
+// NewKey returns a fresh, unnamed key of the suite suiteID that isn't stored
+// anywhere. It is meant for tests and simulations.
+func NewKey(suiteID string) (*Key, error) {
+	suite, err := util.GetSuite(suiteID)
+	if err != nil {
+		return nil, err
+	}
+	return newKey("", suiteID, suite, suite.Scalar().Pick(random.Stream)), nil
+}
+
+func newKey(name, suiteID string, suite abstract.Suite, priv abstract.Scalar) *Key {
+	return &Key{
+		Name:    name,
+		SuiteID: suiteID,
+		Suite:   suite,
+		Public:  suite.Point().Mul(nil, priv),
+		private: priv,
+	}
+}
+
+// Private returns the private key.
+func (k *Key) Private() abstract.Scalar {
+	return k.private
+}
+
+// Sign returns a Schnorr signature on the hash of msg.
+func (k *Key) Sign(msg []byte) (crypto.SchnorrSig, error) {
+	return util.SignMessage(k.Suite, msg, k.private)
+}
+
+// Entry is the stored form of a key.
+type Entry struct {
+	Name       string `json:"name"`
+	Suite      string `json:"suite"`
+	Public     string `json:"public"`
+	Salt       []byte `json:"salt"`
+	Iterations int    `json:"iterations"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// Verifier lets Open check the passphrase without decrypting a key. MAC is
+// an HMAC-SHA256 of verifierLabel under the PBKDF2 key of the passphrase.
+type Verifier struct {
+	Salt       []byte `json:"salt"`
+	Iterations int    `json:"iterations"`
+	MAC        []byte `json:"mac"`
+}
+
+var verifierLabel = []byte("ots keystore passphrase")
+
+type file struct {
+	Version  int       `json:"version"`
+	Verifier *Verifier `json:"verifier,omitempty"`
+	Keys     []*Entry  `json:"keys"`
+}
+
+// Keystore is a keystore file opened with a passphrase. Every change is
+// written back to the file immediately.
+type Keystore struct {
+	sync.Mutex
+	// Iterations is used for the keys created or imported from now on.
+	Iterations int
+	path       string
+	passphrase []byte
+	verifier   *Verifier
+	entries    []*Entry
+}
+
+// Open reads the keystore at path and returns ErrPassphrase if passphrase
+// isn't the one of the keystore. A missing file is an empty keystore, which
+// is only created once a key is added. A nil passphrase isn't checked and
+// only allows to list and delete keys.
+func Open(path string, passphrase []byte) (*Keystore, error) {
+	ks := &Keystore{
+		Iterations: DefaultIterations,
+		path:       path,
+	}
+	if passphrase != nil {
+		ks.passphrase = append([]byte{}, passphrase...)
+	}
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ks, nil
+	} else if err != nil {
+		return nil, err
+	}
+	f := &file{}
+	if err := json.Unmarshal(buf, f); err != nil {
+		return nil, err
+	}
+	if f.Version != 1 && f.Version != Version {
+		return nil, errors.New("Unsupported keystore version")
+	}
+	ks.verifier, ks.entries = f.Verifier, f.Keys
+	if passphrase == nil {
+		return ks, nil
+	}
+	if err := ks.checkPassphrase(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// checkPassphrase compares the passphrase with the verifier. Keystores of
+// version 1 don't have one, so the passphrase has to decrypt their first
+// key instead.
+func (ks *Keystore) checkPassphrase() error {
+	if ks.verifier == nil {
+		if len(ks.entries) == 0 {
+			return nil
+		}
+		_, err := ks.open(ks.entries[0])
+		return err
+	}
+	v := ks.verifier
+	if v.Iterations <= 0 || len(v.Salt) == 0 {
+		return errors.New("Invalid key derivation parameters")
+	}
+	if !hmac.Equal(v.MAC, passphraseMAC(ks.passphrase, v.Salt, v.Iterations)) {
+		return ErrPassphrase
+	}
+	return nil
+}
+
+func passphraseMAC(passphrase, salt []byte, iter int) []byte {
+	mac := hmac.New(sha256.New, pbkdf2.Key(passphrase, salt, iter, 32, sha256.New))
+	mac.Write(verifierLabel)
+	return mac.Sum(nil)
+}
+
+// Create adds a fresh key of the suite suiteID under name.
+func (ks *Keystore) Create(name, suiteID string) (*Key, error) {
+	suite, err := util.GetSuite(suiteID)
+	if err != nil {
+		return nil, err
+	}
+	return ks.Import(name, suiteID, suite.Scalar().Pick(random.Stream))
+}
+
+// Import adds the private key priv of the suite suiteID under name.
+func (ks *Keystore) Import(name, suiteID string, priv abstract.Scalar) (*Key, error) {
+	if name == "" {
+		return nil, errors.New("Empty key name")
+	}
+	if suiteID == "" {
+		suiteID = util.SuiteEd25519
+	}
+	suite, err := util.GetSuite(suiteID)
+	if err != nil {
+		return nil, err
+	}
+	key := newKey(name, suiteID, suite, priv)
+
+	ks.Lock()
+	defer ks.Unlock()
+	if ks.find(name) >= 0 {
+		return nil, ErrExists
+	}
+	e, err := ks.seal(key)
+	if err != nil {
+		return nil, err
+	}
+	ks.entries = append(ks.entries, e)
+	if err := ks.save(); err != nil {
+		ks.entries = ks.entries[:len(ks.entries)-1]
+		return nil, err
+	}
+	return key, nil
+}
+
+// Get decrypts the key stored under name.
+func (ks *Keystore) Get(name string) (*Key, error) {
+	ks.Lock()
+	defer ks.Unlock()
+	i := ks.find(name)
+	if i < 0 {
+		return nil, ErrNotFound
+	}
+	return ks.open(ks.entries[i])
+}
+
+// Delete removes the key stored under name.
+func (ks *Keystore) Delete(name string) error {
+	ks.Lock()
+	defer ks.Unlock()
+	i := ks.find(name)
+	if i < 0 {
+		return ErrNotFound
+	}
+	old := ks.entries
+	ks.entries = append(append([]*Entry{}, old[:i]...), old[i+1:]...)
+	if err := ks.save(); err != nil {
+		ks.entries = old
+		return err
+	}
+	return nil
+}
+
+// List returns the stored keys sorted by name. Their private keys stay
+// encrypted.
+func (ks *Keystore) List() []Entry {
+	ks.Lock()
+	defer ks.Unlock()
+	list := make([]Entry, len(ks.entries))
+	for i, e := range ks.entries {
+		list[i] = *e
+	}
+	sort.Sort(byName(list))
+	return list
+}
+
+type byName []Entry
+
+func (b byName) Len() int           { return len(b) }
+func (b byName) Less(i, j int) bool { return b[i].Name < b[j].Name }
+func (b byName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+func (ks *Keystore) find(name string) int {
+	for i, e := range ks.entries {
+		if e.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// seal encrypts the private key of key. The name, suite and public key are
+// authenticated, so that they can't be swapped between entries.
+func (ks *Keystore) seal(key *Key) (*Entry, error) {
+	if ks.passphrase == nil {
+		return nil, errors.New("Keystore opened without passphrase")
+	}
+	pub, err := util.PointToString64(key.Public)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := key.private.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	e := &Entry{
+		Name:       key.Name,
+		Suite:      key.SuiteID,
+		Public:     pub,
+		Salt:       random.Bytes(saltSize, random.Stream),
+		Iterations: ks.Iterations,
+	}
+	aead, err := ks.aead(e)
+	if err != nil {
+		return nil, err
+	}
+	e.Nonce = random.Bytes(aead.NonceSize(), random.Stream)
+	e.Ciphertext = aead.Seal(nil, e.Nonce, priv, e.ad())
+	return e, nil
+}
+
+func (ks *Keystore) open(e *Entry) (*Key, error) {
+	if ks.passphrase == nil {
+		return nil, errors.New("Keystore opened without passphrase")
+	}
+	suite, err := util.GetSuite(e.Suite)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := ks.aead(e)
+	if err != nil {
+		return nil, err
+	}
+	if len(e.Nonce) != aead.NonceSize() {
+		return nil, ErrPassphrase
+	}
+	buf, err := aead.Open(nil, e.Nonce, e.Ciphertext, e.ad())
+	if err != nil {
+		return nil, ErrPassphrase
+	}
+	priv := suite.Scalar()
+	if err := priv.UnmarshalBinary(buf); err != nil {
+		return nil, err
+	}
+	key := newKey(e.Name, e.Suite, suite, priv)
+	if pub, err := util.PointToString64(key.Public); err != nil || pub != e.Public {
+		return nil, ErrPassphrase
+	}
+	return key, nil
+}
+
+func (ks *Keystore) aead(e *Entry) (cipher.AEAD, error) {
+	if e.Iterations <= 0 || len(e.Salt) == 0 {
+		return nil, errors.New("Invalid key derivation parameters")
+	}
+	block, err := aes.NewCipher(pbkdf2.Key(ks.passphrase, e.Salt, e.Iterations, 32, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (e *Entry) ad() []byte {
+	ad := []byte(e.Name)
+	ad = append(ad, 0)
+	ad = append(ad, e.Suite...)
+	ad = append(ad, 0)
+	return append(ad, e.Public...)
+}
+
+// save writes the keystore to a temporary file first, so that a crash never
+// leaves a partial keystore behind.
+func (ks *Keystore) save() error {
+	if ks.verifier == nil && ks.passphrase != nil {
+		salt := random.Bytes(saltSize, random.Stream)
+		ks.verifier = &Verifier{
+			Salt:       salt,
+			Iterations: ks.Iterations,
+			MAC:        passphraseMAC(ks.passphrase, salt, ks.Iterations),
+		}
+	}
+	buf, err := json.MarshalIndent(&file{Version: Version, Verifier: ks.verifier, Keys: ks.entries}, "", "\t")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(ks.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, ".keystore-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buf)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), ks.path)
+}
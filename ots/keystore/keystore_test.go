@@ -0,0 +1,114 @@
+package keystore
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dedis/cothority_template/ots/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/onet.v1/crypto"
+	"gopkg.in/dedis/onet.v1/log"
+)
+
+func TestMain(m *testing.M) {
+	log.MainTest(m)
+}
+
+func TestKeystore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys.json")
+
+	ks, err := Open(path, []byte("secret"))
+	require.Nil(t, err)
+	ks.Iterations = 10
+	assert.Equal(t, 0, len(ks.List()))
+	alice, err := ks.Create("alice", "")
+	require.Nil(t, err)
+	_, err = ks.Create("alice", "")
+	assert.Equal(t, ErrExists, err)
+	bob, err := NewKey(util.SuiteEd25519)
+	require.Nil(t, err)
+	_, err = ks.Import("bob", util.SuiteEd25519, bob.Private())
+	require.Nil(t, err)
+
+	// The keys survive a reopening of the keystore.
+	ks, err = Open(path, []byte("secret"))
+	require.Nil(t, err)
+	list := ks.List()
+	require.Equal(t, 2, len(list))
+	assert.Equal(t, "alice", list[0].Name)
+	assert.Equal(t, "bob", list[1].Name)
+	key, err := ks.Get("alice")
+	require.Nil(t, err)
+	assert.True(t, key.Public.Equal(alice.Public))
+	assert.True(t, key.Private().Equal(alice.Private()))
+	sig, err := key.Sign([]byte("message"))
+	require.Nil(t, err)
+	hash := sha256.Sum256([]byte("message"))
+	assert.Nil(t, crypto.VerifySchnorr(key.Suite, key.Public, hash[:], sig))
+
+	// A wrong passphrase is refused, and without one the keys can only be
+	// listed.
+	_, err = Open(path, []byte("guess"))
+	assert.Equal(t, ErrPassphrase, err)
+	locked, err := Open(path, nil)
+	require.Nil(t, err)
+	assert.Equal(t, 2, len(locked.List()))
+	_, err = locked.Get("alice")
+	assert.NotNil(t, err)
+	_, err = locked.Create("carol", "")
+	assert.NotNil(t, err)
+
+	// Swapping the ciphertexts of two entries is detected.
+	ks.entries[0].Ciphertext, ks.entries[1].Ciphertext = ks.entries[1].Ciphertext, ks.entries[0].Ciphertext
+	ks.entries[0].Nonce, ks.entries[1].Nonce = ks.entries[1].Nonce, ks.entries[0].Nonce
+	_, err = ks.Get("alice")
+	assert.NotNil(t, err)
+
+	ks, err = Open(path, []byte("secret"))
+	require.Nil(t, err)
+	require.Nil(t, ks.Delete("alice"))
+	assert.Equal(t, ErrNotFound, ks.Delete("alice"))
+	_, err = ks.Get("alice")
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, 1, len(ks.List()))
+}
+
+func TestKeystore_Version1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys.json")
+
+	// Version 1 didn't store a verifier.
+	ks, err := Open(path, []byte("secret"))
+	require.Nil(t, err)
+	ks.Iterations = 10
+	_, err = ks.Create("alice", "")
+	require.Nil(t, err)
+	buf, err := json.Marshal(&file{Version: 1, Keys: ks.entries})
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(path, buf, 0600))
+
+	_, err = Open(path, []byte("guess"))
+	assert.Equal(t, ErrPassphrase, err)
+	ks, err = Open(path, []byte("secret"))
+	require.Nil(t, err)
+	assert.Nil(t, ks.verifier)
+	ks.Iterations = 10
+	_, err = ks.Create("bob", "")
+	require.Nil(t, err)
+
+	ks, err = Open(path, []byte("secret"))
+	require.Nil(t, err)
+	assert.NotNil(t, ks.verifier)
+	_, err = Open(path, []byte("guess"))
+	assert.Equal(t, ErrPassphrase, err)
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 
 	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/cothority_template/ots/keystore"
 	"github.com/dedis/cothority_template/ots/util"
 	otssc "github.com/dedis/cothority_template/otssc/service"
 	ocs "github.com/dedis/onchain-secrets"
@@ -20,116 +21,158 @@ import (
 	"gopkg.in/dedis/onet.v1/crypto"
 )
 
-func AddDummyTxnPairs(scurl *ocs.SkipChainURL, dp *util.DataPVSS, pairCount int) ([]*skipchain.SkipBlock, []*skipchain.SkipBlock) {
-	mesg := "On Wisconsin!"
-	writerSK := make([]abstract.Scalar, pairCount)
-	writerPK := make([]abstract.Point, pairCount)
-	readerSK := make([]abstract.Scalar, pairCount)
-	readerPK := make([]abstract.Point, pairCount)
-	sbWrite := make([]*skipchain.SkipBlock, pairCount)
-	sbRead := make([]*skipchain.SkipBlock, pairCount)
-
-	for i := 0; i < pairCount; i++ {
-		readerSK[i] = dp.Suite.Scalar().Pick(random.Stream)
-		readerPK[i] = dp.Suite.Point().Mul(nil, readerSK[i])
-		writerSK[i] = dp.Suite.Scalar().Pick(random.Stream)
-		writerPK[i] = dp.Suite.Point().Mul(nil, writerSK[i])
-		err := SetupPVSS(dp, readerPK[i])
-		if err != nil {
-			return nil, nil
-			// return err
-		}
-		_, hashEnc, _ := EncryptMessage(dp, []byte(mesg))
-
-		tmp, err := CreateWriteTxn(scurl, dp, hashEnc, readerPK[i], writerSK[i])
-		if err != nil {
-			return nil, nil
-			// return err
-		}
-		sbWrite[i] = tmp
-	}
-
-	for i := 0; i < pairCount; i++ {
-		tmp, err := CreateReadTxn(scurl, sbWrite[i].Hash, readerSK[i])
-		if err != nil {
-			return nil, nil
-			// return err
-		}
-		sbRead[i] = tmp
-	}
-	// return nil
-	return sbWrite, sbRead
-}
-
-func ElGamalDecrypt(shares []*util.DecryptedShare, privKey abstract.Scalar) ([]*pvss.PubVerShare, error) {
+// ElGamalDecrypt decrypts the shares that the trustees re-encrypted for the
+// reader. A share that doesn't decrypt to a PubVerShare, such as one from a
+// faulty trustee, is nil in the result.
+func ElGamalDecrypt(suite abstract.Suite, shares []*util.DecryptedShare, privKey abstract.Scalar) ([]*pvss.PubVerShare, error) {
 	size := len(shares)
 	decShares := make([]*pvss.PubVerShare, size)
 	for i := 0; i < size; i++ {
 		tmp := shares[i]
+		if tmp == nil || tmp.K == nil || len(tmp.Cs) == 0 {
+			continue
+		}
 		var decSh []byte
 		for _, C := range tmp.Cs {
-			S := network.Suite.Point().Mul(tmp.K, privKey)
-			decShPart := network.Suite.Point().Sub(C, S)
+			S := suite.Point().Mul(tmp.K, privKey)
+			decShPart := suite.Point().Sub(C, S)
 			decShPartData, _ := decShPart.Data()
 			decSh = append(decSh, decShPartData...)
 		}
-		_, tmpSh, err := network.Unmarshal(decSh)
+		_, tmpSh, err := network.UnmarshalRegisteredType(decSh, network.DefaultConstructors(suite))
 		if err != nil {
-			return nil, err
+			continue
 		}
 
-		sh := tmpSh.(*pvss.PubVerShare)
+		sh, ok := tmpSh.(*pvss.PubVerShare)
+		if !ok {
+			continue
+		}
 		decShares[i] = sh
 	}
 	return decShares, nil
 }
 
-func GetDecryptedShares(scurl *ocs.SkipChainURL, el *onet.Roster, writeTxnSB *skipchain.SkipBlock, readTxnSBF *skipchain.SkipBlockFix, acPubKeys []abstract.Point, scPubKeys []abstract.Point, privKey abstract.Scalar, index int) ([]*pvss.PubVerShare, error) {
-	cl := otssc.NewClient()
-	defer cl.Close()
+// GetDecryptedShares asks the trustees in el for their shares of the write
+// transaction and decrypts them. The shares are returned in the order they
+// arrived and aren't verified, which RecoverSecret does.
+func GetDecryptedShares(scurl *ocs.SkipChainURL, el *onet.Roster, writeTxnSB *skipchain.SkipBlock, readTxnSBF *skipchain.SkipBlockFix, acPubKeys []abstract.Point, scPubKeys []abstract.Point, key *keystore.Key, index int) ([]*pvss.PubVerShare, error) {
+	_, _, reencShares, err := requestShares(el, writeTxnSB, readTxnSBF, acPubKeys, key, index)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpDecShares, err := ElGamalDecrypt(key.Suite, reencShares, key.Private())
+	if err != nil {
+		return nil, err
+	}
+
+	var decShares []*pvss.PubVerShare
+	for _, ds := range tmpDecShares {
+		if ds != nil && ds.S.I >= 0 && ds.S.I < len(scPubKeys) {
+			decShares = append(decShares, ds)
+		}
+	}
+	return decShares, nil
+}
+
+// requestShares signs the decryption request of key for the read
+// transaction at index and sends it to the trustees in el. It returns the
+// request, its signature and the re-encrypted shares.
+func requestShares(el *onet.Roster, writeTxnSB *skipchain.SkipBlock, readTxnSBF *skipchain.SkipBlockFix, acPubKeys []abstract.Point, key *keystore.Key, index int) (*util.OTSDecryptReqData, *crypto.SchnorrSig, []*util.DecryptedShare, error) {
 	idx := index - writeTxnSB.Index - 1
 	if idx < 0 {
-		return nil, errors.New("Forward-link index is negative")
+		return nil, nil, nil, errors.New("Forward-link index is negative")
 	}
 
 	inclusionProof := writeTxnSB.GetForward(idx)
 	if inclusionProof == nil {
-		return nil, errors.New("Forward-link does not exist")
+		return nil, nil, nil, errors.New("Forward-link does not exist")
 	}
 
-	reencShares, cerr := cl.OTSDecrypt(el, writeTxnSB.SkipBlockFix, readTxnSBF, inclusionProof, acPubKeys, privKey)
+	data, sig, err := otssc.NewDecryptRequest(writeTxnSB.SkipBlockFix, readTxnSBF, inclusionProof, acPubKeys, key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	cl := otssc.NewClient()
+	defer closeClient(cl)
+	reply, cerr := cl.OTSDecryptSigned(el, data, sig)
 	if cerr != nil {
-		return nil, cerr
+		return nil, nil, nil, cerr
 	}
+	return data, sig, reply.DecShares, nil
+}
 
-	tmpDecShares, err := ElGamalDecrypt(reencShares, privKey)
-	if err != nil {
-		return nil, err
+// VerifyDecShares returns the decrypted shares that belong to the trustees
+// of the write transaction, at most one per trustee. The shares can be in
+// any order.
+func VerifyDecShares(suite abstract.Suite, wtd *util.WriteTxnData, decShares []*pvss.PubVerShare) []*pvss.PubVerShare {
+	n := len(wtd.SCPublicKeys)
+	if len(wtd.EncShares) < n {
+		n = len(wtd.EncShares)
+	}
+	seen := make([]bool, n)
+	var valid []*pvss.PubVerShare
+	for _, ds := range decShares {
+		if ds == nil {
+			continue
+		}
+		i := ds.S.I
+		if i < 0 || i >= n || seen[i] || wtd.EncShares[i] == nil {
+			continue
+		}
+		if pvss.VerifyDecShare(suite, wtd.G, wtd.SCPublicKeys[i], wtd.EncShares[i], ds) != nil {
+			continue
+		}
+		seen[i] = true
+		valid = append(valid, ds)
 	}
+	return valid
+}
 
-	size := len(tmpDecShares)
-	decShares := make([]*pvss.PubVerShare, size)
-	for i := 0; i < size; i++ {
-		decShares[tmpDecShares[i].S.I] = tmpDecShares[i]
+// RecoverSecret checks the decrypted shares against the write transaction
+// and recovers the secret from the valid ones. A threshold of 0 uses the
+// threshold stored in the write transaction.
+func RecoverSecret(suite abstract.Suite, wtd *util.WriteTxnData, decShares []*pvss.PubVerShare, threshold int) (abstract.Point, error) {
+	validDecShares := VerifyDecShares(suite, wtd, decShares)
+	if threshold == 0 {
+		threshold = wtd.Threshold
 	}
-	return decShares, nil
+	if threshold == 0 || len(validDecShares) < threshold {
+		return nil, errors.New("Not enough valid decrypted shares")
+	}
+	validKeys := make([]abstract.Point, len(validDecShares))
+	validEncShares := make([]*pvss.PubVerShare, len(validDecShares))
+	for j, ds := range validDecShares {
+		validKeys[j] = wtd.SCPublicKeys[ds.S.I]
+		validEncShares[j] = wtd.EncShares[ds.S.I]
+	}
+	return pvss.RecoverSecret(suite, wtd.G, validKeys, validEncShares, validDecShares, threshold, len(wtd.SCPublicKeys))
 }
 
 func GetUpdatedWriteTxnSB(scurl *ocs.SkipChainURL, sbid skipchain.SkipBlockID) (*skipchain.SkipBlock, error) {
 	cl := skipchain.NewClient()
-	defer cl.Close()
+	defer closeClient(cl)
+	sb, err := cl.GetSingleBlock(scurl.Roster, sbid)
+	return sb, err
+}
+
+// GetReadTxnSB returns the skipblock of the read transaction sbid.
+func GetReadTxnSB(scurl *ocs.SkipChainURL, sbid skipchain.SkipBlockID) (*skipchain.SkipBlock, error) {
+	cl := skipchain.NewClient()
+	defer closeClient(cl)
 	sb, err := cl.GetSingleBlock(scurl.Roster, sbid)
 	return sb, err
 }
 
-func CreateReadTxn(scurl *ocs.SkipChainURL, dataID skipchain.SkipBlockID, privKey abstract.Scalar) (*skipchain.SkipBlock, error) {
+func CreateReadTxn(scurl *ocs.SkipChainURL, dataID skipchain.SkipBlockID, key *keystore.Key) (*skipchain.SkipBlock, error) {
 	cl := ocs.NewClient()
-	defer cl.Close()
-	sb, err := cl.ReadTxnRequest(scurl, dataID, privKey)
+	defer closeClient(cl)
+	sb, err := cl.ReadTxnRequest(scurl, dataID, key.Private())
 	return sb, err
 }
 
-func VerifyTxnSignature(writeTxnData *util.WriteTxnData, sig *crypto.SchnorrSig, wrPubKey abstract.Point) error {
+func VerifyTxnSignature(suite abstract.Suite, writeTxnData *util.WriteTxnData, sig *crypto.SchnorrSig, wrPubKey abstract.Point) error {
 	// network.RegisterMessage(&util.WriteTxnData{})
 	wtd, err := network.Marshal(writeTxnData)
 	if err != nil {
@@ -138,12 +181,12 @@ func VerifyTxnSignature(writeTxnData *util.WriteTxnData, sig *crypto.SchnorrSig,
 
 	tmpHash := sha256.Sum256(wtd)
 	wtdHash := tmpHash[:]
-	return crypto.VerifySchnorr(network.Suite, wrPubKey, wtdHash, *sig)
+	return crypto.VerifySchnorr(suite, wrPubKey, wtdHash, *sig)
 }
 
 func GetWriteTxnSB(scurl *ocs.SkipChainURL, dataID skipchain.SkipBlockID) (*skipchain.SkipBlock, *util.WriteTxnData, *crypto.SchnorrSig, error) {
 	cl := ocs.NewClient()
-	defer cl.Close()
+	defer closeClient(cl)
 	sbWrite, tmpTxn, err := cl.GetWriteTxn(scurl, dataID)
 	if err != nil {
 		return nil, nil, nil, err
@@ -157,22 +200,88 @@ func GetWriteTxnSB(scurl *ocs.SkipChainURL, dataID skipchain.SkipBlockID) (*skip
 		EncProofs:    tmpTxn.Data.EncProofs,
 		HashEnc:      tmpTxn.Data.HashEnc,
 		ReaderPk:     tmpTxn.Data.ReaderPk,
+		Threshold:    tmpTxn.Data.Threshold,
+		SuiteID:      tmpTxn.Data.SuiteID,
+		MerkleRoot:   tmpTxn.Data.MerkleRoot,
+		Attestation:  tmpTxn.Data.Attestation,
 	}
 	return sbWrite, writeTxnData, sig, nil
 }
 
-func CreateWriteTxn(scurl *ocs.SkipChainURL, dp *util.DataPVSS, hashEnc []byte, pubKey abstract.Point, wrPrivKey abstract.Scalar) (*skipchain.SkipBlock, error) {
+func writeValidateData(dp *util.DataPVSS, pubKey abstract.Point) *util.WriteValidateReqData {
+	return &util.WriteValidateReqData{
+		G:            dp.G,
+		SCPublicKeys: dp.SCPublicKeys,
+		EncShares:    dp.EncShares,
+		EncProofs:    dp.EncProofs,
+		ReaderPk:     pubKey,
+		Threshold:    dp.Threshold,
+		SuiteID:      dp.SuiteID,
+	}
+}
+
+// ValidateWriteTxn asks the secret-management cothority scRoster to check
+// the shares prepared by SetupPVSS and returns their attestation.
+func ValidateWriteTxn(scRoster *onet.Roster, dp *util.DataPVSS, pubKey abstract.Point) (*util.WriteAttestation, error) {
+	cl := otssc.NewClient()
+	defer closeClient(cl)
+	data := writeValidateData(dp, pubKey)
+	att, cerr := cl.OTSValidateWrite(scRoster, data)
+	if cerr != nil {
+		return nil, cerr
+	}
+	err := util.VerifyWriteAttestation(att, data)
+	if err != nil {
+		return nil, err
+	}
+	return att, nil
+}
+
+// NewWriteTxnData returns the write transaction of dp for the reader
+// pubKey, with the attestation att of the trustees and the hash hashEnc of
+// the envelope. merkleRoot is the root of the fragments of an envelope
+// stored on the cothority, or nil.
+func NewWriteTxnData(dp *util.DataPVSS, att *util.WriteAttestation, hashEnc []byte, merkleRoot []byte, pubKey abstract.Point) *util.WriteTxnData {
+	return &util.WriteTxnData{
+		G:            dp.G,
+		SCPublicKeys: dp.SCPublicKeys,
+		EncShares:    dp.EncShares,
+		EncProofs:    dp.EncProofs,
+		HashEnc:      hashEnc,
+		ReaderPk:     pubKey,
+		Threshold:    dp.Threshold,
+		SuiteID:      dp.SuiteID,
+		MerkleRoot:   merkleRoot,
+		Attestation:  att,
+	}
+}
+
+// CreateWriteTxn stores the write transaction of dp on the skipchain,
+// provided att shows that the trustees can recover its shares.
+func CreateWriteTxn(scurl *ocs.SkipChainURL, dp *util.DataPVSS, att *util.WriteAttestation, hashEnc []byte, pubKey abstract.Point, wrKey *keystore.Key) (*skipchain.SkipBlock, error) {
+	return AppendWriteTxn(scurl, NewWriteTxnData(dp, att, hashEnc, nil, pubKey), wrKey)
+}
+
+// AppendWriteTxn stores wtd on the skipchain, provided its attestation shows
+// that the trustees can recover its shares. The threshold and the
+// attestation are stored with it, so that the trustees and auditors can
+// check them later.
+func AppendWriteTxn(scurl *ocs.SkipChainURL, wtd *util.WriteTxnData, wrKey *keystore.Key) (*skipchain.SkipBlock, error) {
+	err := util.VerifyWriteAttestation(wtd.Attestation, wtd.ValidateData())
+	if err != nil {
+		return nil, err
+	}
 	cl := ocs.NewClient()
-	defer cl.Close()
+	defer closeClient(cl)
 	readList := make([]abstract.Point, 1)
-	readList[0] = pubKey
-	sb, err := cl.WriteTxnRequest(scurl, dp.G, dp.SCPublicKeys, dp.EncShares, dp.EncProofs, hashEnc, readList, wrPrivKey)
+	readList[0] = wtd.ReaderPk
+	sb, err := cl.WriteTxnDataRequest(scurl, wtd, readList, wrKey.Private())
 	return sb, err
 }
 
 func CreateSkipchain(el *onet.Roster) (*ocs.SkipChainURL, error) {
 	cl := ocs.NewClient()
-	defer cl.Close()
+	defer closeClient(cl)
 	scurl, err := cl.CreateSkipchain(el)
 	return scurl, err
 }
@@ -183,29 +292,27 @@ func VerifyEncMesg(wtd *util.WriteTxnData, encMesg []byte) int {
 	return bytes.Compare(cmptHash, wtd.HashEnc)
 }
 
+// DecryptMessage opens the envelope encMesg with the recovered secret. It
+// fails if the envelope wasn't sealed for the write transaction wtd.
 func DecryptMessage(recSecret abstract.Point, encMesg []byte, wtd *util.WriteTxnData) ([]byte, error) {
-	g_s, err := recSecret.MarshalBinary()
+	digest, err := util.WriteTxnDigest(wtd.G, wtd.SCPublicKeys, wtd.EncShares, wtd.EncProofs, wtd.ReaderPk)
 	if err != nil {
 		return nil, err
 	}
-
-	tempSymKey := sha256.Sum256(g_s)
-	symKey := tempSymKey[:]
-	cipher := network.Suite.Cipher(symKey)
-	decMesg, err := cipher.Open(nil, encMesg)
-	return decMesg, err
+	return openEnvelope(recSecret, digest, encMesg)
 }
 
-func EncryptMessage(dp *util.DataPVSS, mesg []byte) ([]byte, []byte, error) {
-	g_s, err := dp.Suite.Point().Mul(nil, dp.Secret).MarshalBinary()
+// EncryptMessage seals mesg in an envelope for the write transaction
+// prepared by SetupPVSS. It returns the envelope and its hash.
+func EncryptMessage(dp *util.DataPVSS, mesg []byte, opts *EnvelopeOptions) ([]byte, []byte, error) {
+	digest, err := writeDigest(dp)
+	if err != nil {
+		return nil, nil, err
+	}
+	encMesg, err := sealEnvelope(dp.Suite.Point().Mul(nil, dp.Secret), digest, mesg, opts)
 	if err != nil {
 		return nil, nil, err
 	}
-
-	tempSymKey := sha256.Sum256(g_s)
-	symKey := tempSymKey[:]
-	cipher := network.Suite.Cipher(symKey)
-	encMesg := cipher.Seal(nil, mesg)
 	tempHash := sha256.Sum256(encMesg)
 	hashEnc := tempHash[:]
 	return encMesg, hashEnc, nil
@@ -219,7 +326,10 @@ func SetupPVSS(dp *util.DataPVSS, pubKey abstract.Point) error {
 	}
 
 	secret := dp.Suite.Scalar().Pick(random.Stream)
-	threshold := 2*dp.NumTrustee/3 + 1
+	threshold := dp.Threshold
+	if threshold == 0 {
+		threshold = 2*dp.NumTrustee/3 + 1
+	}
 	// PVSS step
 	encShares, commitPoly, err := pvss.EncShares(dp.Suite, h, dp.SCPublicKeys, secret, threshold)
 	if err == nil {
@@ -230,6 +340,7 @@ func SetupPVSS(dp *util.DataPVSS, pubKey abstract.Point) error {
 		dp.Threshold = threshold
 		dp.G = g
 		dp.H = h
+		dp.ReaderPk = pubKey
 		dp.Secret = secret
 		dp.EncShares = encShares
 		dp.EncProofs = encProofs
@@ -239,7 +350,7 @@ func SetupPVSS(dp *util.DataPVSS, pubKey abstract.Point) error {
 	}
 }
 
-func GetPubKeys(fname *string) ([]abstract.Point, error) {
+func GetPubKeys(suite abstract.Suite, fname *string) ([]abstract.Point, error) {
 	var keys []abstract.Point
 	fh, err := os.Open(*fname)
 	defer fh.Close()
@@ -249,7 +360,7 @@ func GetPubKeys(fname *string) ([]abstract.Point, error) {
 
 	fs := bufio.NewScanner(fh)
 	for fs.Scan() {
-		tmp, err := crypto.String64ToPoint(network.Suite, fs.Text())
+		tmp, err := crypto.String64ToPoint(suite, fs.Text())
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,182 @@
+package ots_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/dedis/cothority_template/ots"
+	"github.com/dedis/cothority_template/ots/otstest"
+	"github.com/dedis/cothority_template/ots/util"
+	"github.com/dedis/cothority_template/otssc/protocol"
+	otsstore "github.com/dedis/cothority_template/otsstore/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/crypto.v0/random"
+	"gopkg.in/dedis/onet.v1/log"
+)
+
+func TestMain(m *testing.M) {
+	log.MainTest(m)
+}
+
+func TestOTS_WriteReadDecrypt(t *testing.T) {
+	env, err := otstest.New(5)
+	require.Nil(t, err)
+	defer env.Close()
+
+	for _, size := range []int{0, 1, 100000} {
+		mesg := random.Bytes(size, random.Stream)
+		w, err := env.Write(mesg)
+		require.Nil(t, err)
+		r, err := env.Read(w)
+		require.Nil(t, err)
+		assert.True(t, r.SB.Index > w.SB.Index)
+
+		// The write transaction on the chain is the one we wrote.
+		wtd := r.WTD
+		assert.True(t, wtd.ReaderPk.Equal(env.Reader.Public))
+		_, _, sig, err := ots.GetWriteTxnSB(env.SCURL, w.SB.Hash)
+		require.Nil(t, err)
+		assert.Nil(t, ots.VerifyTxnSignature(w.DP.Suite, wtd, sig, env.Writer.Public))
+		assert.NotNil(t, ots.VerifyTxnSignature(w.DP.Suite, wtd, sig, env.Reader.Public))
+		// So are the threshold, the suite and the attestation of the
+		// trustees.
+		assert.Equal(t, w.DP.Threshold, wtd.Threshold)
+		assert.Equal(t, env.SuiteID, wtd.SuiteID)
+		assert.Nil(t, util.VerifyWriteAttestation(wtd.Attestation, wtd.ValidateData()))
+
+		got, err := env.Decrypt(r)
+		require.Nil(t, err)
+		assert.True(t, bytes.Equal(mesg, got), "size %d", size)
+	}
+}
+
+func TestOTS_Erasure(t *testing.T) {
+	defer func(d time.Duration) { otsstore.PendingTimeout = d }(otsstore.PendingTimeout)
+	otsstore.PendingTimeout = 500 * time.Millisecond
+	env, err := otstest.New(4)
+	require.Nil(t, err)
+	defer env.Close()
+
+	dp, err := env.NewDataPVSS()
+	require.Nil(t, err)
+	require.Nil(t, ots.SetupPVSS(dp, env.Reader.Public))
+	encMesg, hashEnc, err := ots.EncryptMessage(dp, []byte("secret"), nil)
+	require.Nil(t, err)
+	att, err := ots.ValidateWriteTxn(env.Roster, dp, env.Reader.Public)
+	require.Nil(t, err)
+	wtd := ots.NewWriteTxnData(dp, att, hashEnc, nil, env.Reader.Public)
+	frags, root, err := ots.FragmentEnvelope(encMesg, len(env.Roster.List), 2)
+	require.Nil(t, err)
+	wtd.MerkleRoot = root
+	require.Nil(t, ots.StoreEnvelope(env.Roster, frags, wtd, env.Writer))
+	writeSB, err := ots.AppendWriteTxn(env.SCURL, wtd, env.Writer)
+	require.Nil(t, err)
+
+	// Only the block of the write transaction confirms the fragments,
+	// which are then kept.
+	other, err := env.Write([]byte("other secret"))
+	require.Nil(t, err)
+	assert.NotNil(t, ots.ConfirmEnvelope(env.Roster, frags, env.SCURL, other.SB))
+	require.Nil(t, ots.ConfirmEnvelope(env.Roster, frags, env.SCURL, writeSB))
+	time.Sleep(2 * otsstore.PendingTimeout)
+	got, err := ots.RetrieveEnvelope(env.Roster, wtd)
+	require.Nil(t, err)
+	assert.Equal(t, encMesg, got)
+}
+
+func TestOTS_WrongIndex(t *testing.T) {
+	env, err := otstest.New(5)
+	require.Nil(t, err)
+	defer env.Close()
+	defer protocol.ClearFaults()
+
+	protocol.SetFault(env.Roster.List[4].ID, protocol.FaultWrongIndex)
+	w, err := env.Write([]byte("secret"))
+	require.Nil(t, err)
+	r, err := env.Read(w)
+	require.Nil(t, err)
+	decShares, err := ots.GetDecryptedShares(env.SCURL, env.Roster, r.WriteSB, r.SB.SkipBlockFix,
+		r.WriteSB.Roster.Publics(), r.WTD.SCPublicKeys, env.Reader, r.SB.Index)
+	require.Nil(t, err)
+
+	// The share of trustee 4 is a valid share, but claims to be the one
+	// of trustee 0, so its proof fails and only it is dropped.
+	require.Equal(t, 5, len(decShares))
+	suite, err := util.GetSuite(r.WTD.SuiteID)
+	require.Nil(t, err)
+	valid := ots.VerifyDecShares(suite, r.WTD, decShares)
+	assert.Equal(t, 4, len(valid))
+	for _, ds := range valid {
+		assert.NotEqual(t, 4, ds.S.I)
+	}
+	got, err := env.Decrypt(r)
+	require.Nil(t, err)
+	assert.Equal(t, w.Mesg, got)
+}
+
+func TestOTS_Faults(t *testing.T) {
+	env, err := otstest.New(5)
+	require.Nil(t, err)
+	defer env.Close()
+	defer protocol.ClearFaults()
+
+	// With 5 trustees the threshold is 4, so one of them can misbehave.
+	for _, f := range []protocol.Fault{protocol.FaultGarbage, protocol.FaultWrongIndex} {
+		log.Lvl1("Testing fault", f)
+		protocol.SetFault(env.Roster.List[4].ID, f)
+		w, err := env.Write([]byte("secret"))
+		require.Nil(t, err)
+		r, err := env.Read(w)
+		require.Nil(t, err)
+		got, err := env.Decrypt(r)
+		require.Nil(t, err)
+		assert.Equal(t, w.Mesg, got)
+
+		// But not two of them.
+		protocol.SetFault(env.Roster.List[3].ID, f)
+		w, err = env.Write([]byte("secret"))
+		require.Nil(t, err)
+		r, err = env.Read(w)
+		require.Nil(t, err)
+		_, err = env.Decrypt(r)
+		assert.NotNil(t, err)
+		protocol.ClearFaults()
+	}
+}
+
+func TestAddDummyTxnPairs(t *testing.T) {
+	env, err := otstest.New(3)
+	require.Nil(t, err)
+	defer env.Close()
+
+	dp, err := env.NewDataPVSS()
+	require.Nil(t, err)
+	writes, reads, err := ots.AddDummyTxnPairs(env.SCURL, env.Roster, dp, 4, 2)
+	require.Nil(t, err)
+	require.Equal(t, 4, len(writes))
+	require.Equal(t, 4, len(reads))
+	// The pairs are prepared concurrently, but are returned in the order
+	// of the writes and all reads come after the writes.
+	for i := 1; i < len(writes); i++ {
+		assert.True(t, writes[i].Index > writes[i-1].Index)
+	}
+	lastWrite, last := writes[len(writes)-1].Index, 0
+	for _, r := range reads {
+		assert.True(t, r.Index > lastWrite)
+		if r.Index > last {
+			last = r.Index
+		}
+	}
+
+	// The chain can still be used.
+	w, err := env.Write([]byte("after the dummies"))
+	require.Nil(t, err)
+	assert.True(t, w.SB.Index > last)
+	r, err := env.Read(w)
+	require.Nil(t, err)
+	got, err := env.Decrypt(r)
+	require.Nil(t, err)
+	assert.Equal(t, w.Mesg, got)
+}
@@ -0,0 +1,179 @@
+/*
+Package otstest runs a complete OTS deployment inside a test: local
+conodes with the skipchain, onchain-secrets and OTSSCService services, an
+access-control skipchain and the keys of a writer and a reader.
+
+	env, err := otstest.New(5)
+	log.ErrFatal(err)
+	defer env.Close()
+	w, err := env.Write([]byte("secret"))
+	log.ErrFatal(err)
+	r, err := env.Read(w)
+	log.ErrFatal(err)
+	mesg, err := env.Decrypt(r)
+
+Tests of packages that ots imports have to use an external test package,
+such as "package service_test", to avoid an import cycle.
+*/
+package otstest
+
+import (
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/cothority_template/ots"
+	"github.com/dedis/cothority_template/ots/keystore"
+	"github.com/dedis/cothority_template/ots/util"
+	otssc "github.com/dedis/cothority_template/otssc/service"
+	ocs "github.com/dedis/onchain-secrets"
+	// The onchain-secrets service holds the access-control skipchain.
+	_ "github.com/dedis/onchain-secrets/service"
+	"gopkg.in/dedis/onet.v1"
+)
+
+// Env is a local OTS deployment, where all servers are in the AC and in the
+// SC.
+type Env struct {
+	Local   *onet.LocalTest
+	Servers []*onet.Server
+	Roster  *onet.Roster
+	SuiteID string
+	// SCURL is the access-control skipchain.
+	SCURL *ocs.SkipChainURL
+	// Writer signs the write transactions, Reader is the key they are
+	// written for.
+	Writer *keystore.Key
+	Reader *keystore.Key
+	// Store holds the envelopes of the write transactions.
+	Store *ots.MemStorage
+	// OCS and OTSSC are clients of the skipchain and of the trustees for
+	// the tests that send their own requests.
+	OCS   *ocs.Client
+	OTSSC *otssc.Client
+}
+
+// New starts n servers and creates the access-control skipchain on them.
+func New(n int) (*Env, error) {
+	local := onet.NewTCPTest()
+	servers, roster, _ := local.GenTree(n, true)
+	env := &Env{
+		Local:   local,
+		Servers: servers,
+		Roster:  roster,
+		SuiteID: util.SuiteEd25519,
+		Store:   ots.NewMemStorage(),
+		OCS:     ocs.NewClient(),
+		OTSSC:   otssc.NewClient(),
+	}
+	var err error
+	if env.Writer, err = keystore.NewKey(env.SuiteID); err != nil {
+		env.Close()
+		return nil, err
+	}
+	if env.Reader, err = keystore.NewKey(env.SuiteID); err != nil {
+		env.Close()
+		return nil, err
+	}
+	if env.SCURL, err = ots.CreateSkipchain(roster); err != nil {
+		env.Close()
+		return nil, err
+	}
+	return env, nil
+}
+
+// Close stops the clients and the servers.
+func (env *Env) Close() {
+	env.OCS.Close()
+	env.OTSSC.Close()
+	env.Local.CloseAll()
+}
+
+// NewDataPVSS returns the PVSS data for a write transaction to all the
+// trustees, with the default threshold.
+func (env *Env) NewDataPVSS() (*util.DataPVSS, error) {
+	return util.NewDataPVSS(env.SuiteID, env.Roster.Publics(), len(env.Roster.List))
+}
+
+// Write is a write transaction stored on the skipchain.
+type Write struct {
+	DP   *util.DataPVSS
+	SB   *skipchain.SkipBlock
+	Mesg []byte
+}
+
+// Write stores mesg for the reader: it seals mesg in an envelope, has the
+// trustees validate the shares and appends the write transaction.
+func (env *Env) Write(mesg []byte) (*Write, error) {
+	dp, err := env.NewDataPVSS()
+	if err != nil {
+		return nil, err
+	}
+	if err := ots.SetupPVSS(dp, env.Reader.Public); err != nil {
+		return nil, err
+	}
+	encMesg, hashEnc, err := ots.EncryptMessage(dp, mesg, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ots.UploadEnvelope(env.Store, encMesg); err != nil {
+		return nil, err
+	}
+	att, err := ots.ValidateWriteTxn(env.Roster, dp, env.Reader.Public)
+	if err != nil {
+		return nil, err
+	}
+	sb, err := ots.CreateWriteTxn(env.SCURL, dp, att, hashEnc, env.Reader.Public, env.Writer)
+	if err != nil {
+		return nil, err
+	}
+	return &Write{DP: dp, SB: sb, Mesg: mesg}, nil
+}
+
+// Read is a read transaction of the reader for a write transaction.
+type Read struct {
+	SB *skipchain.SkipBlock
+	// WriteSB is the block of the write transaction, with the forward link
+	// that proves the read transaction.
+	WriteSB *skipchain.SkipBlock
+	WTD     *util.WriteTxnData
+	// Threshold is the threshold stored in the write transaction.
+	Threshold int
+}
+
+// Read appends a read transaction of the reader for w.
+func (env *Env) Read(w *Write) (*Read, error) {
+	sb, err := ots.CreateReadTxn(env.SCURL, w.SB.Hash, env.Reader)
+	if err != nil {
+		return nil, err
+	}
+	writeSB, err := ots.GetUpdatedWriteTxnSB(env.SCURL, w.SB.Hash)
+	if err != nil {
+		return nil, err
+	}
+	_, wtd, _, err := ots.GetWriteTxnSB(env.SCURL, w.SB.Hash)
+	if err != nil {
+		return nil, err
+	}
+	return &Read{SB: sb, WriteSB: writeSB, WTD: wtd, Threshold: wtd.Threshold}, nil
+}
+
+// Decrypt gets the shares of the trustees for r, recovers the secret and
+// opens the envelope of the write transaction.
+func (env *Env) Decrypt(r *Read) ([]byte, error) {
+	decShares, err := ots.GetDecryptedShares(env.SCURL, env.Roster, r.WriteSB, r.SB.SkipBlockFix,
+		r.WriteSB.Roster.Publics(), r.WTD.SCPublicKeys, env.Reader, r.SB.Index)
+	if err != nil {
+		return nil, err
+	}
+	suite, err := util.GetSuite(r.WTD.SuiteID)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := ots.RecoverSecret(suite, r.WTD, decShares, r.Threshold)
+	if err != nil {
+		return nil, err
+	}
+	encMesg, err := ots.FetchEnvelope(env.Store, r.WTD)
+	if err != nil {
+		return nil, err
+	}
+	return ots.DecryptMessage(secret, encMesg, r.WTD)
+}
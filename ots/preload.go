@@ -0,0 +1,157 @@
+package ots
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/cothority_template/ots/keystore"
+	"github.com/dedis/cothority_template/ots/util"
+	ocs "github.com/dedis/onchain-secrets"
+	"gopkg.in/dedis/onet.v1"
+)
+
+// dummyMesg is the message of the dummy write transactions.
+const dummyMesg = "On Wisconsin!"
+
+// PreloadError is returned by AddDummyTxnPairs if some of the pairs could
+// not be added.
+type PreloadError struct {
+	// Pairs is the number of pairs that were asked for.
+	Pairs int
+	// Errors holds the error of every failed pair.
+	Errors map[int]error
+}
+
+func (pe *PreloadError) Error() string {
+	first := -1
+	for i := range pe.Errors {
+		if first < 0 || i < first {
+			first = i
+		}
+	}
+	return strconv.Itoa(len(pe.Errors)) + " of " + strconv.Itoa(pe.Pairs) +
+		" dummy pairs failed, first: pair " + strconv.Itoa(first) + ": " +
+		pe.Errors[first].Error()
+}
+
+// AddDummyTxnPairs adds pairCount write transactions to the skipchain,
+// followed by a read transaction for each of them. The writes use the
+// trustees and the threshold of dp, which is not changed. Up to concurrency
+// pairs are prepared at the same time, but the blocks are appended one by
+// one, as the skipchain only accepts blocks that follow its latest block.
+//
+// The blocks of the pairs that were added are returned in the order of the
+// writes on the chain, the read of a write at the same position, even if
+// others failed, in which case the error is a *PreloadError.
+func AddDummyTxnPairs(scurl *ocs.SkipChainURL, scRoster *onet.Roster, dp *util.DataPVSS, pairCount, concurrency int) ([]*skipchain.SkipBlock, []*skipchain.SkipBlock, error) {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	readers := make([]*keystore.Key, pairCount)
+	sbWrite := make([]*skipchain.SkipBlock, pairCount)
+	sbRead := make([]*skipchain.SkipBlock, pairCount)
+	errs := make([]error, pairCount)
+	var chain sync.Mutex
+
+	// run calls f for every pair that didn't fail yet, with up to
+	// concurrency calls at the same time.
+	run := func(f func(i int) error) {
+		jobs := make(chan int)
+		var wg sync.WaitGroup
+		for w := 0; w < concurrency; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range jobs {
+					errs[i] = f(i)
+				}
+			}()
+		}
+		for i := 0; i < pairCount; i++ {
+			if errs[i] == nil {
+				jobs <- i
+			}
+		}
+		close(jobs)
+		wg.Wait()
+	}
+
+	run(func(i int) error {
+		var err error
+		readers[i], sbWrite[i], err = addDummyWrite(scurl, scRoster, dp, &chain)
+		return err
+	})
+	run(func(i int) error {
+		chain.Lock()
+		defer chain.Unlock()
+		var err error
+		sbRead[i], err = CreateReadTxn(scurl, sbWrite[i].Hash, readers[i])
+		return err
+	})
+
+	pe := &PreloadError{Pairs: pairCount, Errors: map[int]error{}}
+	var writes, reads []*skipchain.SkipBlock
+	for i, err := range errs {
+		if err != nil {
+			pe.Errors[i] = err
+			continue
+		}
+		writes = append(writes, sbWrite[i])
+		reads = append(reads, sbRead[i])
+	}
+	sort.Sort(byWriteIndex{writes, reads})
+	if len(pe.Errors) > 0 {
+		return writes, reads, pe
+	}
+	return writes, reads, nil
+}
+
+// byWriteIndex sorts the pairs by the index of their write block.
+type byWriteIndex struct {
+	writes, reads []*skipchain.SkipBlock
+}
+
+func (b byWriteIndex) Len() int           { return len(b.writes) }
+func (b byWriteIndex) Less(i, j int) bool { return b.writes[i].Index < b.writes[j].Index }
+func (b byWriteIndex) Swap(i, j int) {
+	b.writes[i], b.writes[j] = b.writes[j], b.writes[i]
+	b.reads[i], b.reads[j] = b.reads[j], b.reads[i]
+}
+
+// addDummyWrite creates a reader and appends a write transaction for it,
+// holding chain while appending.
+func addDummyWrite(scurl *ocs.SkipChainURL, scRoster *onet.Roster, template *util.DataPVSS, chain *sync.Mutex) (*keystore.Key, *skipchain.SkipBlock, error) {
+	dp, err := util.NewDataPVSS(template.SuiteID, template.SCPublicKeys, template.NumTrustee)
+	if err != nil {
+		return nil, nil, err
+	}
+	dp.Threshold = template.Threshold
+	reader, err := keystore.NewKey(dp.SuiteID)
+	if err != nil {
+		return nil, nil, err
+	}
+	writer, err := keystore.NewKey(dp.SuiteID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := SetupPVSS(dp, reader.Public); err != nil {
+		return nil, nil, err
+	}
+	_, hashEnc, err := EncryptMessage(dp, []byte(dummyMesg), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	att, err := ValidateWriteTxn(scRoster, dp, reader.Public)
+	if err != nil {
+		return nil, nil, err
+	}
+	chain.Lock()
+	defer chain.Unlock()
+	sb, err := CreateWriteTxn(scurl, dp, att, hashEnc, reader.Public, writer)
+	if err != nil {
+		return nil, nil, err
+	}
+	return reader, sb, nil
+}
@@ -0,0 +1,181 @@
+package ots
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/cothority_template/ots/keystore"
+	"github.com/dedis/cothority_template/ots/util"
+	otsstore "github.com/dedis/cothority_template/otsstore/service"
+	ocs "github.com/dedis/onchain-secrets"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// ErrNotFound is returned by a Storage that doesn't hold the requested
+// envelope.
+var ErrNotFound = errors.New("Envelope not found")
+
+// Storage keeps the envelopes of write transactions outside of the
+// skipchain. Envelopes are indexed by their hash, which is the HashEnc
+// stored in the write transaction.
+type Storage interface {
+	Put(hashEnc []byte, env []byte) error
+	Get(hashEnc []byte) ([]byte, error)
+}
+
+// UploadEnvelope stores env in st and returns its hash.
+func UploadEnvelope(st Storage, env []byte) ([]byte, error) {
+	tmpHash := sha256.Sum256(env)
+	hashEnc := tmpHash[:]
+	if err := st.Put(hashEnc, env); err != nil {
+		return nil, err
+	}
+	return hashEnc, nil
+}
+
+// FetchEnvelope gets the envelope of the write transaction wtd from st and
+// checks it against wtd.HashEnc.
+func FetchEnvelope(st Storage, wtd *util.WriteTxnData) ([]byte, error) {
+	env, err := st.Get(wtd.HashEnc)
+	if err != nil {
+		return nil, err
+	}
+	if VerifyEncMesg(wtd, env) != 0 {
+		return nil, errors.New("Stored envelope doesn't match the write transaction")
+	}
+	return env, nil
+}
+
+// FragmentEnvelope splits env into one fragment for each of the n conodes
+// that will store it, so that any required of them can rebuild it. It
+// returns the fragments and their Merkle root, which goes into the write
+// transaction.
+func FragmentEnvelope(env []byte, n, required int) ([]*otsstore.Fragment, []byte, error) {
+	frags, err := otsstore.Fragments(env, required, n)
+	if err != nil {
+		return nil, nil, err
+	}
+	return frags, frags[0].Root, nil
+}
+
+// StoreEnvelope gives the fragments returned by FragmentEnvelope to the
+// conodes of r, which keep them for the write transaction wtd of wrKey. wtd
+// has to hold the Merkle root of the fragments and r has to be the trustees
+// of wtd, in the same order.
+func StoreEnvelope(r *onet.Roster, frags []*otsstore.Fragment, wtd *util.WriteTxnData, wrKey *keystore.Key) error {
+	buf, err := network.Marshal(wtd)
+	if err != nil {
+		return err
+	}
+	sig, err := wrKey.Sign(buf)
+	if err != nil {
+		return err
+	}
+	cl := otsstore.NewClient()
+	defer closeClient(cl)
+	return cl.Store(r, frags, wtd, wrKey.Public, &sig)
+}
+
+// ConfirmEnvelope tells the conodes of r, which got frags from
+// StoreEnvelope, that writeSB on the skipchain scurl holds the write
+// transaction of the envelope. Until then, the conodes only keep the
+// fragments for otsstore's PendingTimeout.
+func ConfirmEnvelope(r *onet.Roster, frags []*otsstore.Fragment, scurl *ocs.SkipChainURL, writeSB *skipchain.SkipBlock) error {
+	cl := otsstore.NewClient()
+	defer closeClient(cl)
+	return cl.Confirm(r, frags, scurl.Roster, writeSB.Hash)
+}
+
+// RetrieveEnvelope rebuilds the envelope of the write transaction wtd from
+// the conodes of r.
+func RetrieveEnvelope(r *onet.Roster, wtd *util.WriteTxnData) ([]byte, error) {
+	if wtd.MerkleRoot == nil {
+		return nil, errors.New("Envelope of the write transaction is not stored on the cothority")
+	}
+	cl := otsstore.NewClient()
+	defer closeClient(cl)
+	return cl.Retrieve(r, wtd.MerkleRoot, wtd.HashEnc)
+}
+
+// MemStorage keeps the envelopes in memory. It is meant for tests and
+// simulations.
+type MemStorage struct {
+	sync.Mutex
+	envs map[string][]byte
+}
+
+// NewMemStorage returns an empty MemStorage.
+func NewMemStorage() *MemStorage {
+	return &MemStorage{envs: make(map[string][]byte)}
+}
+
+// Put implements Storage.
+func (ms *MemStorage) Put(hashEnc []byte, env []byte) error {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.envs[string(hashEnc)] = append([]byte{}, env...)
+	return nil
+}
+
+// Get implements Storage.
+func (ms *MemStorage) Get(hashEnc []byte) ([]byte, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	env, ok := ms.envs[string(hashEnc)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte{}, env...), nil
+}
+
+// DirStorage keeps every envelope in its own file of a local directory,
+// named after the hex-encoded hash.
+type DirStorage struct {
+	dir string
+}
+
+// NewDirStorage returns a DirStorage in dir, creating it if needed.
+func NewDirStorage(dir string) (*DirStorage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &DirStorage{dir: dir}, nil
+}
+
+func (ds *DirStorage) path(hashEnc []byte) string {
+	return filepath.Join(ds.dir, hex.EncodeToString(hashEnc))
+}
+
+// Put implements Storage. The envelope is written to a temporary file
+// first, so a reader never sees a partial envelope.
+func (ds *DirStorage) Put(hashEnc []byte, env []byte) error {
+	tmp, err := ioutil.TempFile(ds.dir, ".upload-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(env)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), ds.path(hashEnc))
+}
+
+// Get implements Storage.
+func (ds *DirStorage) Get(hashEnc []byte) ([]byte, error) {
+	env, err := ioutil.ReadFile(ds.path(hashEnc))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return env, err
+}
@@ -0,0 +1,41 @@
+package ots
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dedis/cothority_template/ots/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ots-storage")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	ds, err := NewDirStorage(dir)
+	require.Nil(t, err)
+
+	for _, st := range []Storage{NewMemStorage(), ds} {
+		env := []byte("some envelope")
+		hashEnc, err := UploadEnvelope(st, env)
+		require.Nil(t, err)
+
+		wtd := &util.WriteTxnData{HashEnc: hashEnc}
+		got, err := FetchEnvelope(st, wtd)
+		require.Nil(t, err)
+		assert.Equal(t, env, got)
+
+		_, err = st.Get([]byte("unknown"))
+		assert.Equal(t, ErrNotFound, err)
+
+		// An envelope stored under the wrong hash is rejected.
+		other := []byte("other envelope")
+		otherHash, err := UploadEnvelope(st, other)
+		require.Nil(t, err)
+		require.Nil(t, st.Put(otherHash, env))
+		_, err = FetchEnvelope(st, &util.WriteTxnData{HashEnc: otherHash})
+		assert.NotNil(t, err)
+	}
+}
@@ -6,19 +6,20 @@ import (
 	"os"
 
 	ots "github.com/dedis/cothority_template/ots"
+	"github.com/dedis/cothority_template/ots/keystore"
 	util "github.com/dedis/cothority_template/ots/util"
-	"gopkg.in/dedis/crypto.v0/abstract"
-	"gopkg.in/dedis/crypto.v0/ed25519"
-	"gopkg.in/dedis/crypto.v0/random"
-	"gopkg.in/dedis/crypto.v0/share/pvss"
+	otsstore "github.com/dedis/cothority_template/otsstore/service"
 	"gopkg.in/dedis/onet.v1/log"
 )
 
 func main() {
 
 	numTrusteePtr := flag.Int("t", 0, "size of the SC cothority")
+	suitePtr := flag.String("s", util.SuiteEd25519, "cryptographic suite")
 	filePtr := flag.String("g", "", "group.toml file for trustees")
 	pkFilePtr := flag.String("p", "", "pk.txt file")
+	storePtr := flag.String("store", "", "directory for the encrypted messages (in memory if empty)")
+	erasurePtr := flag.Int("k", 0, "store the encrypted message on the trustees, any k of which can rebuild it")
 	dbgPtr := flag.Int("d", 0, "debug level")
 	flag.Parse()
 	log.SetDebugVisible(*dbgPtr)
@@ -34,25 +35,38 @@ func main() {
 		os.Exit(1)
 	}
 
-	scPubKeys, err := ots.GetPubKeys(pkFilePtr)
+	suite, err := util.GetSuite(*suitePtr)
+	if err != nil {
+		log.Errorf("Couldn't get suite: %v", err)
+		os.Exit(1)
+	}
+
+	scPubKeys, err := ots.GetPubKeys(suite, pkFilePtr)
 	if err != nil {
 		log.Errorf("Couldn't read pk file: %v", err)
 		os.Exit(1)
 	}
 
-	dataPVSS := util.DataPVSS{
-		Suite:        ed25519.NewAES128SHA256Ed25519(false),
-		SCPublicKeys: scPubKeys,
-		NumTrustee:   *numTrusteePtr,
+	dataPVSS, err := util.NewDataPVSS(*suitePtr, scPubKeys, *numTrusteePtr)
+	if err != nil {
+		log.Errorf("Couldn't prepare PVSS data: %v", err)
+		os.Exit(1)
 	}
-	// Writer's pk/sk pair
-	wrPrivKey := dataPVSS.Suite.Scalar().Pick(random.Stream)
-	wrPubKey := dataPVSS.Suite.Point().Mul(nil, wrPrivKey)
-	// Reader's pk/sk pair
-	privKey := dataPVSS.Suite.Scalar().Pick(random.Stream)
-	pubKey := dataPVSS.Suite.Point().Mul(nil, privKey)
+	// Writer's and reader's keys
+	wrKey, err := keystore.NewKey(dataPVSS.SuiteID)
+	if err != nil {
+		log.Errorf("Couldn't create writer key: %v", err)
+		os.Exit(1)
+	}
+	wrPubKey := wrKey.Public
+	key, err := keystore.NewKey(dataPVSS.SuiteID)
+	if err != nil {
+		log.Errorf("Couldn't create reader key: %v", err)
+		os.Exit(1)
+	}
+	pubKey := key.Public
 
-	err = ots.SetupPVSS(&dataPVSS, pubKey)
+	err = ots.SetupPVSS(dataPVSS, pubKey)
 	if err != nil {
 		log.Errorf("Could not setup PVSS: %v", err)
 		os.Exit(1)
@@ -63,18 +77,55 @@ func main() {
 	for i := 0; i < mesgSize; i++ {
 		mesg[i] = 'w'
 	}
-	encMesg, hashEnc, err := ots.EncryptMessage(&dataPVSS, mesg)
+	encMesg, hashEnc, err := ots.EncryptMessage(dataPVSS, mesg, nil)
 	if err != nil {
 		log.Errorf("Could not encrypt message: %v", err)
 		os.Exit(1)
 	}
 
+	var store ots.Storage = ots.NewMemStorage()
+	if *storePtr != "" {
+		store, err = ots.NewDirStorage(*storePtr)
+		if err != nil {
+			log.Errorf("Could not open storage: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	// Trustees check the shares before the write transaction is created
+	att, err := ots.ValidateWriteTxn(el, dataPVSS, pubKey)
+	if err != nil {
+		log.Errorf("Trustees did not attest the write transaction: %v", err)
+		os.Exit(1)
+	}
+	writeTxnData := ots.NewWriteTxnData(dataPVSS, att, hashEnc, nil, pubKey)
+
+	var frags []*otsstore.Fragment
+	if *erasurePtr > 0 {
+		frags, writeTxnData.MerkleRoot, err = ots.FragmentEnvelope(encMesg, len(el.List), *erasurePtr)
+		if err == nil {
+			err = ots.StoreEnvelope(el, frags, writeTxnData, wrKey)
+		}
+	} else {
+		_, err = ots.UploadEnvelope(store, encMesg)
+	}
+	if err != nil {
+		log.Errorf("Could not store encrypted message: %v", err)
+		os.Exit(1)
+	}
+
 	// Creating write transaction
-	writeSB, err := ots.CreateWriteTxn(scurl, &dataPVSS, hashEnc, pubKey, wrPrivKey)
+	writeSB, err := ots.AppendWriteTxn(scurl, writeTxnData, wrKey)
 	if err != nil {
 		log.Errorf("Could not create write transaction: %v", err)
 		os.Exit(1)
 	}
+	if *erasurePtr > 0 {
+		if err = ots.ConfirmEnvelope(el, frags, scurl, writeSB); err != nil {
+			log.Errorf("Could not confirm encrypted message: %v", err)
+			os.Exit(1)
+		}
+	}
 
 	// Bob gets it from Alice
 	writeID := writeSB.Hash
@@ -85,23 +136,26 @@ func main() {
 		os.Exit(1)
 	}
 
-	sigVerErr := ots.VerifyTxnSignature(writeTxnData, sig, wrPubKey)
+	sigVerErr := ots.VerifyTxnSignature(suite, writeTxnData, sig, wrPubKey)
 	if sigVerErr != nil {
 		log.Errorf("Signature verification failed on the write transaction: %v", sigVerErr)
 		os.Exit(1)
 	}
 
 	log.Info("Signature verified on the retrieved write transaction")
-	validHash := ots.VerifyEncMesg(writeTxnData, encMesg)
-	if validHash == 0 {
-		log.Info("Valid hash for encrypted message")
+	if *erasurePtr > 0 {
+		encMesg, err = ots.RetrieveEnvelope(el, writeTxnData)
 	} else {
-		log.Errorf("Invalid hash for encrypted message")
+		encMesg, err = ots.FetchEnvelope(store, writeTxnData)
+	}
+	if err != nil {
+		log.Errorf("Could not fetch encrypted message: %v", err)
 		os.Exit(1)
 	}
+	log.Info("Valid hash for encrypted message")
 
 	// Creating read transaction
-	readSB, err := ots.CreateReadTxn(scurl, writeID, privKey)
+	readSB, err := ots.CreateReadTxn(scurl, writeID, key)
 	if err != nil {
 		log.Errorf("Could not create read transaction: %v", err)
 		os.Exit(1)
@@ -113,28 +167,18 @@ func main() {
 		os.Exit(1)
 	}
 
-	acPubKeys := readSB.Roster.Publics()
+	acPubKeys := updWriteSB.Roster.Publics()
 	// Bob obtains the SC public keys from T_W
 	scPubKeys = writeTxnData.SCPublicKeys
-	decShares, err := ots.GetDecryptedShares(scurl, el, updWriteSB, readSB.SkipBlockFix, acPubKeys, scPubKeys, privKey, readSB.Index)
+	decShares, err := ots.GetDecryptedShares(scurl, el, updWriteSB, readSB.SkipBlockFix, acPubKeys, scPubKeys, key, readSB.Index)
 	if err != nil {
 		log.Errorf("Could not get the decrypted shares: %v", err)
 		os.Exit(1)
 	}
 
-	var validKeys []abstract.Point
-	var validEncShares []*pvss.PubVerShare
-	var validDecShares []*pvss.PubVerShare
-	sz := len(decShares)
-	for i := 0; i < sz; i++ {
-		validKeys = append(validKeys, writeTxnData.SCPublicKeys[i])
-		validEncShares = append(validEncShares, writeTxnData.EncShares[i])
-		validDecShares = append(validDecShares, decShares[i])
-	}
-
 	// Normally Bob doesn't have dataPVSS but we are
 	// using it only for PVSS parameters for simplicity
-	recSecret, err := pvss.RecoverSecret(dataPVSS.Suite, writeTxnData.G, validKeys, validEncShares, validDecShares, dataPVSS.Threshold, dataPVSS.NumTrustee)
+	recSecret, err := ots.RecoverSecret(dataPVSS.Suite, writeTxnData, decShares, dataPVSS.Threshold)
 	if err != nil {
 		log.Errorf("Could not recover secret: %v", err)
 		os.Exit(1)
@@ -0,0 +1,41 @@
+package ots
+
+import (
+	"sync/atomic"
+)
+
+// Traffic counts the bytes that the clients of the functions of this
+// package sent and received, so that a caller can measure the traffic of an
+// OTS phase with measure.Start(name, ots.Traffic). It implements
+// monitor.CounterIO.
+var Traffic = &Counter{}
+
+// Counter adds up the bytes of clients once they are closed.
+type Counter struct {
+	tx, rx uint64
+}
+
+// Tx returns the number of bytes sent.
+func (c *Counter) Tx() uint64 {
+	return atomic.LoadUint64(&c.tx)
+}
+
+// Rx returns the number of bytes received.
+func (c *Counter) Rx() uint64 {
+	return atomic.LoadUint64(&c.rx)
+}
+
+// client is what all the clients of the services used by this package have
+// from their onet.Client.
+type client interface {
+	Tx() uint64
+	Rx() uint64
+	Close() error
+}
+
+// closeClient adds the bytes of cl to Traffic and closes it.
+func closeClient(cl client) {
+	atomic.AddUint64(&Traffic.tx, cl.Tx())
+	atomic.AddUint64(&Traffic.rx, cl.Rx())
+	cl.Close()
+}
@@ -0,0 +1,242 @@
+package ots
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/cothority_template/ots/keystore"
+	"github.com/dedis/cothority_template/ots/util"
+	"github.com/dedis/cothority_template/otssc/protocol"
+	ocs "github.com/dedis/onchain-secrets"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/crypto.v0/share/pvss"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/crypto"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// TranscriptVersion is the version of the transcripts written by this
+// package. It is increased whenever a field changes its meaning.
+const TranscriptVersion = 2
+
+// ErrOtherChain is a transcript whose write block is not on the skipchain
+// given to GenesisRoster.
+var ErrOtherChain = errors.New("Write block is not on the given skipchain")
+
+func init() {
+	network.RegisterMessage(&Transcript{})
+}
+
+// Transcript records the release of a secret, so that an auditor can check
+// it later without contacting the cothority. Nothing in it is trusted: the
+// auditor checks it against the access-control roster they know.
+//
+// The decrypted shares let anybody recover the secret of the write
+// transaction, and with it decrypt the file: a transcript is as confidential
+// as the file itself and must only be given to those allowed to read it.
+type Transcript struct {
+	Version int
+	// Request is the decryption request as the trustees got it. It holds
+	// the write block, the read block, the forward-link from the one to
+	// the other and the keys of the access-control cothority.
+	Request *util.OTSDecryptReqData
+	// Signature is the reader's signature on Request.
+	Signature *crypto.SchnorrSig
+	// DecShares are the shares decrypted by the reader. They are checked
+	// against the threshold of the write transaction in Request.
+	DecShares []*pvss.PubVerShare
+}
+
+// GetTranscript asks the trustees in el for their shares of the write
+// transaction, like GetDecryptedShares, and returns the transcript of the
+// exchange. The secret can be recovered from its DecShares.
+func GetTranscript(el *onet.Roster, writeTxnSB *skipchain.SkipBlock, readTxnSB *skipchain.SkipBlock, key *keystore.Key) (*Transcript, error) {
+	data, sig, reencShares, err := requestShares(el, writeTxnSB, readTxnSB.SkipBlockFix, writeTxnSB.Roster.Publics(), key, readTxnSB.Index)
+	if err != nil {
+		return nil, err
+	}
+	tmpDecShares, err := ElGamalDecrypt(key.Suite, reencShares, key.Private())
+	if err != nil {
+		return nil, err
+	}
+	t := &Transcript{
+		Version:   TranscriptVersion,
+		Request:   data,
+		Signature: sig,
+	}
+	for _, ds := range tmpDecShares {
+		if ds != nil {
+			t.DecShares = append(t.DecShares, ds)
+		}
+	}
+	return t, nil
+}
+
+// Export returns the transcript in the format read by ImportTranscript.
+func (t *Transcript) Export() ([]byte, error) {
+	return network.Marshal(t)
+}
+
+// ImportTranscript reads a transcript written by Export.
+func ImportTranscript(buf []byte) (*Transcript, error) {
+	_, msg, err := network.Unmarshal(buf)
+	if err != nil {
+		return nil, err
+	}
+	t, ok := msg.(*Transcript)
+	if !ok {
+		return nil, errors.New("Not a transcript")
+	}
+	if t.Version != TranscriptVersion {
+		return nil, errors.New("Transcript of version " + strconv.Itoa(t.Version) +
+			" is not supported")
+	}
+	return t, nil
+}
+
+// WriteTxn returns the write transaction in the write block of the request
+// of t, with the writer's signature on it. Nothing of it is verified.
+func (t *Transcript) WriteTxn() (*util.WriteTxnData, *crypto.SchnorrSig, error) {
+	if t == nil || t.Request == nil || t.Request.WriteTxnSBF == nil {
+		return nil, nil, errors.New("Missing write block")
+	}
+	_, msg, err := network.Unmarshal(t.Request.WriteTxnSBF.Data)
+	if err != nil {
+		return nil, nil, protocol.ErrNoWriteTxn
+	}
+	data, ok := msg.(*ocs.DataOCS)
+	if !ok || data.WriteTxn == nil || data.WriteTxn.Data == nil {
+		return nil, nil, protocol.ErrNoWriteTxn
+	}
+	return data.WriteTxn.Data, data.WriteTxn.Signature, nil
+}
+
+// TranscriptCheck is the outcome of one check of VerifyTranscript.
+type TranscriptCheck struct {
+	Name string
+	// Detail tells what was checked.
+	Detail string
+	// Err is nil if the check passed.
+	Err error
+}
+
+// TranscriptReport holds the outcome of all checks of a transcript.
+type TranscriptReport []*TranscriptCheck
+
+// Passed returns true if all checks passed.
+func (r TranscriptReport) Passed() bool {
+	for _, c := range r {
+		if c.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// VerifyTranscript checks t offline against acRoster, the access-control
+// cothority the auditor trusts, and writer, the public key of the writer:
+//   - roster: the keys in the request are those of acRoster,
+//   - write: the attestation of the trustees on the write transaction, and
+//     the signature of writer on it, unless writer is nil,
+//   - request: the trustees had to accept the request, as checked by
+//     protocol.VerifyDecryptionRequest: the reader's signature, the
+//     forward-link from the write block to the read block with the
+//     signature of the keys in the request, which are those of the roster
+//     of the write block, and the write block in the read block,
+//   - shares: the PVSS proofs of the decrypted shares against the write
+//     transaction, and that there are at least as many valid ones as the
+//     threshold the trustees attested in it.
+//
+// A check that depends on a failed one fails as well.
+func VerifyTranscript(t *Transcript, acRoster *onet.Roster, writer abstract.Point) TranscriptReport {
+	roster := &TranscriptCheck{Name: "roster", Detail: "request keys are those of the access-control cothority"}
+	write := &TranscriptCheck{Name: "write", Detail: "attestation and writer's signature of the write transaction"}
+	request := &TranscriptCheck{Name: "request", Detail: "signatures and forward-link of the decryption request"}
+	shares := &TranscriptCheck{Name: "shares", Detail: "PVSS proofs of the decrypted shares"}
+	report := TranscriptReport{roster, write, request, shares}
+	if t == nil || t.Request == nil {
+		for _, c := range report {
+			c.Err = errors.New("Missing decryption request")
+		}
+		return report
+	}
+
+	if acRoster == nil || !util.SamePoints(acRoster.Publics(), t.Request.ACPublicKeys) {
+		roster.Err = errors.New("Keys of the request differ from the access-control roster")
+	}
+
+	write.Err = verifyTranscriptWrite(t, writer)
+	if writer == nil {
+		write.Detail = "attestation of the write transaction, the writer's signature is not checked"
+	}
+
+	wtd, suite, err := protocol.VerifyDecryptionRequest(t.Request, t.Signature)
+	if err != nil {
+		request.Err = err
+		shares.Err = errors.New("Decryption request not verified")
+		return report
+	}
+
+	valid := len(VerifyDecShares(suite, wtd, t.DecShares))
+	shares.Detail = strconv.Itoa(valid) + " of " + strconv.Itoa(len(t.DecShares)) +
+		" decrypted shares valid, from " + strconv.Itoa(len(wtd.SCPublicKeys)) + " trustees"
+	switch {
+	case valid == 0:
+		shares.Err = errors.New("No valid decrypted share")
+	case valid < wtd.Threshold:
+		shares.Err = errors.New("Fewer valid decrypted shares than the threshold of " +
+			strconv.Itoa(wtd.Threshold))
+	}
+	return report
+}
+
+// verifyTranscriptWrite checks the attestation of the write transaction of
+// t and, if writer isn't nil, its signature by writer.
+func verifyTranscriptWrite(t *Transcript, writer abstract.Point) error {
+	wtd, sig, err := t.WriteTxn()
+	if err != nil {
+		return err
+	}
+	if err := util.VerifyWriteAttestation(wtd.Attestation, wtd.ValidateData()); err != nil {
+		return err
+	}
+	if writer == nil {
+		return nil
+	}
+	suite, err := util.GetSuite(wtd.SuiteID)
+	if err != nil {
+		return err
+	}
+	if sig == nil || VerifyTxnSignature(suite, wtd, sig, writer) != nil {
+		return errors.New("Write transaction is not signed by the writer")
+	}
+	return nil
+}
+
+// GenesisRoster returns the roster of the genesis block of the skipchain
+// genesis, to verify t against. It gets the block from the conodes of the
+// write block in t, after checking that the write block is on the skipchain.
+// Transcripts of a skipchain whose roster changed since its genesis block
+// have to be verified against the current roster instead.
+func GenesisRoster(t *Transcript, genesis skipchain.SkipBlockID) (*onet.Roster, error) {
+	if t == nil || t.Request == nil || t.Request.WriteTxnSBF == nil ||
+		t.Request.WriteTxnSBF.Roster == nil {
+		return nil, errors.New("Missing write block")
+	}
+	wsbf := t.Request.WriteTxnSBF
+	if !wsbf.GenesisID.Equal(genesis) &&
+		!(wsbf.Index == 0 && wsbf.CalculateHash().Equal(genesis)) {
+		return nil, ErrOtherChain
+	}
+	cl := skipchain.NewClient()
+	defer closeClient(cl)
+	sb, cerr := cl.GetSingleBlock(wsbf.Roster, genesis)
+	if cerr != nil {
+		return nil, cerr
+	}
+	if sb.Index != 0 || sb.Roster == nil || !sb.CalculateHash().Equal(genesis) {
+		return nil, errors.New("Got another block than the genesis block")
+	}
+	return sb.Roster, nil
+}
@@ -0,0 +1,153 @@
+package ots_test
+
+import (
+	"testing"
+
+	"github.com/dedis/cothority_template/ots"
+	"github.com/dedis/cothority_template/ots/otstest"
+	"github.com/dedis/cothority_template/ots/util"
+	ocs "github.com/dedis/onchain-secrets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/crypto.v0/random"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+func TestTranscript(t *testing.T) {
+	env, err := otstest.New(4)
+	require.Nil(t, err)
+	defer env.Close()
+
+	w, err := env.Write([]byte("secret"))
+	require.Nil(t, err)
+	r, err := env.Read(w)
+	require.Nil(t, err)
+	tr, err := ots.GetTranscript(env.Roster, r.WriteSB, r.SB, env.Reader)
+	require.Nil(t, err)
+	assert.Equal(t, 4, len(tr.DecShares))
+
+	// The transcript survives the export and holds the secret.
+	buf, err := tr.Export()
+	require.Nil(t, err)
+	tr, err = ots.ImportTranscript(buf)
+	require.Nil(t, err)
+	report := ots.VerifyTranscript(tr, env.Roster, env.Writer.Public)
+	require.Equal(t, 4, len(report))
+	for _, c := range report {
+		assert.Nil(t, c.Err, c.Name)
+	}
+	assert.True(t, report.Passed())
+	_, err = ots.RecoverSecret(w.DP.Suite, r.WTD, tr.DecShares, r.Threshold)
+	assert.Nil(t, err)
+
+	// A transcript of another write transaction to mix with the first one.
+	other, err := env.Write([]byte("other secret"))
+	require.Nil(t, err)
+	otherRead, err := env.Read(other)
+	require.Nil(t, err)
+	otherTr, err := ots.GetTranscript(env.Roster, otherRead.WriteSB, otherRead.SB, env.Reader)
+	require.Nil(t, err)
+	assert.True(t, ots.VerifyTranscript(otherTr, env.Roster, env.Writer.Public).Passed())
+
+	tests := []struct {
+		name   string
+		tamper func(tr *ots.Transcript)
+		// failed is the name of the checks expected to fail.
+		failed []string
+	}{
+		{"other shares", func(tr *ots.Transcript) { tr.DecShares = otherTr.DecShares },
+			[]string{"shares"}},
+		{"missing shares", func(tr *ots.Transcript) { tr.DecShares = tr.DecShares[:r.Threshold-1] },
+			[]string{"shares"}},
+		{"single share", func(tr *ots.Transcript) { tr.DecShares = tr.DecShares[:1] },
+			[]string{"shares"}},
+		{"no shares", func(tr *ots.Transcript) { tr.DecShares = nil },
+			[]string{"shares"}},
+		{"other keys", func(tr *ots.Transcript) { tr.Request.ACPublicKeys = tr.Request.ACPublicKeys[1:] },
+			[]string{"roster", "request", "shares"}},
+		{"other request", func(tr *ots.Transcript) { tr.Request = otherTr.Request },
+			[]string{"request", "shares"}},
+		{"other write", func(tr *ots.Transcript) { tr.Request.WriteTxnSBF = otherTr.Request.WriteTxnSBF },
+			[]string{"request", "shares"}},
+		{"unattested write", func(tr *ots.Transcript) { tamperWrite(t, tr, unattest) },
+			[]string{"write", "request", "shares"}},
+		{"unsigned write", func(tr *ots.Transcript) { tamperWrite(t, tr, unsign) },
+			[]string{"write", "request", "shares"}},
+		{"missing signature", func(tr *ots.Transcript) { tr.Signature = nil },
+			[]string{"request", "shares"}},
+		{"missing request", func(tr *ots.Transcript) { tr.Request = nil },
+			[]string{"roster", "write", "request", "shares"}},
+	}
+	for _, test := range tests {
+		tampered, err := ots.ImportTranscript(buf)
+		require.Nil(t, err)
+		test.tamper(tampered)
+		report := ots.VerifyTranscript(tampered, env.Roster, env.Writer.Public)
+		assert.False(t, report.Passed(), test.name)
+		var failed []string
+		for _, c := range report {
+			if c.Err != nil {
+				failed = append(failed, c.Name)
+			}
+		}
+		assert.Equal(t, test.failed, failed, test.name)
+	}
+
+	// A transcript that is consistent in itself, but not signed by the
+	// roster the auditor trusts, only fails the roster check.
+	for _, ac := range []*onet.Roster{onet.NewRoster(env.Roster.List[1:]), nil} {
+		report := ots.VerifyTranscript(tr, ac, env.Writer.Public)
+		assert.NotNil(t, report[0].Err)
+		assert.Nil(t, report[1].Err)
+		assert.Nil(t, report[2].Err)
+		assert.Nil(t, report[3].Err)
+	}
+
+	// Nor written by the writer the auditor expects only fails the write
+	// check, which without a writer only checks the attestation.
+	report = ots.VerifyTranscript(tr, env.Roster, env.Reader.Public)
+	assert.False(t, report.Passed())
+	assert.Equal(t, "write", report[1].Name)
+	assert.NotNil(t, report[1].Err)
+	assert.Nil(t, report[2].Err)
+	assert.True(t, ots.VerifyTranscript(tr, env.Roster, nil).Passed())
+
+	// The roster can be taken from the genesis block of the skipchain.
+	ac, err := ots.GenesisRoster(tr, env.SCURL.Genesis)
+	require.Nil(t, err)
+	assert.True(t, ots.VerifyTranscript(tr, ac, env.Writer.Public).Passed())
+	_, err = ots.GenesisRoster(tr, w.SB.Hash)
+	assert.Equal(t, ots.ErrOtherChain, err)
+
+	// Only transcripts of the known version are read.
+	tr.Version++
+	newer, err := network.Marshal(tr)
+	require.Nil(t, err)
+	_, err = ots.ImportTranscript(newer)
+	assert.NotNil(t, err)
+	_, err = ots.ImportTranscript(random.Bytes(100, random.Stream))
+	assert.NotNil(t, err)
+	notTranscript, err := network.Marshal(&util.WriteAttestation{Threshold: 1})
+	require.Nil(t, err)
+	_, err = ots.ImportTranscript(notTranscript)
+	assert.NotNil(t, err)
+}
+
+// tamperWrite changes the write block in the request of tr with f.
+func tamperWrite(t *testing.T, tr *ots.Transcript, f func(data *ocs.DataOCS)) {
+	_, msg, err := network.Unmarshal(tr.Request.WriteTxnSBF.Data)
+	require.Nil(t, err)
+	data := msg.(*ocs.DataOCS)
+	f(data)
+	tr.Request.WriteTxnSBF.Data, err = network.Marshal(data)
+	require.Nil(t, err)
+}
+
+func unattest(data *ocs.DataOCS) {
+	data.WriteTxn.Data.Attestation = nil
+}
+
+func unsign(data *ocs.DataOCS) {
+	data.WriteTxn.Signature = nil
+}
@@ -4,11 +4,13 @@ import (
 	"github.com/dedis/cothority/skipchain"
 	"gopkg.in/dedis/crypto.v0/abstract"
 	"gopkg.in/dedis/crypto.v0/share/pvss"
+	"gopkg.in/dedis/onet.v1/crypto"
 )
 
 type DataPVSS struct {
 	NumTrustee   int
 	Threshold    int
+	SuiteID      string
 	Suite        abstract.Suite
 	G            abstract.Point
 	H            abstract.Point
@@ -16,6 +18,7 @@ type DataPVSS struct {
 	SCPublicKeys []abstract.Point
 	EncShares    []*pvss.PubVerShare
 	EncProofs    []abstract.Point
+	ReaderPk     abstract.Point
 }
 
 type WriteTxnData struct {
@@ -25,6 +28,16 @@ type WriteTxnData struct {
 	EncProofs    []abstract.Point
 	HashEnc      []byte
 	ReaderPk     abstract.Point
+	// Threshold is the number of trustees needed to recover the secret.
+	Threshold int
+	// SuiteID is the suite of the PVSS data and of the reader's key.
+	SuiteID string
+	// MerkleRoot is the root of the fragments of the envelope if it is
+	// stored on the cothority, and nil otherwise.
+	MerkleRoot []byte
+	// Attestation shows that Threshold trustees checked the shares before
+	// the write transaction was stored.
+	Attestation *WriteAttestation
 }
 
 type OTSDecryptReqData struct {
@@ -32,6 +45,7 @@ type OTSDecryptReqData struct {
 	ReadTxnSBF     *skipchain.SkipBlockFix
 	InclusionProof *skipchain.BlockLink
 	ACPublicKeys   []abstract.Point
+	SuiteID        string
 }
 
 type DecryptedShare struct {
@@ -39,3 +53,29 @@ type DecryptedShare struct {
 	K  abstract.Point
 	Cs []abstract.Point
 }
+
+// WriteValidateReqData holds the PVSS part of a proposed write transaction
+// that the trustees check before it goes on the access-control skipchain.
+type WriteValidateReqData struct {
+	G            abstract.Point
+	SCPublicKeys []abstract.Point
+	EncShares    []*pvss.PubVerShare
+	EncProofs    []abstract.Point
+	ReaderPk     abstract.Point
+	Threshold    int
+	SuiteID      string
+}
+
+// WriteAttestation is the trustees' statement that the shares of a write
+// transaction are valid and can be recovered by any Threshold of them.
+type WriteAttestation struct {
+	Threshold  int
+	Signatures []*TrusteeSignature
+}
+
+// TrusteeSignature is the signature of the trustee at position Index in
+// SCPublicKeys on the attestation message.
+type TrusteeSignature struct {
+	Index     int
+	Signature *crypto.SchnorrSig
+}
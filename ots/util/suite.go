@@ -0,0 +1,62 @@
+package util
+
+import (
+	"errors"
+	"sync"
+
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/crypto.v0/ed25519"
+)
+
+// SuiteEd25519 identifies the Ed25519 suite that the conodes use for their
+// own keys. It is the suite of every write transaction that doesn't name
+// another one.
+const SuiteEd25519 = "Ed25519"
+
+var suites = struct {
+	sync.Mutex
+	m map[string]abstract.Suite
+}{m: map[string]abstract.Suite{
+	SuiteEd25519: ed25519.NewAES128SHA256Ed25519(false),
+}}
+
+// RegisterSuite makes suite available under id. The trustees of a write
+// transaction using this suite need keys from the same suite.
+func RegisterSuite(id string, suite abstract.Suite) {
+	suites.Lock()
+	defer suites.Unlock()
+	suites.m[id] = suite
+}
+
+// GetSuite returns the suite registered under id. An empty id stands for
+// SuiteEd25519.
+func GetSuite(id string) (abstract.Suite, error) {
+	if id == "" {
+		id = SuiteEd25519
+	}
+	suites.Lock()
+	defer suites.Unlock()
+	suite, ok := suites.m[id]
+	if !ok {
+		return nil, errors.New("Unknown suite: " + id)
+	}
+	return suite, nil
+}
+
+// NewDataPVSS returns the PVSS data for a write transaction using the suite
+// registered under suiteID.
+func NewDataPVSS(suiteID string, scPubKeys []abstract.Point, numTrustee int) (*DataPVSS, error) {
+	if suiteID == "" {
+		suiteID = SuiteEd25519
+	}
+	suite, err := GetSuite(suiteID)
+	if err != nil {
+		return nil, err
+	}
+	return &DataPVSS{
+		SuiteID:      suiteID,
+		Suite:        suite,
+		SCPublicKeys: scPubKeys,
+		NumTrustee:   numTrustee,
+	}, nil
+}
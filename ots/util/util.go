@@ -2,41 +2,122 @@ package util
 
 import (
 	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"os"
-	"syscall"
 
 	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/crypto.v0/share/pvss"
 	onet "gopkg.in/dedis/onet.v1"
 	"gopkg.in/dedis/onet.v1/app"
 	"gopkg.in/dedis/onet.v1/crypto"
 	"gopkg.in/dedis/onet.v1/log"
-	"gopkg.in/dedis/onet.v1/network"
 )
 
-func iiToF(sec int64, usec int64) float64 {
-	return float64(sec) + float64(usec)/1000000.0
+func SignMessage(suite abstract.Suite, msg []byte, privKey abstract.Scalar) (crypto.SchnorrSig, error) {
+	tmpHash := sha256.Sum256(msg)
+	msgHash := tmpHash[:]
+	return crypto.SignSchnorr(suite, privKey, msgHash)
 }
 
-func GetRTime() (tSys, tUsr float64) {
-	rusage := &syscall.Rusage{}
-	if err := syscall.Getrusage(syscall.RUSAGE_SELF, rusage); err != nil {
-		log.Error("Couldn't get rusage time:", err)
-		return -1, -1
-	}
-	s, u := rusage.Stime, rusage.Utime
-	return iiToF(int64(s.Sec), int64(s.Usec)), iiToF(int64(u.Sec), int64(u.Usec))
+// WriteTxnDigest hashes the PVSS data of a write transaction, that is every
+// field except HashEnc.
+func WriteTxnDigest(g abstract.Point, scPubKeys []abstract.Point, encShares []*pvss.PubVerShare, encProofs []abstract.Point, readerPk abstract.Point) ([]byte, error) {
+	if g == nil || readerPk == nil {
+		return nil, errors.New("Missing G or reader public key")
+	}
+	hash := sha256.New()
+	points := []abstract.Point{g, readerPk}
+	points = append(points, scPubKeys...)
+	points = append(points, encProofs...)
+	for _, p := range points {
+		if p == nil {
+			return nil, errors.New("Missing point in write transaction")
+		}
+		if _, err := p.MarshalTo(hash); err != nil {
+			return nil, err
+		}
+	}
+	var idx [4]byte
+	for _, sh := range encShares {
+		if sh == nil || sh.S.V == nil || sh.P.VG == nil || sh.P.VH == nil ||
+			sh.P.C == nil || sh.P.R == nil {
+			return nil, errors.New("Missing encrypted share")
+		}
+		binary.BigEndian.PutUint32(idx[:], uint32(sh.S.I))
+		hash.Write(idx[:])
+		for _, m := range []abstract.Marshaling{sh.S.V, sh.P.VG, sh.P.VH, sh.P.C, sh.P.R} {
+			if _, err := m.MarshalTo(hash); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return hash.Sum(nil), nil
 }
 
-func GetDiffRTime(tSys, tUsr float64) (tDiffSys, tDiffUsr float64) {
-	nowSys, nowUsr := GetRTime()
-	return nowSys - tSys, nowUsr - tUsr
+// AttestationMessage returns the message the trustees sign when they
+// attest that a write transaction is recoverable. It covers the suite, so
+// that the attestation only holds for the suite the shares were checked in.
+func AttestationMessage(data *WriteValidateReqData) ([]byte, error) {
+	digest, err := WriteTxnDigest(data.G, data.SCPublicKeys, data.EncShares, data.EncProofs, data.ReaderPk)
+	if err != nil {
+		return nil, err
+	}
+	var t [4]byte
+	binary.BigEndian.PutUint32(t[:], uint32(data.Threshold))
+	msg := append(digest, t[:]...)
+	tmpHash := sha256.Sum256(append(msg, data.SuiteID...))
+	return tmpHash[:], nil
 }
 
-func SignMessage(msg []byte, privKey abstract.Scalar) (crypto.SchnorrSig, error) {
-	tmpHash := sha256.Sum256(msg)
-	msgHash := tmpHash[:]
-	return crypto.SignSchnorr(network.Suite, privKey, msgHash)
+// ValidateData returns the part of the write transaction that the trustees
+// attested.
+func (wtd *WriteTxnData) ValidateData() *WriteValidateReqData {
+	return &WriteValidateReqData{
+		G:            wtd.G,
+		SCPublicKeys: wtd.SCPublicKeys,
+		EncShares:    wtd.EncShares,
+		EncProofs:    wtd.EncProofs,
+		ReaderPk:     wtd.ReaderPk,
+		Threshold:    wtd.Threshold,
+		SuiteID:      wtd.SuiteID,
+	}
+}
+
+// VerifyWriteAttestation checks that at least data.Threshold distinct
+// trustees signed the attestation for data.
+func VerifyWriteAttestation(att *WriteAttestation, data *WriteValidateReqData) error {
+	if att == nil {
+		return errors.New("Missing write attestation")
+	}
+	if att.Threshold != data.Threshold {
+		return errors.New("Attestation is for a different threshold")
+	}
+	suite, err := GetSuite(data.SuiteID)
+	if err != nil {
+		return err
+	}
+	msg, err := AttestationMessage(data)
+	if err != nil {
+		return err
+	}
+
+	signed := make(map[int]bool)
+	for _, ts := range att.Signatures {
+		if ts == nil || ts.Signature == nil || signed[ts.Index] ||
+			ts.Index < 0 || ts.Index >= len(data.SCPublicKeys) ||
+			data.SCPublicKeys[ts.Index] == nil {
+			continue
+		}
+		if crypto.VerifySchnorr(suite, data.SCPublicKeys[ts.Index], msg, *ts.Signature) == nil {
+			signed[ts.Index] = true
+		}
+	}
+	if len(signed) < data.Threshold {
+		return errors.New("Not enough trustees attested the write transaction")
+	}
+	return nil
 }
 
 func CreatePointH(suite abstract.Suite, pubKey abstract.Point) (abstract.Point, error) {
@@ -51,6 +132,20 @@ func CreatePointH(suite abstract.Suite, pubKey abstract.Point) (abstract.Point,
 	return h, nil
 }
 
+// SamePoints returns true if a and b hold the same points in the same order.
+// Empty lists are never the same, so that missing keys don't pass a check.
+func SamePoints(a, b []abstract.Point) bool {
+	if len(a) == 0 || len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] == nil || b[i] == nil || !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
 func ReadRoster(tomlFileName string) (*onet.Roster, error) {
 	log.Lvl3("Reading in the roster from group.toml")
 	f, err := os.Open(tomlFileName)
@@ -68,3 +163,35 @@ func ReadRoster(tomlFileName string) (*onet.Roster, error) {
 	log.Lvl3(el)
 	return el, err
 }
+
+// PointToString64 returns the base64 encoding of p, as used for the public
+// keys in group.toml files.
+func PointToString64(p abstract.Point) (string, error) {
+	buf, err := p.MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf), nil
+}
+
+// ScalarToString64 returns the base64 encoding of s.
+func ScalarToString64(s abstract.Scalar) (string, error) {
+	buf, err := s.MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf), nil
+}
+
+// String64ToScalar decodes a scalar encoded by ScalarToString64.
+func String64ToScalar(suite abstract.Suite, str string) (abstract.Scalar, error) {
+	buf, err := base64.StdEncoding.DecodeString(str)
+	if err != nil {
+		return nil, err
+	}
+	s := suite.Scalar()
+	if err := s.UnmarshalBinary(buf); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,82 @@
+package protocol
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// Fault is a misbehaviour of a trustee in the decryption protocol. Faults
+// are only meant for tests and simulations, to check that the reader still
+// recovers the secret as long as enough trustees behave.
+type Fault int
+
+const (
+	// FaultNone is an honest trustee.
+	FaultNone Fault = iota
+	// FaultCrash never replies. On the root, its own share is left out.
+	// It is the only fault that also applies to the validation of write
+	// transactions.
+	FaultCrash
+	// FaultDelay replies after FaultDelayDuration.
+	FaultDelay
+	// FaultGarbage replies with random points instead of its share.
+	FaultGarbage
+	// FaultWrongIndex replies with its own share, correctly decrypted,
+	// but labelled with the index of the next trustee.
+	FaultWrongIndex
+)
+
+// ParseFault returns the fault with the given name, as used in the
+// simulation files: "none", "crash", "delay", "garbage" or "wrongindex".
+func ParseFault(name string) (Fault, error) {
+	switch name {
+	case "", "none":
+		return FaultNone, nil
+	case "crash":
+		return FaultCrash, nil
+	case "delay":
+		return FaultDelay, nil
+	case "garbage":
+		return FaultGarbage, nil
+	case "wrongindex":
+		return FaultWrongIndex, nil
+	}
+	return FaultNone, errors.New("Unknown fault: " + name)
+}
+
+// FaultDelayDuration is how long a trustee with FaultDelay waits before
+// replying.
+var FaultDelayDuration = time.Second
+
+var faults = struct {
+	sync.Mutex
+	m map[network.ServerIdentityID]Fault
+}{m: map[network.ServerIdentityID]Fault{}}
+
+// SetFault makes the trustee id misbehave in all decryption protocols it
+// takes part in from now on.
+func SetFault(id network.ServerIdentityID, f Fault) {
+	faults.Lock()
+	defer faults.Unlock()
+	if f == FaultNone {
+		delete(faults.m, id)
+		return
+	}
+	faults.m[id] = f
+}
+
+// ClearFaults makes all trustees honest again.
+func ClearFaults() {
+	faults.Lock()
+	defer faults.Unlock()
+	faults.m = map[network.ServerIdentityID]Fault{}
+}
+
+func faultOf(id network.ServerIdentityID) Fault {
+	faults.Lock()
+	defer faults.Unlock()
+	return faults.m[id]
+}
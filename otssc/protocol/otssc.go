@@ -3,7 +3,10 @@ package protocol
 import (
 	"crypto/sha256"
 	"errors"
+	"time"
 
+	"github.com/dedis/cothority_template/measure"
+	"github.com/dedis/cothority_template/netem"
 	"github.com/dedis/cothority_template/ots/util"
 	ocs "github.com/dedis/onchain-secrets"
 
@@ -19,6 +22,43 @@ import (
 
 var Name = "otssc"
 
+// The reasons why a trustee refuses a decryption request.
+var (
+	// ErrIncompleteRequest is a request without data, signature, blocks or
+	// forward-link.
+	ErrIncompleteRequest = errors.New("Incomplete decryption request")
+	// ErrNoWriteTxn is a write block that holds no write transaction.
+	ErrNoWriteTxn = errors.New("No write transaction in the write block")
+	// ErrSuite is a request for another suite than the one of the write
+	// transaction.
+	ErrSuite = errors.New("Suite of the request differs from the write transaction")
+	// ErrNoReadTxn is a read block that holds no read transaction.
+	ErrNoReadTxn = errors.New("No read transaction in the read block")
+	// ErrRequestSignature is a request not signed by the reader of the
+	// write transaction.
+	ErrRequestSignature = errors.New("Cannot verify DecReq message signature")
+	// ErrAttestation is a write transaction without the attestation of
+	// Threshold trustees.
+	ErrAttestation = errors.New("Write transaction is not attested by the trustees")
+	// ErrNoLinkSignature is a forward-link without signature, or one too
+	// short to be a signature.
+	ErrNoLinkSignature = errors.New("No signature present on forward-link")
+	// ErrLinkHash is a forward-link to another block than the read block.
+	ErrLinkHash = errors.New("Forward link hash does not match read transaction hash")
+	// ErrACPublicKeys are access-control keys that differ from the roster
+	// of the write block.
+	ErrACPublicKeys = errors.New("Access-control keys are not those of the write block")
+	// ErrLinkSignature is a forward-link not signed by the access-control
+	// conodes.
+	ErrLinkSignature = errors.New("Cannot verify forward-link signature")
+	// ErrWriteHash is a read transaction for another write transaction.
+	ErrWriteHash = errors.New("Invalid write block hash in the read block")
+)
+
+// DefaultTimeout is how long the root waits for the replies of the other
+// trustees if the Timeout of OTSDecrypt or OTSValidate isn't set.
+var DefaultTimeout = 10 * time.Second
+
 func init() {
 	network.RegisterMessage(AnnounceDecrypt{})
 	network.RegisterMessage(DecryptReply{})
@@ -31,11 +71,19 @@ func init() {
 type OTSDecrypt struct {
 	*onet.TreeNodeInstance
 	ChannelAnnounce chan StructAnnounceDecrypt
-	ChannelReply    chan []StructDecryptReply
+	ChannelReply    chan StructDecryptReply
 	DecShares       chan []*util.DecryptedShare
 	DecReqData      *util.OTSDecryptReqData
 	Signature       *crypto.SchnorrSig
 	RootIndex       int
+	// Timeout is how long the root waits for the shares of the other
+	// trustees. Shares that arrive later are left out.
+	Timeout time.Duration
+	// TrusteeCPU holds the CPU seconds every trustee spent on the request.
+	// It is set on the root before the shares are sent to DecShares.
+	TrusteeCPU map[network.ServerIdentityID]float64
+	// started is closed by Start, once the fields above are set.
+	started chan struct{}
 }
 
 func NewProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
@@ -43,6 +91,8 @@ func NewProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
 	otsDecrypt := &OTSDecrypt{
 		TreeNodeInstance: n,
 		DecShares:        make(chan []*util.DecryptedShare),
+		TrusteeCPU:       map[network.ServerIdentityID]float64{},
+		started:          make(chan struct{}),
 	}
 	err := otsDecrypt.RegisterChannel(&otsDecrypt.ChannelAnnounce)
 
@@ -57,10 +107,13 @@ func NewProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
 	return otsDecrypt, nil
 }
 
+// Start sends the request to the other trustees. A trustee that can't be
+// reached is left out, like one that doesn't reply in time.
 func (p *OTSDecrypt) Start() error {
 	log.Lvl3("Starting OTSDecrypt")
+	close(p.started)
 	for _, c := range p.Children() {
-		err := p.SendTo(c, &AnnounceDecrypt{
+		err := netem.SendTo(p.TreeNodeInstance, c, &AnnounceDecrypt{
 			DecReqData: p.DecReqData,
 			Signature:  p.Signature,
 			RootIndex:  p.RootIndex,
@@ -68,20 +121,15 @@ func (p *OTSDecrypt) Start() error {
 
 		if err != nil {
 			log.Error(p.Info(), "failed to send to", c.Name(), err)
-			return err
 		}
 	}
 	return nil
 }
 
 func (p *OTSDecrypt) Dispatch() error {
+	fault := faultOf(p.ServerIdentity().ID)
 	if p.IsLeaf() {
 		announcement := <-p.ChannelAnnounce
-		writeTxnData, sigErr := verifyDecryptionRequest(announcement.DecReqData, announcement.Signature)
-		if sigErr != nil {
-			return sigErr
-		}
-
 		idx := p.Index()
 		// This is not needed anymore because indexes
 		// are swapped instead of shifting
@@ -93,31 +141,18 @@ func (p *OTSDecrypt) Dispatch() error {
 			idx = 0
 		}
 
-		h, err := util.CreatePointH(network.Suite, writeTxnData.ReaderPk)
+		if fault == FaultCrash {
+			log.Lvl2(p.Name(), "is faulty and doesn't reply")
+			return nil
+		}
+		ds, cpu, err := p.decryptShare(announcement.DecReqData, announcement.Signature, idx, fault)
 		if err != nil {
-			log.Error(p.Info(), "Failed to generate point h", p.Name(), err)
 			return err
 		}
-
-		// ds := &util.DecryptedShare{
-		// 	Index: p.Index(),
-		// }
-		ds := &util.DecryptedShare{
-			K:  nil,
-			Cs: nil,
-		}
-		tempSh, err := pvss.DecShare(network.Suite, h, p.Public(), writeTxnData.EncProofs[idx], p.Private(), writeTxnData.EncShares[idx])
-		if err != nil {
-			log.Error(p.Info(), "Failed to decrypt share", p.Name(), err)
-			// ds.K = nil
-			// ds.Cs = nil
-		} else {
-			K, Cs := elGamalEncrypt(tempSh, writeTxnData.ReaderPk)
-			ds.K = K
-			ds.Cs = Cs
+		if fault == FaultDelay {
+			time.Sleep(FaultDelayDuration)
 		}
-
-		err = p.SendTo(p.Parent(), &DecryptReply{ds})
+		err = netem.SendTo(p.TreeNodeInstance, p.Parent(), &DecryptReply{DecShare: ds, CPU: cpu})
 		if err != nil {
 			log.Error(p.Info(), "Failed to send reply to", p.Parent().Name(), err)
 			return err
@@ -125,47 +160,93 @@ func (p *OTSDecrypt) Dispatch() error {
 		return nil
 	}
 
-	var decShares []*util.DecryptedShare
-	idx := p.RootIndex
-	reply := <-p.ChannelReply
-	for _, c := range reply {
-		decShares = append(decShares, c.DecryptReply.DecShare)
+	<-p.started
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
 	}
+	deadline := time.After(timeout)
 
-	writeTxnData, sigErr := verifyDecryptionRequest(p.DecReqData, p.Signature)
-	if sigErr != nil {
-		return sigErr
+	var decShares []*util.DecryptedShare
+	if fault != FaultCrash {
+		ds, cpu, err := p.decryptShare(p.DecReqData, p.Signature, p.RootIndex, fault)
+		if err != nil {
+			// The other trustees refuse the request as well.
+			log.Error(p.Info(), "refuses the decryption request:", err)
+			p.DecShares <- nil
+			return err
+		}
+		p.TrusteeCPU[p.ServerIdentity().ID] = cpu
+		if fault == FaultDelay {
+			time.Sleep(FaultDelayDuration)
+		}
+		decShares = append(decShares, ds)
 	}
 
-	h, err := util.CreatePointH(network.Suite, writeTxnData.ReaderPk)
-	if err != nil {
-		log.Error(p.Info(), "Failed to generate point h", p.Name(), err)
-		return err
+	children := len(p.Children())
+collect:
+	for replies := 0; replies < children; replies++ {
+		select {
+		case c := <-p.ChannelReply:
+			decShares = append(decShares, c.DecryptReply.DecShare)
+			p.TrusteeCPU[c.ServerIdentity.ID] = c.CPU
+		case <-deadline:
+			log.Lvl2(p.ServerIdentity().Address, "timed out with", replies, "of", children, "replies")
+			break collect
+		}
 	}
 
-	// ds := &util.DecryptedShare{
-	// 	Index: p.Index(),
-	// }
+	log.Lvl3(p.ServerIdentity().Address, "is done with total of", len(decShares))
+	p.DecShares <- decShares
+	return nil
+}
+
+// decryptShare verifies the decryption request and returns the share idx of
+// the write transaction, decrypted and re-encrypted for the reader, together
+// with the CPU seconds it took. If the share can't be decrypted, an empty
+// share is returned so that the reader still gets the others. FaultGarbage
+// and FaultWrongIndex replace the share.
+func (p *OTSDecrypt) decryptShare(data *util.OTSDecryptReqData, sig *crypto.SchnorrSig, idx int, fault Fault) (*util.DecryptedShare, float64, error) {
 	ds := &util.DecryptedShare{
 		K:  nil,
 		Cs: nil,
 	}
-	tempSh, err := pvss.DecShare(network.Suite, h, p.Public(), writeTxnData.EncProofs[idx], p.Private(), writeTxnData.EncShares[idx])
-
-	if err != nil {
-		log.Error(p.Info(), "Failed to decrypt share", p.Name(), err)
-		ds.K = nil
-		ds.Cs = nil
-	} else {
-		K, Cs := elGamalEncrypt(tempSh, writeTxnData.ReaderPk)
-		ds.K = K
-		ds.Cs = Cs
-	}
-
-	decShares = append(decShares, ds)
-	log.Lvl3(p.ServerIdentity().Address, "is done with total of", len(decShares))
-	p.DecShares <- decShares
-	return nil
+	var err error
+	cpu := measure.CPUTime(func() {
+		writeTxnData, suite, sigErr := VerifyDecryptionRequest(data, sig)
+		if sigErr != nil {
+			err = sigErr
+			return
+		}
+		h, hErr := util.CreatePointH(suite, writeTxnData.ReaderPk)
+		if hErr != nil {
+			log.Error(p.Info(), "Failed to generate point h", p.Name(), hErr)
+			err = hErr
+			return
+		}
+		n := len(writeTxnData.EncShares)
+		if len(writeTxnData.EncProofs) != n || idx < 0 || idx >= n ||
+			writeTxnData.EncShares[idx] == nil || writeTxnData.EncProofs[idx] == nil {
+			err = errors.New("No share for this trustee in the write transaction")
+			return
+		}
+		tempSh, decErr := pvss.DecShare(suite, h, p.Public(), writeTxnData.EncProofs[idx], p.Private(), writeTxnData.EncShares[idx])
+		if decErr != nil {
+			log.Error(p.Info(), "Failed to decrypt share", p.Name(), decErr)
+			return
+		}
+		if fault == FaultWrongIndex {
+			tempSh.S.I = (idx + 1) % n
+		}
+		ds.K, ds.Cs = elGamalEncrypt(suite, tempSh, writeTxnData.ReaderPk)
+		if fault == FaultGarbage {
+			ds.K = suite.Point().Pick(nil, random.Stream)
+			for i := range ds.Cs {
+				ds.Cs[i] = suite.Point().Pick(nil, random.Stream)
+			}
+		}
+	})
+	return ds, cpu, err
 }
 
 func min(a int, b int) int {
@@ -175,7 +256,7 @@ func min(a int, b int) int {
 	return b
 }
 
-func elGamalEncrypt(ds *pvss.PubVerShare, rPubKey abstract.Point) (abstract.Point, []abstract.Point) {
+func elGamalEncrypt(suite abstract.Suite, ds *pvss.PubVerShare, rPubKey abstract.Point) (abstract.Point, []abstract.Point) {
 
 	msg, err := network.Marshal(ds)
 	if err != nil {
@@ -184,65 +265,117 @@ func elGamalEncrypt(ds *pvss.PubVerShare, rPubKey abstract.Point) (abstract.Poin
 	}
 
 	var Cs []abstract.Point
-	k := network.Suite.Scalar().Pick(random.Stream)
-	K := network.Suite.Point().Mul(nil, k)
-	S := network.Suite.Point().Mul(rPubKey, k)
+	k := suite.Scalar().Pick(random.Stream)
+	K := suite.Point().Mul(nil, k)
+	S := suite.Point().Mul(rPubKey, k)
 	for len(msg) > 0 {
-		kp, _ := network.Suite.Point().Pick(msg, random.Stream)
-		Cs = append(Cs, network.Suite.Point().Add(S, kp))
+		kp, _ := suite.Point().Pick(msg, random.Stream)
+		Cs = append(Cs, suite.Point().Add(S, kp))
 		msg = msg[min(len(msg), kp.PickLen()):]
 	}
 	return K, Cs
 }
 
-func verifyDecryptionRequest(decReqData *util.OTSDecryptReqData, sig *crypto.SchnorrSig) (*util.WriteTxnData, error) {
+// VerifyDecryptionRequest checks that the reader of the read transaction in
+// decReqData signed the request, that the trustees attested the write
+// transaction, that the forward-link proves the read transaction with the
+// signature of the access-control conodes in the roster of the write block,
+// and that the read transaction is for the write transaction in decReqData.
+// It returns the write transaction and its suite.
+//
+// Every trustee runs it before releasing its share, and it needs nothing
+// but the request, so it can also check a request after the fact.
+func VerifyDecryptionRequest(decReqData *util.OTSDecryptReqData, sig *crypto.SchnorrSig) (*util.WriteTxnData, abstract.Suite, error) {
+	if decReqData == nil || sig == nil || sig.Challenge == nil || sig.Response == nil ||
+		decReqData.WriteTxnSBF == nil || decReqData.ReadTxnSBF == nil ||
+		decReqData.InclusionProof == nil {
+		return nil, nil, ErrIncompleteRequest
+	}
+	// The skipchain blocks are always encoded with the cothority's suite.
 	_, tmp, err := network.Unmarshal(decReqData.WriteTxnSBF.Data)
 	if err != nil {
 		log.Errorf("Unmarshaling WriteTxnSBF failed: %v", err)
-		return nil, err
+		return nil, nil, ErrNoWriteTxn
+	}
+	data, ok := tmp.(*ocs.DataOCS)
+	if !ok || data.WriteTxn == nil || data.WriteTxn.Data == nil ||
+		data.WriteTxn.Data.ReaderPk == nil {
+		return nil, nil, ErrNoWriteTxn
+	}
+	writeTxn := data.WriteTxn.Data
+	// The suite travels with the write transaction, the one of the request
+	// only has to agree.
+	if decReqData.SuiteID != writeTxn.SuiteID {
+		log.Error("Suite of the DecReq differs from the write transaction")
+		return nil, nil, ErrSuite
+	}
+	suite, err := util.GetSuite(writeTxn.SuiteID)
+	if err != nil {
+		log.Errorf("Cannot use the suite of the write transaction: %v", err)
+		return nil, nil, err
 	}
-
-	writeTxn := tmp.(*ocs.DataOCS).WriteTxn.Data
 	_, tmp, err = network.Unmarshal(decReqData.ReadTxnSBF.Data)
 	if err != nil {
 		log.Errorf("Unmarshaling ReadTxnSBF failed: %v", err)
-		return nil, err
+		return nil, nil, ErrNoReadTxn
+	}
+	data, ok = tmp.(*ocs.DataOCS)
+	if !ok || data.Read == nil {
+		return nil, nil, ErrNoReadTxn
 	}
+	readTxn := data.Read
 
-	readTxn := tmp.(*ocs.DataOCS).Read
 	// 1) Check signature on the DecReq message
 	drd, err := network.Marshal(decReqData)
 	if err != nil {
 		log.Errorf("Marshaling DecryptReqData failed: %v", err)
-		return nil, err
+		return nil, nil, err
 	}
 
 	tmpHash := sha256.Sum256(drd)
 	drdHash := tmpHash[:]
-	sigErr := crypto.VerifySchnorr(network.Suite, writeTxn.ReaderPk, drdHash, *sig)
+	sigErr := crypto.VerifySchnorr(suite, writeTxn.ReaderPk, drdHash, *sig)
 	if sigErr != nil {
 		log.Errorf("Cannot verify DecReq message signature: %v", sigErr)
-		return nil, sigErr
+		return nil, nil, ErrRequestSignature
+	}
+
+	// The trustees only release shares they checked when the write
+	// transaction was created.
+	attErr := util.VerifyWriteAttestation(writeTxn.Attestation, writeTxn.ValidateData())
+	if attErr != nil {
+		log.Errorf("Write transaction is not attested: %v", attErr)
+		return nil, nil, ErrAttestation
 	}
 
 	// 2) Check inclusion proof
 	readSBHash := decReqData.ReadTxnSBF.CalculateHash()
 	proof := decReqData.InclusionProof
-	if len(proof.Signature) == 0 {
+	if len(proof.Signature) < network.Suite.PointLen()+network.Suite.ScalarLen() {
 		log.Error("No signature present on forward-link")
-		return nil, errors.New("No signature present on forward-link")
+		return nil, nil, ErrNoLinkSignature
 	}
 
 	hc := proof.Hash.Equal(readSBHash)
 	if !hc {
 		log.Error("Forward link hash does not match read transaction hash")
-		return nil, errors.New("Forward link hash does not match read transaction hash")
+		return nil, nil, ErrLinkHash
+	}
+
+	// The forward-link to the read block is signed by the roster of the
+	// block before it, which is at the latest the write block.
+	if decReqData.WriteTxnSBF.Roster == nil ||
+		!util.SamePoints(decReqData.ACPublicKeys, decReqData.WriteTxnSBF.Roster.Publics()) {
+		log.Error("Access-control keys are not those of the write block")
+		return nil, nil, ErrACPublicKeys
 	}
 
+	// The forward-link is signed by the access-control conodes with their
+	// own keys, so it stays with the cothority's suite.
 	sigErr = cosi.VerifySignature(network.Suite, decReqData.ACPublicKeys, proof.Hash, proof.Signature)
 	if sigErr != nil {
 		log.Error("Cannot verify forward-link signature")
-		return nil, sigErr
+		return nil, nil, ErrLinkSignature
 	}
 
 	// 3) Check that read contains write's hash
@@ -250,7 +383,7 @@ func verifyDecryptionRequest(decReqData *util.OTSDecryptReqData, sig *crypto.Sch
 	hc = readTxn.DataID.Equal(writeSBHash)
 	if !hc {
 		log.Error("Invalid write block hash in the read block")
-		return nil, errors.New("Invalid write block hash in the read block")
+		return nil, nil, ErrWriteHash
 	}
-	return writeTxn, nil
+	return writeTxn, suite, nil
 }
@@ -0,0 +1,319 @@
+package protocol_test
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/cothority_template/ots/keystore"
+	"github.com/dedis/cothority_template/ots/otstest"
+	"github.com/dedis/cothority_template/ots/util"
+	"github.com/dedis/cothority_template/otssc/protocol"
+	ocs "github.com/dedis/onchain-secrets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/crypto.v0/random"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/crypto"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+func TestMain(m *testing.M) {
+	log.MainTest(m)
+}
+
+// request is a valid decryption request, together with what is needed to
+// tamper with it.
+type request struct {
+	env  *otstest.Env
+	data *util.OTSDecryptReqData
+	sig  *crypto.SchnorrSig
+	// other is a second write transaction of the same writer and reader.
+	other *skipchain.SkipBlock
+}
+
+func newRequest(t *testing.T, env *otstest.Env) *request {
+	w, err := env.Write([]byte("secret"))
+	require.Nil(t, err)
+	r, err := env.Read(w)
+	require.Nil(t, err)
+	other, err := env.Write([]byte("other secret"))
+	require.Nil(t, err)
+	link := r.WriteSB.GetForward(r.SB.Index - r.WriteSB.Index - 1)
+	require.NotNil(t, link)
+	req := &request{
+		env: env,
+		data: &util.OTSDecryptReqData{
+			WriteTxnSBF:    r.WriteSB.SkipBlockFix,
+			ReadTxnSBF:     r.SB.SkipBlockFix,
+			InclusionProof: link,
+			ACPublicKeys:   r.WriteSB.Roster.Publics(),
+			SuiteID:        env.SuiteID,
+		},
+		other: other.SB,
+	}
+	req.sig = sign(t, req.data, env.Reader)
+	return req
+}
+
+func sign(t *testing.T, data *util.OTSDecryptReqData, key *keystore.Key) *crypto.SchnorrSig {
+	msg, err := network.Marshal(data)
+	require.Nil(t, err)
+	sig, err := key.Sign(msg)
+	require.Nil(t, err)
+	return &sig
+}
+
+// clone returns a copy of the request that can be changed without
+// changing req.
+func (req *request) clone() *util.OTSDecryptReqData {
+	d := *req.data
+	wsbf := *d.WriteTxnSBF
+	wsbf.Data = append([]byte{}, wsbf.Data...)
+	d.WriteTxnSBF = &wsbf
+	rsbf := *d.ReadTxnSBF
+	rsbf.Data = append([]byte{}, rsbf.Data...)
+	d.ReadTxnSBF = &rsbf
+	link := *d.InclusionProof
+	link.Hash = append([]byte{}, link.Hash...)
+	link.Signature = append([]byte{}, link.Signature...)
+	d.InclusionProof = &link
+	d.ACPublicKeys = append([]abstract.Point{}, d.ACPublicKeys...)
+	return &d
+}
+
+// rewrite changes the write transaction in the write block of d.
+func rewrite(t *testing.T, d *util.OTSDecryptReqData, f func(wtd *util.WriteTxnData)) {
+	_, msg, err := network.Unmarshal(d.WriteTxnSBF.Data)
+	require.Nil(t, err)
+	data, ok := msg.(*ocs.DataOCS)
+	require.True(t, ok)
+	f(data.WriteTxn.Data)
+	d.WriteTxnSBF.Data, err = network.Marshal(data)
+	require.Nil(t, err)
+}
+
+func TestVerifyDecryptionRequest(t *testing.T) {
+	env, err := otstest.New(4)
+	require.Nil(t, err)
+	defer env.Close()
+	req := newRequest(t, env)
+	suite, err := util.GetSuite(env.SuiteID)
+	require.Nil(t, err)
+	mallory, err := keystore.NewKey(env.SuiteID)
+	require.Nil(t, err)
+
+	wtd, _, err := protocol.VerifyDecryptionRequest(req.data, req.sig)
+	require.Nil(t, err)
+	assert.True(t, wtd.ReaderPk.Equal(env.Reader.Public))
+
+	tests := []struct {
+		name string
+		// tamper changes d, which is a copy of the valid request.
+		tamper func(d *util.OTSDecryptReqData)
+		// resign signs the tampered request again with the reader's key,
+		// so that the checks after the signature are reached.
+		resign bool
+		// sig is used instead of the signature of the request if set.
+		sig *crypto.SchnorrSig
+		// noSig sends no signature at all.
+		noSig bool
+		// err is the expected error, or any error if nil.
+		err error
+	}{
+		{"missing signature", nil, false, nil, true, protocol.ErrIncompleteRequest},
+		{"incomplete signature", nil, false, &crypto.SchnorrSig{Challenge: req.sig.Challenge},
+			false, protocol.ErrIncompleteRequest},
+		{"missing write block", func(d *util.OTSDecryptReqData) { d.WriteTxnSBF = nil },
+			true, nil, false, protocol.ErrIncompleteRequest},
+		{"missing read block", func(d *util.OTSDecryptReqData) { d.ReadTxnSBF = nil },
+			true, nil, false, protocol.ErrIncompleteRequest},
+		{"missing forward-link", func(d *util.OTSDecryptReqData) { d.InclusionProof = nil },
+			true, nil, false, protocol.ErrIncompleteRequest},
+		{"other suite", func(d *util.OTSDecryptReqData) { d.SuiteID = "unknown" },
+			true, nil, false, protocol.ErrSuite},
+		{"unknown suite", func(d *util.OTSDecryptReqData) {
+			d.SuiteID = "unknown"
+			rewrite(t, d, func(wtd *util.WriteTxnData) { wtd.SuiteID = "unknown" })
+		}, true, nil, false, nil},
+		{"empty write block", func(d *util.OTSDecryptReqData) { d.WriteTxnSBF.Data = nil },
+			true, nil, false, protocol.ErrNoWriteTxn},
+		{"truncated write block", func(d *util.OTSDecryptReqData) { d.WriteTxnSBF.Data = d.WriteTxnSBF.Data[:10] },
+			true, nil, false, protocol.ErrNoWriteTxn},
+		{"truncated read block", func(d *util.OTSDecryptReqData) { d.ReadTxnSBF.Data = d.ReadTxnSBF.Data[:10] },
+			true, nil, false, protocol.ErrNoReadTxn},
+		{"garbage write block", func(d *util.OTSDecryptReqData) { d.WriteTxnSBF.Data = random.Bytes(100, random.Stream) },
+			true, nil, false, protocol.ErrNoWriteTxn},
+		{"not a write transaction", func(d *util.OTSDecryptReqData) {
+			d.WriteTxnSBF.Data, _ = network.Marshal(&util.WriteAttestation{Threshold: 1})
+		}, true, nil, false, protocol.ErrNoWriteTxn},
+		{"swapped blocks", func(d *util.OTSDecryptReqData) {
+			d.WriteTxnSBF, d.ReadTxnSBF = d.ReadTxnSBF, d.WriteTxnSBF
+		}, true, nil, false, protocol.ErrNoWriteTxn},
+		{"write block as read block", func(d *util.OTSDecryptReqData) { d.ReadTxnSBF = d.WriteTxnSBF },
+			true, nil, false, protocol.ErrNoReadTxn},
+		{"tampered after signing", func(d *util.OTSDecryptReqData) {
+			d.ACPublicKeys[0], d.ACPublicKeys[1] = d.ACPublicKeys[1], d.ACPublicKeys[0]
+		}, false, nil, false, protocol.ErrRequestSignature},
+		{"signed by another key", nil, false, sign(t, req.data, mallory), false, protocol.ErrRequestSignature},
+		{"tampered signature", nil, false, &crypto.SchnorrSig{
+			Challenge: req.sig.Challenge,
+			Response:  suite.Scalar().Pick(random.Stream),
+		}, false, protocol.ErrRequestSignature},
+		{"write without attestation", func(d *util.OTSDecryptReqData) {
+			rewrite(t, d, func(wtd *util.WriteTxnData) { wtd.Attestation = nil })
+		}, true, nil, false, protocol.ErrAttestation},
+		{"attestation of too few trustees", func(d *util.OTSDecryptReqData) {
+			rewrite(t, d, func(wtd *util.WriteTxnData) {
+				wtd.Attestation.Signatures = wtd.Attestation.Signatures[:wtd.Threshold-1]
+			})
+		}, true, nil, false, protocol.ErrAttestation},
+		{"lowered threshold", func(d *util.OTSDecryptReqData) {
+			rewrite(t, d, func(wtd *util.WriteTxnData) { wtd.Threshold = 1 })
+		}, true, nil, false, protocol.ErrAttestation},
+		{"no forward-link signature", func(d *util.OTSDecryptReqData) { d.InclusionProof.Signature = nil },
+			true, nil, false, protocol.ErrNoLinkSignature},
+		{"truncated forward-link signature", func(d *util.OTSDecryptReqData) {
+			d.InclusionProof.Signature = d.InclusionProof.Signature[:10]
+		}, true, nil, false, protocol.ErrNoLinkSignature},
+		{"forward-link to another block", func(d *util.OTSDecryptReqData) { d.InclusionProof.Hash = req.other.Hash },
+			true, nil, false, protocol.ErrLinkHash},
+		{"tampered read block", func(d *util.OTSDecryptReqData) { d.ReadTxnSBF.Index++ },
+			true, nil, false, protocol.ErrLinkHash},
+		{"no access-control keys", func(d *util.OTSDecryptReqData) { d.ACPublicKeys = nil },
+			true, nil, false, protocol.ErrACPublicKeys},
+		{"missing access-control key", func(d *util.OTSDecryptReqData) { d.ACPublicKeys = d.ACPublicKeys[1:] },
+			true, nil, false, protocol.ErrACPublicKeys},
+		{"other access-control key", func(d *util.OTSDecryptReqData) { d.ACPublicKeys[0] = mallory.Public },
+			true, nil, false, protocol.ErrACPublicKeys},
+		{"reordered access-control keys", func(d *util.OTSDecryptReqData) {
+			d.ACPublicKeys[0], d.ACPublicKeys[1] = d.ACPublicKeys[1], d.ACPublicKeys[0]
+		}, true, nil, false, protocol.ErrACPublicKeys},
+		{"tampered forward-link signature", func(d *util.OTSDecryptReqData) { d.InclusionProof.Signature[0] ^= 1 },
+			true, nil, false, protocol.ErrLinkSignature},
+		{"read for another write", func(d *util.OTSDecryptReqData) { d.WriteTxnSBF = req.other.SkipBlockFix },
+			true, nil, false, protocol.ErrWriteHash},
+	}
+	for _, test := range tests {
+		d := req.clone()
+		if test.tamper != nil {
+			test.tamper(d)
+		}
+		sig := req.sig
+		switch {
+		case test.noSig:
+			sig = nil
+		case test.sig != nil:
+			sig = test.sig
+		case test.resign:
+			sig = sign(t, d, env.Reader)
+		}
+		_, _, err := verify(t, test.name, d, sig)
+		if test.err == nil {
+			assert.NotNil(t, err, test.name)
+		} else {
+			assert.Equal(t, test.err, err, test.name)
+		}
+	}
+
+	// A missing request can't be signed.
+	_, _, err = verify(t, "missing request", nil, req.sig)
+	assert.Equal(t, protocol.ErrIncompleteRequest, err)
+}
+
+// TestVerifyDecryptionRequest_RosterChange reads on a chain whose roster
+// changes with the read block. The forward-link to the read block is signed
+// by the roster of the write block, so that is the one the keys must match.
+func TestVerifyDecryptionRequest_RosterChange(t *testing.T) {
+	env, err := otstest.New(4)
+	require.Nil(t, err)
+	defer env.Close()
+	w, err := env.Write([]byte("secret"))
+	require.Nil(t, err)
+	_, write, err := network.Unmarshal(w.SB.Data)
+	require.Nil(t, err)
+
+	cl := skipchain.NewClient()
+	defer cl.Close()
+	writeSB, cerr := cl.CreateGenesis(env.Roster, 2, 2, skipchain.VerificationNone, write, nil)
+	require.Nil(t, cerr)
+	newRoster := onet.NewRoster(env.Roster.List[:len(env.Roster.List)-1])
+	read := &ocs.DataOCS{Read: &ocs.DataOCSRead{Public: env.Reader.Public, DataID: writeSB.Hash}}
+	reply, cerr := cl.StoreSkipBlock(writeSB, newRoster, read)
+	require.Nil(t, cerr)
+	writeSB, cerr = cl.GetSingleBlock(env.Roster, writeSB.Hash)
+	require.Nil(t, cerr)
+	link := writeSB.GetForward(0)
+	require.NotNil(t, link)
+
+	d := &util.OTSDecryptReqData{
+		WriteTxnSBF:    writeSB.SkipBlockFix,
+		ReadTxnSBF:     reply.Latest.SkipBlockFix,
+		InclusionProof: link,
+		ACPublicKeys:   env.Roster.Publics(),
+		SuiteID:        env.SuiteID,
+	}
+	_, _, err = verify(t, "roster of the write block", d, sign(t, d, env.Reader))
+	assert.Nil(t, err)
+
+	d.ACPublicKeys = newRoster.Publics()
+	_, _, err = verify(t, "roster of the read block", d, sign(t, d, env.Reader))
+	assert.Equal(t, protocol.ErrACPublicKeys, err)
+}
+
+// TestVerifyDecryptionRequest_Fuzz changes random bytes of a valid request
+// and checks that every changed request is refused without a panic.
+func TestVerifyDecryptionRequest_Fuzz(t *testing.T) {
+	env, err := otstest.New(4)
+	require.Nil(t, err)
+	defer env.Close()
+	req := newRequest(t, env)
+
+	rounds := 500
+	if testing.Short() {
+		rounds = 50
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < rounds; i++ {
+		d := req.clone()
+		fields := []*[]byte{&d.WriteTxnSBF.Data, &d.ReadTxnSBF.Data,
+			(*[]byte)(&d.InclusionProof.Hash), &d.InclusionProof.Signature}
+		f := rnd.Intn(len(fields))
+		buf := *fields[f]
+		name := "round " + strconv.Itoa(i) + ", field " + strconv.Itoa(f)
+		if len(buf) == 0 {
+			continue
+		}
+		switch rnd.Intn(3) {
+		case 0:
+			buf[rnd.Intn(len(buf))] ^= byte(1 + rnd.Intn(255))
+			name += ": flipped a byte"
+		case 1:
+			buf = buf[:rnd.Intn(len(buf))]
+			name += ": truncated"
+		case 2:
+			rnd.Read(buf[rnd.Intn(len(buf)):])
+			name += ": random tail"
+		}
+		*fields[f] = buf
+		sig := req.sig
+		if rnd.Intn(2) == 0 {
+			sig = sign(t, d, env.Reader)
+		}
+		_, _, err := verify(t, name, d, sig)
+		assert.NotNil(t, err, name)
+	}
+}
+
+// verify calls VerifyDecryptionRequest and fails the test if it panics.
+func verify(t *testing.T, name string, d *util.OTSDecryptReqData, sig *crypto.SchnorrSig) (wtd *util.WriteTxnData, suite abstract.Suite, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatal(name, "panicked:", r)
+		}
+	}()
+	return protocol.VerifyDecryptionRequest(d, sig)
+}
@@ -19,9 +19,32 @@ type StructAnnounceDecrypt struct {
 
 type DecryptReply struct {
 	DecShare *util.DecryptedShare
+	// CPU is the CPU time in seconds the trustee spent on the request.
+	CPU float64
 }
 
 type StructDecryptReply struct {
 	*onet.TreeNode
 	DecryptReply
 }
+
+type AnnounceValidate struct {
+	ReqData *util.WriteValidateReqData
+}
+
+type StructAnnounceValidate struct {
+	*onet.TreeNode
+	AnnounceValidate
+}
+
+// ValidateReply carries either the trustee's signature on the attestation
+// or the reason why it refused to sign.
+type ValidateReply struct {
+	Signature *util.TrusteeSignature
+	Error     string
+}
+
+type StructValidateReply struct {
+	*onet.TreeNode
+	ValidateReply
+}
@@ -0,0 +1,239 @@
+package protocol
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/dedis/cothority_template/netem"
+	"github.com/dedis/cothority_template/ots/util"
+
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/crypto.v0/share"
+	"gopkg.in/dedis/crypto.v0/share/pvss"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/crypto"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+var NameValidate = "otsvalidate"
+
+func init() {
+	network.RegisterMessage(AnnounceValidate{})
+	network.RegisterMessage(ValidateReply{})
+	network.RegisterMessage(&util.WriteValidateReqData{})
+	network.RegisterMessage(&util.WriteAttestation{})
+	onet.GlobalProtocolRegister(NameValidate, NewValidateProtocol)
+}
+
+// OTSValidate asks every trustee to check the encrypted shares of a
+// proposed write transaction. The root collects the signatures of the
+// trustees that accept it into a WriteAttestation, until Threshold of them
+// signed, all trustees replied or Timeout passed.
+type OTSValidate struct {
+	*onet.TreeNodeInstance
+	ChannelAnnounce chan StructAnnounceValidate
+	ChannelReply    chan StructValidateReply
+	Attestation     chan *util.WriteAttestation
+	ReqData         *util.WriteValidateReqData
+	// Timeout is how long the root waits for the signatures of the other
+	// trustees.
+	Timeout time.Duration
+	started chan bool
+}
+
+func NewValidateProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+	otsValidate := &OTSValidate{
+		TreeNodeInstance: n,
+		Attestation:      make(chan *util.WriteAttestation, 1),
+		started:          make(chan bool, 1),
+	}
+	err := otsValidate.RegisterChannel(&otsValidate.ChannelAnnounce)
+	if err != nil {
+		return nil, errors.New("couldn't register announcement-channel: " + err.Error())
+	}
+	err = otsValidate.RegisterChannel(&otsValidate.ChannelReply)
+	if err != nil {
+		return nil, errors.New("couldn't register reply-channel: " + err.Error())
+	}
+	return otsValidate, nil
+}
+
+// Start sends the write transaction to the other trustees. A trustee that
+// can't be reached is left out, like one that doesn't reply in time.
+func (p *OTSValidate) Start() error {
+	log.Lvl3("Starting OTSValidate")
+	p.started <- true
+	for _, c := range p.Children() {
+		err := netem.SendTo(p.TreeNodeInstance, c, &AnnounceValidate{ReqData: p.ReqData})
+		if err != nil {
+			log.Error(p.Info(), "failed to send to", c.Name(), err)
+		}
+	}
+	return nil
+}
+
+func (p *OTSValidate) Dispatch() error {
+	defer p.Done()
+	if !p.IsRoot() {
+		announcement := <-p.ChannelAnnounce
+		if faultOf(p.ServerIdentity().ID) == FaultCrash {
+			log.Lvl2(p.Name(), "is faulty and doesn't reply")
+			return nil
+		}
+		reply := &ValidateReply{}
+		ts, err := attestWrite(p.TreeNodeInstance, announcement.ReqData)
+		if err != nil {
+			log.Error(p.Info(), "Refusing to attest write transaction:", err)
+			reply.Error = err.Error()
+		} else {
+			reply.Signature = ts
+		}
+		err = netem.SendTo(p.TreeNodeInstance, p.Parent(), reply)
+		if err != nil {
+			log.Error(p.Info(), "Failed to send reply to", p.Parent().Name(), err)
+			return err
+		}
+		return nil
+	}
+
+	<-p.started
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	deadline := time.After(timeout)
+
+	att := &util.WriteAttestation{Threshold: p.ReqData.Threshold}
+	if faultOf(p.ServerIdentity().ID) == FaultCrash {
+		log.Lvl2(p.Name(), "is faulty and leaves out its own attestation")
+	} else {
+		ts, err := attestWrite(p.TreeNodeInstance, p.ReqData)
+		if err != nil {
+			log.Error(p.Info(), "Refusing to attest write transaction:", err)
+		} else {
+			att.Signatures = append(att.Signatures, ts)
+		}
+	}
+
+	children := len(p.Children())
+collect:
+	for replies := 0; replies < children && len(att.Signatures) < att.Threshold; replies++ {
+		select {
+		case r := <-p.ChannelReply:
+			if r.Signature == nil {
+				log.Lvl2(r.ServerIdentity.Address, "refused to attest:", r.Error)
+				continue
+			}
+			att.Signatures = append(att.Signatures, r.Signature)
+		case <-deadline:
+			log.Lvl2(p.ServerIdentity().Address, "timed out with", replies, "of", children, "replies")
+			break collect
+		}
+	}
+	log.Lvl3(p.ServerIdentity().Address, "collected", len(att.Signatures), "attestations")
+	p.Attestation <- att
+	return nil
+}
+
+// attestWrite verifies the shares of the write transaction and, if they
+// are recoverable, signs the attestation message with the trustee's key.
+func attestWrite(n *onet.TreeNodeInstance, data *util.WriteValidateReqData) (*util.TrusteeSignature, error) {
+	if data == nil {
+		return nil, errors.New("Missing write transaction data")
+	}
+	idx := -1
+	for i, pk := range data.SCPublicKeys {
+		if pk != nil && pk.Equal(n.Public()) {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return nil, errors.New("Not a trustee of this write transaction")
+	}
+
+	suite, err := util.GetSuite(data.SuiteID)
+	if err != nil {
+		return nil, err
+	}
+	err = verifyWriteShares(suite, data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Make sure we will be able to do our part at decryption time.
+	h, err := util.CreatePointH(suite, data.ReaderPk)
+	if err != nil {
+		return nil, err
+	}
+	_, err = pvss.DecShare(suite, h, n.Public(), data.EncProofs[idx], n.Private(), data.EncShares[idx])
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := util.AttestationMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := crypto.SignSchnorr(suite, n.Private(), msg)
+	if err != nil {
+		return nil, err
+	}
+	return &util.TrusteeSignature{Index: idx, Signature: &sig}, nil
+}
+
+// verifyWriteShares checks the proofs of all encrypted shares and that the
+// shares lie on a single polynomial of degree Threshold-1.
+func verifyWriteShares(suite abstract.Suite, data *util.WriteValidateReqData) error {
+	n := len(data.SCPublicKeys)
+	if n == 0 || len(data.EncShares) != n || len(data.EncProofs) != n {
+		return errors.New("Inconsistent number of trustees, shares and proofs")
+	}
+	t := data.Threshold
+	if t < 1 || t > n {
+		return errors.New("Invalid threshold " + strconv.Itoa(t))
+	}
+	if data.ReaderPk == nil {
+		return errors.New("Missing reader public key")
+	}
+
+	h, err := util.CreatePointH(suite, data.ReaderPk)
+	if err != nil {
+		return err
+	}
+	commits := make([]*share.PubShare, n)
+	for i := 0; i < n; i++ {
+		sh := data.EncShares[i]
+		if sh == nil || data.SCPublicKeys[i] == nil || data.EncProofs[i] == nil {
+			return errors.New("Missing data for share " + strconv.Itoa(i))
+		}
+		if sh.S.I != i {
+			return errors.New("Share " + strconv.Itoa(i) + " has index " + strconv.Itoa(sh.S.I))
+		}
+		err = pvss.VerifyEncShare(suite, h, data.SCPublicKeys[i], data.EncProofs[i], sh)
+		if err != nil {
+			return errors.New("Invalid proof for share " + strconv.Itoa(i) + ": " + err.Error())
+		}
+		commits[i] = &share.PubShare{I: i, V: data.EncProofs[i]}
+	}
+
+	// Two consecutive windows of t commitments share t-1 points. If both
+	// interpolate to the same value at zero, they agree on t points and
+	// define the same polynomial. Chaining this over all windows shows that
+	// every set of t trustees recovers the same secret.
+	var secretCommit abstract.Point
+	for j := 0; j+t <= n; j++ {
+		c, err := share.RecoverCommit(suite, commits[j:j+t], t, n)
+		if err != nil {
+			return err
+		}
+		if secretCommit == nil {
+			secretCommit = c
+		} else if !secretCommit.Equal(c) {
+			return errors.New("Shares do not lie on a polynomial of degree " + strconv.Itoa(t-1))
+		}
+	}
+	return nil
+}
@@ -4,9 +4,11 @@ import (
 	"math/rand"
 
 	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/cothority_template/ots/keystore"
 	"github.com/dedis/cothority_template/ots/util"
 	"gopkg.in/dedis/crypto.v0/abstract"
 	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/crypto"
 	"gopkg.in/dedis/onet.v1/network"
 )
 
@@ -18,35 +20,58 @@ func NewClient() *Client {
 	return &Client{Client: onet.NewClient(ServiceName)}
 }
 
-func (c *Client) OTSDecrypt(r *onet.Roster, writeTxnSBF *skipchain.SkipBlockFix, readTxnSBF *skipchain.SkipBlockFix, inclusionProof *skipchain.BlockLink, acPubKeys []abstract.Point, privKey abstract.Scalar) ([]*util.DecryptedShare, onet.ClientError) {
+func (c *Client) OTSDecrypt(r *onet.Roster, writeTxnSBF *skipchain.SkipBlockFix, readTxnSBF *skipchain.SkipBlockFix, inclusionProof *skipchain.BlockLink, acPubKeys []abstract.Point, key *keystore.Key) ([]*util.DecryptedShare, onet.ClientError) {
+	reply, cerr := c.OTSDecryptWithLoad(r, writeTxnSBF, readTxnSBF, inclusionProof, acPubKeys, key)
+	if cerr != nil {
+		return nil, cerr
+	}
+	return reply.DecShares, nil
+}
+
+// OTSDecryptWithLoad is like OTSDecrypt, but returns the whole response,
+// including the CPU time the trustees spent on the request.
+func (c *Client) OTSDecryptWithLoad(r *onet.Roster, writeTxnSBF *skipchain.SkipBlockFix, readTxnSBF *skipchain.SkipBlockFix, inclusionProof *skipchain.BlockLink, acPubKeys []abstract.Point, key *keystore.Key) (*OTSDecryptResp, onet.ClientError) {
+	data, sig, err := NewDecryptRequest(writeTxnSBF, readTxnSBF, inclusionProof, acPubKeys, key)
+	if err != nil {
+		return nil, onet.NewClientErrorCode(ErrorParse, err.Error())
+	}
+	return c.OTSDecryptSigned(r, data, sig)
+}
 
-	// network.RegisterMessage(&util.OTSDecryptReqData{})
+// NewDecryptRequest returns the decryption request for the read transaction
+// and the signature of the reader key on it.
+func NewDecryptRequest(writeTxnSBF *skipchain.SkipBlockFix, readTxnSBF *skipchain.SkipBlockFix, inclusionProof *skipchain.BlockLink, acPubKeys []abstract.Point, key *keystore.Key) (*util.OTSDecryptReqData, *crypto.SchnorrSig, error) {
 	data := &util.OTSDecryptReqData{
 		WriteTxnSBF:    writeTxnSBF,
 		ReadTxnSBF:     readTxnSBF,
 		InclusionProof: inclusionProof,
 		ACPublicKeys:   acPubKeys,
+		SuiteID:        key.SuiteID,
 	}
 	msg, err := network.Marshal(data)
 	if err != nil {
-		return nil, onet.NewClientErrorCode(ErrorParse, err.Error())
+		return nil, nil, err
 	}
-
-	sig, err := util.SignMessage(msg, privKey)
+	sig, err := key.Sign(msg)
 	if err != nil {
-		return nil, onet.NewClientErrorCode(ErrorParse, err.Error())
+		return nil, nil, err
 	}
+	return data, &sig, nil
+}
 
+// OTSDecryptSigned sends the request returned by NewDecryptRequest to a
+// random trustee in r.
+func (c *Client) OTSDecryptSigned(r *onet.Roster, data *util.OTSDecryptReqData, sig *crypto.SchnorrSig) (*OTSDecryptResp, onet.ClientError) {
 	decryptReq := &OTSDecryptReq{
 		Roster:    r,
 		Data:      data,
-		Signature: &sig,
+		Signature: sig,
 	}
 	idx := rand.Int() % len(r.List)
 	dst := r.List[idx]
 	decryptReq.RootIndex = idx
 	reply := &OTSDecryptResp{}
-	err = c.SendProtobuf(dst, decryptReq, reply)
+	err := c.SendProtobuf(dst, decryptReq, reply)
 	if err != nil {
 		return nil, onet.NewClientErrorCode(ErrorParse, err.Error())
 	}
@@ -64,5 +89,22 @@ func (c *Client) OTSDecrypt(r *onet.Roster, writeTxnSBF *skipchain.SkipBlockFix,
 	// 		}
 	// 	}
 	// }
-	return reply.DecShares, nil
+	return reply, nil
+}
+
+// OTSValidateWrite asks the trustees in r to attest that the shares in data
+// can be recovered. The returned attestation holds the signatures of the
+// trustees that accepted the shares.
+func (c *Client) OTSValidateWrite(r *onet.Roster, data *util.WriteValidateReqData) (*util.WriteAttestation, onet.ClientError) {
+	req := &OTSValidateWriteReq{
+		Roster: r,
+		Data:   data,
+	}
+	dst := r.RandomServerIdentity()
+	reply := &OTSValidateWriteResp{}
+	err := c.SendProtobuf(dst, req, reply)
+	if err != nil {
+		return nil, onet.NewClientErrorCode(ErrorParse, err.Error())
+	}
+	return reply.Attestation, nil
 }
@@ -24,11 +24,28 @@ type OTSDecryptReq struct {
 
 type OTSDecryptResp struct {
 	DecShares []*util.DecryptedShare
+	// CPU holds the CPU seconds every trustee of the roster spent on the
+	// request, in the order of the roster.
+	CPU []float64
+}
+
+// OTSValidateWriteReq asks the trustees in Roster to check the shares of a
+// write transaction before it is stored on the access-control skipchain.
+type OTSValidateWriteReq struct {
+	Roster *onet.Roster
+	Data   *util.WriteValidateReqData
+}
+
+type OTSValidateWriteResp struct {
+	Attestation *util.WriteAttestation
 }
 
 const (
 	// ErrorParse indicates an error while parsing the protobuf-file.
 	ErrorParse = iota + 4000
+	// ErrorRefused indicates that no trustee accepted the decryption
+	// request.
+	ErrorRefused
 )
 
 func init() {
@@ -36,12 +53,17 @@ func init() {
 	onet.RegisterNewService(ServiceName, newOTSSCService)
 	network.RegisterMessage(&OTSDecryptReq{})
 	network.RegisterMessage(&OTSDecryptResp{})
+	network.RegisterMessage(&OTSValidateWriteReq{})
+	network.RegisterMessage(&OTSValidateWriteResp{})
 	// network.RegisterMessage(&util.OTSDecryptReqData{})
 	// network.RegisterMessage(&util.DecryptedShare{})
 }
 
 func (s *OTSSCService) OTSDecryptReq(req *OTSDecryptReq) (*OTSDecryptResp, onet.ClientError) {
 	log.Lvl3("OTSDecryptReq received in service")
+	if req.Roster == nil || req.Data == nil || req.Signature == nil {
+		return nil, onet.NewClientErrorCode(ErrorParse, "missing roster, request or signature")
+	}
 	// Tree with depth = 1
 	childCount := len(req.Roster.List) - 1
 	log.Lvl3("Number of childs:", childCount)
@@ -65,22 +87,65 @@ func (s *OTSSCService) OTSDecryptReq(req *OTSDecryptReq) (*OTSDecryptResp, onet.
 	}
 
 	resp := &OTSDecryptResp{
-		DecShares: <-pi.(*protocol.OTSDecrypt).DecShares,
+		DecShares: <-otsDec.DecShares,
+		CPU:       make([]float64, len(req.Roster.List)),
+	}
+	if len(resp.DecShares) == 0 {
+		return nil, onet.NewClientErrorCode(ErrorRefused, "the trustees refused the decryption request")
+	}
+	for id, cpu := range otsDec.TrusteeCPU {
+		if i, _ := req.Roster.Search(id); i >= 0 {
+			resp.CPU[i] = cpu
+		}
+	}
+	return resp, nil
+}
+
+func (s *OTSSCService) OTSValidateWriteReq(req *OTSValidateWriteReq) (*OTSValidateWriteResp, onet.ClientError) {
+	log.Lvl3("OTSValidateWriteReq received in service")
+	if req.Roster == nil || req.Data == nil {
+		return nil, onet.NewClientErrorCode(ErrorParse, "missing roster or write transaction data")
+	}
+	childCount := len(req.Roster.List) - 1
+	tree := req.Roster.GenerateNaryTreeWithRoot(childCount, s.ServerIdentity())
+	if tree == nil {
+		return nil, onet.NewClientErrorCode(ErrorParse, "couldn't create tree")
+	}
+
+	pi, err := s.CreateProtocol(protocol.NameValidate, tree)
+	if err != nil {
+		return nil, onet.NewClientError(err)
+	}
+
+	otsValidate := pi.(*protocol.OTSValidate)
+	otsValidate.ReqData = req.Data
+	err = pi.Start()
+	if err != nil {
+		return nil, onet.NewClientError(err)
+	}
+
+	resp := &OTSValidateWriteResp{
+		Attestation: <-otsValidate.Attestation,
 	}
 	return resp, nil
 }
 
 func (s *OTSSCService) NewProtocol(tn *onet.TreeNodeInstance, conf *onet.GenericConfig) (onet.ProtocolInstance, error) {
-	log.Lvl3("OTSDecrypt Service received New Protocol event")
-	pi, err := protocol.NewProtocol(tn)
-	return pi, err
+	log.Lvl3("OTSSC Service received New Protocol event")
+	switch tn.ProtocolName() {
+	case protocol.Name:
+		return protocol.NewProtocol(tn)
+	case protocol.NameValidate:
+		return protocol.NewValidateProtocol(tn)
+	}
+	return nil, nil
 }
 
 func newOTSSCService(c *onet.Context) onet.Service {
 	s := &OTSSCService{
 		ServiceProcessor: onet.NewServiceProcessor(c),
 	}
-	err := s.RegisterHandler(s.OTSDecryptReq)
+	err := s.RegisterHandlers(s.OTSDecryptReq, s.OTSValidateWriteReq)
 	log.Lvl3("OTSSC Service registered")
 	if err != nil {
 		log.ErrFatal(err, "Couldn't register message:")
@@ -0,0 +1,136 @@
+package service_test
+
+import (
+	"testing"
+
+	"github.com/dedis/cothority_template/ots"
+	"github.com/dedis/cothority_template/ots/keystore"
+	"github.com/dedis/cothority_template/ots/otstest"
+	"github.com/dedis/cothority_template/ots/util"
+	"github.com/dedis/cothority_template/otssc/protocol"
+	"github.com/dedis/cothority_template/otssc/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/onet.v1/log"
+)
+
+func TestMain(m *testing.M) {
+	log.MainTest(m)
+}
+
+func TestClient_OTSDecryptWithLoad(t *testing.T) {
+	env, err := otstest.New(4)
+	require.Nil(t, err)
+	defer env.Close()
+
+	w, err := env.Write([]byte("secret"))
+	require.Nil(t, err)
+	r, err := env.Read(w)
+	require.Nil(t, err)
+	link := r.WriteSB.GetForward(r.SB.Index - r.WriteSB.Index - 1)
+	require.NotNil(t, link)
+
+	reply, cerr := env.OTSSC.OTSDecryptWithLoad(env.Roster, r.WriteSB.SkipBlockFix, r.SB.SkipBlockFix,
+		link, r.SB.Roster.Publics(), env.Reader)
+	require.Nil(t, cerr)
+	assert.Equal(t, 4, len(reply.DecShares))
+	require.Equal(t, 4, len(reply.CPU))
+	for _, cpu := range reply.CPU {
+		assert.True(t, cpu >= 0)
+	}
+
+	decShares, err := ots.ElGamalDecrypt(w.DP.Suite, reply.DecShares, env.Reader.Private())
+	require.Nil(t, err)
+	assert.Equal(t, 4, len(ots.VerifyDecShares(w.DP.Suite, r.WTD, decShares)))
+	_, err = ots.RecoverSecret(w.DP.Suite, r.WTD, decShares, w.DP.Threshold)
+	assert.Nil(t, err)
+}
+
+func TestClient_OTSValidateWrite(t *testing.T) {
+	env, err := otstest.New(4)
+	require.Nil(t, err)
+	defer env.Close()
+
+	dp, err := env.NewDataPVSS()
+	require.Nil(t, err)
+	require.Nil(t, ots.SetupPVSS(dp, env.Reader.Public))
+	att, err := ots.ValidateWriteTxn(env.Roster, dp, env.Reader.Public)
+	require.Nil(t, err)
+	assert.Equal(t, dp.Threshold, att.Threshold)
+
+	// The attestation doesn't hold for other shares.
+	other, err := env.NewDataPVSS()
+	require.Nil(t, err)
+	require.Nil(t, ots.SetupPVSS(other, env.Reader.Public))
+	assert.NotNil(t, util.VerifyWriteAttestation(att, validateData(other, env.Reader)))
+
+	// Nor for another suite, even one with the same group.
+	util.RegisterSuite("Ed25519-copy", dp.Suite)
+	data := validateData(dp, env.Reader)
+	assert.Nil(t, util.VerifyWriteAttestation(att, data))
+	data.SuiteID = "Ed25519-copy"
+	assert.NotNil(t, util.VerifyWriteAttestation(att, data))
+}
+
+// validateData returns the data of dp the trustees attest for reader.
+func validateData(dp *util.DataPVSS, reader *keystore.Key) *util.WriteValidateReqData {
+	return &util.WriteValidateReqData{
+		G:            dp.G,
+		SCPublicKeys: dp.SCPublicKeys,
+		EncShares:    dp.EncShares,
+		EncProofs:    dp.EncProofs,
+		ReaderPk:     reader.Public,
+		Threshold:    dp.Threshold,
+		SuiteID:      dp.SuiteID,
+	}
+}
+
+func TestClient_OTSValidateWriteCrash(t *testing.T) {
+	env, err := otstest.New(4)
+	require.Nil(t, err)
+	defer env.Close()
+	defer protocol.ClearFaults()
+
+	// With 4 trustees the threshold is 3, so the attestation doesn't need
+	// to wait for a trustee that is down, be it a leaf or the root.
+	protocol.SetFault(env.Roster.List[3].ID, protocol.FaultCrash)
+	for _, root := range []int{0, 3} {
+		dp, err := env.NewDataPVSS()
+		require.Nil(t, err)
+		require.Nil(t, ots.SetupPVSS(dp, env.Reader.Public))
+		reply := &service.OTSValidateWriteResp{}
+		req := &service.OTSValidateWriteReq{Roster: env.Roster, Data: validateData(dp, env.Reader)}
+		require.Nil(t, env.OTSSC.SendProtobuf(env.Roster.List[root], req, reply))
+		assert.Equal(t, dp.Threshold, len(reply.Attestation.Signatures))
+		for _, ts := range reply.Attestation.Signatures {
+			assert.NotEqual(t, 3, ts.Index)
+		}
+	}
+}
+
+func TestClient_OTSDecryptRefused(t *testing.T) {
+	env, err := otstest.New(4)
+	require.Nil(t, err)
+	defer env.Close()
+
+	w, err := env.Write([]byte("secret"))
+	require.Nil(t, err)
+	r, err := env.Read(w)
+	require.Nil(t, err)
+	link := r.WriteSB.GetForward(r.SB.Index - r.WriteSB.Index - 1)
+	require.NotNil(t, link)
+
+	// Only the reader of the write transaction gets the shares, and the
+	// others get an error instead of waiting forever.
+	mallory, err := keystore.NewKey(env.SuiteID)
+	require.Nil(t, err)
+	_, cerr := env.OTSSC.OTSDecryptWithLoad(env.Roster, r.WriteSB.SkipBlockFix, r.SB.SkipBlockFix,
+		link, r.SB.Roster.Publics(), mallory)
+	require.NotNil(t, cerr)
+	assert.Equal(t, service.ErrorRefused, cerr.ErrorCode())
+
+	// So do requests for other access-control keys.
+	_, cerr = env.OTSSC.OTSDecryptWithLoad(env.Roster, r.WriteSB.SkipBlockFix, r.SB.SkipBlockFix,
+		link, env.Roster.Publics()[1:], env.Reader)
+	assert.NotNil(t, cerr)
+}
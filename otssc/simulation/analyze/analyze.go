@@ -0,0 +1,258 @@
+/*
+Analyze reads the results of the OTS simulations, as in data_backup, and
+shows, compares or plots their metrics. Every run is identified by all its
+parameters, such as hosts, bf or scsize, and a file can't hold two runs with
+the same parameters:
+
+	analyze show -m 'DecReq_wall_*' data_backup/backup.csv
+	analyze compare -t 0.2 old.csv new.csv
+	analyze plot -o decreq.svg data_backup/*.data
+
+Both the CSV files of the simulations and the .data files with one
+"name value" pair per line can be read. compare exits with 3 if a metric got
+worse by more than its tolerance, so that it can be used in CI.
+*/
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/urfave/cli.v1"
+)
+
+const (
+	// exitError is used for files that can't be read or written.
+	exitError = 1
+	// exitUsage is used for missing or malformed arguments.
+	exitUsage = 2
+	// exitRegression is used when compare finds a regression.
+	exitRegression = 3
+)
+
+// defaultMetrics are the metrics used without --metric: the average
+// wall-clock time of every phase.
+var defaultMetrics = []string{"*_wall_avg"}
+
+func main() {
+	cliApp := cli.NewApp()
+	cliApp.Name = "analyze"
+	cliApp.Usage = "Show, compare and plot the results of the OTS simulations."
+	cliApp.Version = "0.1"
+	metricFlag := cli.StringSliceFlag{
+		Name:  "metric, m",
+		Usage: "metric to use, with * and ? as wildcards (default *_wall_avg)",
+	}
+	cliApp.Commands = []cli.Command{
+		{
+			Name:      "show",
+			Usage:     "print a table of the metrics by run",
+			ArgsUsage: "file...",
+			Action:    cmdShow,
+			Flags:     []cli.Flag{metricFlag},
+		},
+		{
+			Name:      "compare",
+			Usage:     "compare a run to a base run and fail on regressions",
+			ArgsUsage: "base-file current-file",
+			Action:    cmdCompare,
+			Flags: []cli.Flag{
+				metricFlag,
+				cli.Float64Flag{
+					Name:  "tolerance, t",
+					Value: 0.1,
+					Usage: "relative increase that is still accepted",
+				},
+				cli.StringSliceFlag{
+					Name:  "metric-tolerance",
+					Usage: "tolerance of one metric, as metric=value",
+				},
+				cli.StringSliceFlag{
+					Name:  "higher-better",
+					Usage: "metric where a higher value is better, such as a throughput",
+				},
+			},
+		},
+		{
+			Name:      "plot",
+			Usage:     "write an SVG plot of the metrics against the number of trustees",
+			ArgsUsage: "file...",
+			Action:    cmdPlot,
+			Flags: []cli.Flag{
+				metricFlag,
+				cli.StringFlag{
+					Name:  "output, o",
+					Usage: "SVG file to write, standard output if empty",
+				},
+				cli.StringFlag{
+					Name:  "title",
+					Value: "OTS phase latency",
+				},
+				cli.StringFlag{
+					Name:  "unit",
+					Value: "seconds",
+				},
+			},
+		},
+	}
+	cliApp.Flags = []cli.Flag{
+		cli.IntFlag{
+			Name:  "debug, d",
+			Value: 0,
+			Usage: "debug-level: 1 for terse, 5 for maximal",
+		},
+	}
+	cliApp.Before = func(c *cli.Context) error {
+		log.SetDebugVisible(c.Int("debug"))
+		return nil
+	}
+	cliApp.Run(os.Args)
+}
+
+// loadArgs reads the files given as arguments and the metrics of --metric.
+func loadArgs(c *cli.Context, files []string) (results, []string, error) {
+	if len(files) == 0 {
+		return nil, nil, cli.NewExitError("Please give the files to read", exitUsage)
+	}
+	rs, err := load(files)
+	if err != nil {
+		return nil, nil, cli.NewExitError(err, exitError)
+	}
+	patterns := c.StringSlice("metric")
+	if len(patterns) == 0 {
+		patterns = defaultMetrics
+	}
+	metrics, err := rs.metrics(patterns)
+	if err != nil {
+		return nil, nil, cli.NewExitError(err, exitUsage)
+	}
+	if len(metrics) == 0 {
+		return nil, nil, cli.NewExitError("No metric matches", exitUsage)
+	}
+	return rs, metrics, nil
+}
+
+// Prints a table with a line per run and a column per parameter and metric.
+func cmdShow(c *cli.Context) error {
+	rs, metrics, err := loadArgs(c, c.Args())
+	if err != nil {
+		return err
+	}
+	showTable(os.Stdout, rs, metrics)
+	return nil
+}
+
+func showTable(w io.Writer, rs results, metrics []string) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	params := rs.params()
+	for _, p := range params {
+		fmt.Fprint(tw, p, "\t")
+	}
+	for _, m := range metrics {
+		fmt.Fprint(tw, m, "\t")
+	}
+	fmt.Fprintln(tw)
+	for _, r := range rs {
+		for _, p := range params {
+			fmt.Fprint(tw, formatParam(r, p), "\t")
+		}
+		for _, m := range metrics {
+			fmt.Fprint(tw, formatValue(r, m), "\t")
+		}
+		fmt.Fprintln(tw)
+	}
+	tw.Flush()
+}
+
+// Compares the current run to the base run.
+func cmdCompare(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return cli.NewExitError("Please give the base and the current file", exitUsage)
+	}
+	base, metrics, err := loadArgs(c, c.Args()[:1])
+	if err != nil {
+		return err
+	}
+	current, err := load(c.Args()[1:])
+	if err != nil {
+		return cli.NewExitError(err, exitError)
+	}
+	tol, err := parseTolerances(c.Float64("tolerance"), c.StringSlice("metric-tolerance"),
+		c.StringSlice("higher-better"))
+	if err != nil {
+		return cli.NewExitError(err, exitUsage)
+	}
+	cs := compare(base, current, metrics, tol)
+	if len(cs) == 0 {
+		return cli.NewExitError("No common runs and metrics to compare", exitUsage)
+	}
+	regressions := showComparison(os.Stdout, cs)
+	if regressions > 0 {
+		return cli.NewExitError(strconv.Itoa(regressions)+" regressions", exitRegression)
+	}
+	return nil
+}
+
+// showComparison prints the comparisons and returns the number of
+// regressions.
+func showComparison(w io.Writer, cs []comparison) int {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "run\tmetric\tbase\tcurrent\tchange\t")
+	regressions := 0
+	for _, c := range cs {
+		change := "-"
+		if !math.IsNaN(c.change) {
+			change = fmt.Sprintf("%+.1f%%", c.change*100)
+		}
+		status := ""
+		if c.regression {
+			status = "REGRESSION"
+			regressions++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%g\t%g\t%s\t%s\n", c.run, c.metric, c.base, c.current, change, status)
+	}
+	tw.Flush()
+	return regressions
+}
+
+// Writes the SVG plot.
+func cmdPlot(c *cli.Context) error {
+	rs, metrics, err := loadArgs(c, c.Args())
+	if err != nil {
+		return err
+	}
+	w := io.Writer(os.Stdout)
+	if c.String("output") != "" {
+		f, err := os.Create(c.String("output"))
+		if err != nil {
+			return cli.NewExitError(err, exitError)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := plot(w, rs, metrics, c.String("title"), c.String("unit")); err != nil {
+		return cli.NewExitError(err, exitError)
+	}
+	return nil
+}
+
+func formatParam(r run, param string) string {
+	v, ok := r[param]
+	if !ok {
+		return "-"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func formatValue(r run, metric string) string {
+	v, ok := r[metric]
+	if !ok || math.IsNaN(v) {
+		return "-"
+	}
+	return strconv.FormatFloat(v, 'f', 6, 64)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"math"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/onet.v1/log"
+)
+
+func TestMain(m *testing.M) {
+	log.MainTest(m)
+}
+
+func TestLoad(t *testing.T) {
+	rs, err := load([]string{"../data_backup/backup.csv", "../data_backup/192.data"})
+	require.Nil(t, err)
+	var hosts []int
+	for _, r := range rs {
+		hosts = append(hosts, r.hosts())
+	}
+	assert.Equal(t, []int{16, 32, 64, 128, 192}, hosts)
+	assert.True(t, rs.byKey("hosts=192")["DecReq_wall_avg"] > 0)
+	assert.Equal(t, "bf=15 depth=1 hosts=16 rounds=10 runwait=1200 servers=4", rs[0].key())
+	r, err := readData(strings.NewReader("DecReq_wall_dev nan\n"))
+	require.Nil(t, err)
+	assert.True(t, math.IsNaN(r["DecReq_wall_dev"]))
+
+	metrics, err := rs.metrics([]string{"DecReq_wall_*"})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"DecReq_wall_avg", "DecReq_wall_dev", "DecReq_wall_max",
+		"DecReq_wall_min", "DecReq_wall_sum"}, metrics)
+
+	_, err = readData(strings.NewReader("DecReq_wall_avg 1 2\n"))
+	assert.NotNil(t, err)
+	_, err = readCSV(strings.NewReader("bf,DecReq_wall_avg\n1,2\n"))
+	assert.NotNil(t, err)
+
+	// The same run twice can't be told apart.
+	_, err = load([]string{"../data_backup/backup.csv", "../data_backup/backup.csv"})
+	assert.NotNil(t, err)
+}
+
+func TestLines(t *testing.T) {
+	// Runs with the same hosts but other trustees or faults are distinct.
+	rs, err := readCSV(strings.NewReader("hosts,scsize,faults,DecReq_wall_avg\n" +
+		"32,8,0,1\n32,16,0,2\n32,8,1,3\n32,16,1,4\n"))
+	require.Nil(t, err)
+	sort.Sort(rs)
+	name, n := rs[0].trustees()
+	assert.Equal(t, "scsize", name)
+	assert.Equal(t, 8, n)
+
+	ss := lines(rs, []string{"DecReq_wall_avg"})
+	require.Equal(t, 2, len(ss))
+	assert.Equal(t, "DecReq_wall_avg (faults=0 hosts=32)", ss[0].label)
+	require.Equal(t, 2, len(ss[0].runs))
+	assert.Equal(t, 1.0, ss[0].runs[0]["DecReq_wall_avg"])
+	assert.Equal(t, 2.0, ss[0].runs[1]["DecReq_wall_avg"])
+	require.Nil(t, plot(&bytes.Buffer{}, rs, []string{"DecReq_wall_avg"}, "", ""))
+}
+
+func TestCompare(t *testing.T) {
+	base, err := readCSV(strings.NewReader("hosts,DecReq_wall_avg,Throughput\n16,1.0,100\n32,2.0,50\n"))
+	require.Nil(t, err)
+	current, err := readCSV(strings.NewReader("hosts,DecReq_wall_avg,Throughput\n16,1.05,100\n32,2.5,40\n64,4,20\n"))
+	require.Nil(t, err)
+	tol, err := parseTolerances(0.1, nil, []string{"Throughput"})
+	require.Nil(t, err)
+
+	cs := compare(base, current, []string{"DecReq_wall_avg", "Throughput"}, tol)
+	require.Equal(t, 4, len(cs))
+	assert.False(t, cs[0].regression)
+	assert.False(t, cs[1].regression)
+	assert.True(t, cs[2].regression)
+	assert.True(t, cs[3].regression)
+	assert.Equal(t, 2, showComparison(&bytes.Buffer{}, cs))
+
+	tol, err = parseTolerances(0.1, []string{"DecReq_wall_avg=0.3"}, nil)
+	require.Nil(t, err)
+	cs = compare(base, current, []string{"DecReq_wall_avg"}, tol)
+	assert.False(t, cs[1].regression)
+
+	_, err = parseTolerances(0.1, []string{"DecReq_wall_avg"}, nil)
+	assert.NotNil(t, err)
+}
+
+func TestPlot(t *testing.T) {
+	rs, err := load([]string{"../data_backup/backup.csv"})
+	require.Nil(t, err)
+	buf := &bytes.Buffer{}
+	require.Nil(t, plot(buf, rs, []string{"DecReq_wall_avg", "RecoverSecret_wall_avg"}, "<title>", "seconds"))
+	d := xml.NewDecoder(buf)
+	for {
+		_, err := d.Token()
+		if err != nil {
+			assert.Equal(t, "EOF", err.Error())
+			break
+		}
+	}
+	assert.NotNil(t, plot(buf, nil, []string{"DecReq_wall_avg"}, "", ""))
+}
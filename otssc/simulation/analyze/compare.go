@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// tolerances tell by how much a metric may get worse before it counts as a
+// regression.
+type tolerances struct {
+	// def is the relative tolerance of the metrics not in metric, e.g.
+	// 0.1 for 10%.
+	def    float64
+	metric map[string]float64
+	// higher holds the metrics where a higher value is better, such as
+	// throughputs.
+	higher map[string]bool
+}
+
+// parseTolerances returns the tolerances with the default def and the
+// "metric=tolerance" pairs of perMetric.
+func parseTolerances(def float64, perMetric, higher []string) (*tolerances, error) {
+	if def < 0 {
+		return nil, errors.New("negative tolerance")
+	}
+	t := &tolerances{def: def, metric: map[string]float64{}, higher: map[string]bool{}}
+	for _, pm := range perMetric {
+		kv := strings.SplitN(pm, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("tolerance must be metric=value: " + pm)
+		}
+		v, err := strconv.ParseFloat(kv[1], 64)
+		if err != nil || v < 0 {
+			return nil, errors.New("invalid tolerance: " + pm)
+		}
+		t.metric[kv[0]] = v
+	}
+	for _, h := range higher {
+		t.higher[h] = true
+	}
+	return t, nil
+}
+
+func (t *tolerances) of(metric string) float64 {
+	if v, ok := t.metric[metric]; ok {
+		return v
+	}
+	return t.def
+}
+
+// comparison is the difference of one metric between two runs with the same
+// parameters.
+type comparison struct {
+	run           string
+	metric        string
+	base, current float64
+	// change is relative to base, NaN if it can't be computed.
+	change     float64
+	regression bool
+}
+
+// compare returns the comparisons of the metrics for all runs that are in
+// both base and current. Missing or NaN values are left out.
+func compare(base, current results, metrics []string, t *tolerances) []comparison {
+	var cs []comparison
+	for _, cur := range current {
+		b := base.byKey(cur.key())
+		if b == nil {
+			continue
+		}
+		for _, m := range metrics {
+			bv, okB := b[m]
+			cv, okC := cur[m]
+			if !okB || !okC || math.IsNaN(bv) || math.IsNaN(cv) {
+				continue
+			}
+			c := comparison{run: cur.key(), metric: m, base: bv, current: cv, change: math.NaN()}
+			if bv != 0 {
+				c.change = (cv - bv) / math.Abs(bv)
+				if t.higher[m] {
+					c.regression = c.change < -t.of(m)
+				} else {
+					c.regression = c.change > t.of(m)
+				}
+			}
+			cs = append(cs, c)
+		}
+	}
+	return cs
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// run holds the values of one line of a simulation result, indexed by the
+// column name, e.g. "hosts" or "DecReq_wall_avg". The columns without the
+// suffix of a statistic are the parameters of the run, such as "hosts", "bf"
+// or "scsize".
+type run map[string]float64
+
+// statSuffixes end the names of the columns that aren't parameters.
+var statSuffixes = []string{"_min", "_max", "_avg", "_sum", "_dev"}
+
+func isParam(name string) bool {
+	for _, s := range statSuffixes {
+		if strings.HasSuffix(name, s) {
+			return false
+		}
+	}
+	return true
+}
+
+// params returns the sorted names of the parameters of r.
+func (r run) params() []string {
+	var names []string
+	for name := range r {
+		if isParam(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// key identifies the run by all its parameters, except those in skip, as
+// in "bf=15 depth=1 hosts=16".
+func (r run) key(skip ...string) string {
+	var kv []string
+	for _, name := range r.params() {
+		skipped := false
+		for _, s := range skip {
+			skipped = skipped || s == name
+		}
+		if !skipped {
+			kv = append(kv, name+"="+strconv.FormatFloat(r[name], 'g', -1, 64))
+		}
+	}
+	return strings.Join(kv, " ")
+}
+
+// hosts returns the number of conodes of the run.
+func (r run) hosts() int {
+	return int(r["hosts"])
+}
+
+// trustees returns the parameter giving the number of trustees of the run
+// and its value: scsize if it is set, else hosts, as an OTS simulation
+// without scsize uses all hosts as trustees.
+func (r run) trustees() (string, int) {
+	if sc := int(r["scsize"]); sc > 0 {
+		return "scsize", sc
+	}
+	return "hosts", r.hosts()
+}
+
+// results are the runs of one or more files, sorted by the number of
+// trustees and then by key.
+type results []run
+
+func (rs results) Len() int      { return len(rs) }
+func (rs results) Swap(i, j int) { rs[i], rs[j] = rs[j], rs[i] }
+func (rs results) Less(i, j int) bool {
+	_, ti := rs[i].trustees()
+	_, tj := rs[j].trustees()
+	if ti != tj {
+		return ti < tj
+	}
+	return rs[i].key() < rs[j].key()
+}
+
+// byKey returns the run with the given key, or nil.
+func (rs results) byKey(key string) run {
+	for _, r := range rs {
+		if r.key() == key {
+			return r
+		}
+	}
+	return nil
+}
+
+// params returns the sorted names of the parameters of all runs.
+func (rs results) params() []string {
+	names := map[string]bool{}
+	for _, r := range rs {
+		for _, name := range r.params() {
+			names[name] = true
+		}
+	}
+	var list []string
+	for name := range names {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// metrics returns the sorted names of the columns of all runs that match
+// one of the patterns, as in filepath.Match. No pattern matches all
+// columns.
+func (rs results) metrics(patterns []string) ([]string, error) {
+	names := map[string]bool{}
+	for _, r := range rs {
+		for name := range r {
+			ok := len(patterns) == 0
+			for _, p := range patterns {
+				m, err := filepath.Match(p, name)
+				if err != nil {
+					return nil, err
+				}
+				ok = ok || m
+			}
+			if ok {
+				names[name] = true
+			}
+		}
+	}
+	var list []string
+	for name := range names {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list, nil
+}
+
+// load reads the files and returns their runs sorted. Two runs with the
+// same parameters are an error, as it isn't clear which one to use.
+func load(files []string) (results, error) {
+	var rs results
+	seen := map[string]string{}
+	for _, f := range files {
+		var runs results
+		var err error
+		if strings.HasSuffix(f, ".data") {
+			runs, err = loadData(f)
+		} else {
+			runs, err = loadCSV(f)
+		}
+		if err != nil {
+			return nil, errors.New(f + ": " + err.Error())
+		}
+		for _, r := range runs {
+			if other, ok := seen[r.key()]; ok {
+				return nil, errors.New(f + ": run " + r.key() + " is also in " + other)
+			}
+			seen[r.key()] = f
+			rs = append(rs, r)
+		}
+	}
+	sort.Sort(rs)
+	return rs, nil
+}
+
+// loadCSV reads a file written by the simulations: a header with the names
+// of the columns and one line per run.
+func loadCSV(file string) (results, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readCSV(f)
+}
+
+// Lines can be shorter than the header, as some runs leave out the last
+// columns, such as the bandwidth.
+func readCSV(r io.Reader) (results, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	lines, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, errors.New("empty file")
+	}
+	header := lines[0]
+	var rs results
+	for n, line := range lines[1:] {
+		if len(line) > len(header) {
+			return nil, errors.New("line " + strconv.Itoa(n+2) + ": more values than columns")
+		}
+		r := run{}
+		for i, v := range line {
+			f, err := parseValue(v)
+			if err != nil {
+				return nil, errors.New("line " + strconv.Itoa(n+2) + ": " + err.Error())
+			}
+			r[strings.TrimSpace(header[i])] = f
+		}
+		if _, ok := r["hosts"]; !ok {
+			return nil, errors.New("no hosts column")
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+// loadData reads a file with one "name value" pair per line. Unless the
+// file has a "hosts" line, the number of hosts is the name of the file, as
+// in "128.data".
+func loadData(file string) (results, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := readData(f)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := r["hosts"]; !ok {
+		hosts, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(file), ".data"))
+		if err != nil {
+			return nil, errors.New("no hosts in the file or its name")
+		}
+		r["hosts"] = float64(hosts)
+	}
+	return results{r}, nil
+}
+
+func readData(rd io.Reader) (run, error) {
+	r := run{}
+	scanner := bufio.NewScanner(rd)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, errors.New("line " + strconv.Itoa(n) + ": expected a name and a value")
+		}
+		f, err := parseValue(fields[1])
+		if err != nil {
+			return nil, errors.New("line " + strconv.Itoa(n) + ": " + err.Error())
+		}
+		r[fields[0]] = f
+	}
+	return r, scanner.Err()
+}
+
+// parseValue parses a number, where the simulations write "NaN" or "nan"
+// for the deviation of a single value.
+func parseValue(v string) (float64, error) {
+	v = strings.TrimSpace(v)
+	if strings.EqualFold(v, "nan") {
+		return math.NaN(), nil
+	}
+	return strconv.ParseFloat(v, 64)
+}
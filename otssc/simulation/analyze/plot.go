@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	plotWidth  = 800
+	plotHeight = 500
+	marginLeft = 80
+	marginRest = 50
+)
+
+// colors are used in turn for the lines of the plot.
+var colors = []string{"#1f77b4", "#ff7f0e", "#2ca02c", "#d62728", "#9467bd",
+	"#8c564b", "#e377c2", "#7f7f7f", "#bcbd22", "#17becf"}
+
+// series is the line of one metric through runs that only differ in the
+// number of trustees.
+type series struct {
+	metric string
+	label  string
+	runs   results
+}
+
+// lines returns the series of the metrics. If the runs differ in other
+// parameters than the number of trustees, every metric has a series for
+// each of their combinations, labelled with it.
+func lines(rs results, metrics []string) []series {
+	var groups []string
+	byGroup := map[string]results{}
+	for _, r := range rs {
+		name, _ := r.trustees()
+		g := r.key(name)
+		if _, ok := byGroup[g]; !ok {
+			groups = append(groups, g)
+		}
+		byGroup[g] = append(byGroup[g], r)
+	}
+	var ss []series
+	for _, m := range metrics {
+		for _, g := range groups {
+			label := m
+			if len(groups) > 1 {
+				label += " (" + g + ")"
+			}
+			ss = append(ss, series{m, label, byGroup[g]})
+		}
+	}
+	return ss
+}
+
+// plot writes an SVG line chart of the metrics against the number of
+// trustees, which is scsize if the runs have it, else hosts. Runs that miss a
+// metric or have NaN are left out of its line.
+func plot(w io.Writer, rs results, metrics []string, title, unit string) error {
+	if len(rs) == 0 || len(metrics) == 0 {
+		return errors.New("nothing to plot")
+	}
+	_, first := rs[0].trustees()
+	_, last := rs[len(rs)-1].trustees()
+	minX, maxX := float64(first), float64(last)
+	if minX == maxX {
+		minX, maxX = minX-1, maxX+1
+	}
+	maxY := 0.0
+	for _, r := range rs {
+		for _, m := range metrics {
+			if v, ok := r[m]; ok && !math.IsNaN(v) {
+				maxY = math.Max(maxY, v)
+			}
+		}
+	}
+	if maxY == 0 {
+		maxY = 1
+	}
+	maxY *= 1.05
+	innerW := float64(plotWidth - marginLeft - marginRest)
+	innerH := float64(plotHeight - 2*marginRest)
+	x := func(v int) float64 { return marginLeft + (float64(v)-minX)/(maxX-minX)*innerW }
+	y := func(v float64) float64 { return marginRest + innerH - v/maxY*innerH }
+
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="sans-serif" font-size="12">`+"\n",
+		plotWidth, plotHeight)
+	fmt.Fprintf(b, `<rect width="%d" height="%d" fill="white"/>`+"\n", plotWidth, plotHeight)
+	fmt.Fprintf(b, `<text x="%d" y="%d" text-anchor="middle" font-size="16">%s</text>`+"\n",
+		plotWidth/2, marginRest/2, escape(title))
+
+	// Axes with a tick for every number of trustees and five for the
+	// values.
+	fmt.Fprintf(b, `<path d="M%d %d V%d H%d" stroke="black" fill="none"/>`+"\n",
+		marginLeft, marginRest, plotHeight-marginRest, plotWidth-marginRest)
+	ticks := map[int]bool{}
+	names := map[string]bool{}
+	for _, r := range rs {
+		name, t := r.trustees()
+		names[name] = true
+		if !ticks[t] {
+			ticks[t] = true
+			fmt.Fprintf(b, `<text x="%.1f" y="%d" text-anchor="middle">%d</text>`+"\n",
+				x(t), plotHeight-marginRest+18, t)
+		}
+	}
+	for i := 0; i <= 5; i++ {
+		v := maxY * float64(i) / 5
+		fmt.Fprintf(b, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="#ddd"/>`+"\n",
+			marginLeft, y(v), plotWidth-marginRest, y(v))
+		fmt.Fprintf(b, `<text x="%d" y="%.1f" text-anchor="end">%s</text>`+"\n",
+			marginLeft-6, y(v)+4, strconv.FormatFloat(v, 'g', 3, 64))
+	}
+	xLabel := "trustees"
+	if len(names) == 1 {
+		for name := range names {
+			xLabel += " (" + name + ")"
+		}
+	}
+	fmt.Fprintf(b, `<text x="%d" y="%d" text-anchor="middle">%s</text>`+"\n",
+		marginLeft+int(innerW)/2, plotHeight-12, xLabel)
+	fmt.Fprintf(b, `<text x="16" y="%d" text-anchor="middle" transform="rotate(-90 16 %d)">%s</text>`+"\n",
+		marginRest+int(innerH)/2, marginRest+int(innerH)/2, escape(unit))
+
+	for i, s := range lines(rs, metrics) {
+		color := colors[i%len(colors)]
+		var points [][2]float64
+		var coords []string
+		for _, r := range s.runs {
+			if v, ok := r[s.metric]; ok && !math.IsNaN(v) {
+				_, t := r.trustees()
+				p := [2]float64{x(t), y(v)}
+				points = append(points, p)
+				coords = append(coords, fmt.Sprintf("%.1f,%.1f", p[0], p[1]))
+			}
+		}
+		if len(points) > 0 {
+			fmt.Fprintf(b, `<polyline points="%s" stroke="%s" stroke-width="2" fill="none"/>`+"\n",
+				strings.Join(coords, " "), color)
+		}
+		for _, p := range points {
+			fmt.Fprintf(b, `<circle cx="%.1f" cy="%.1f" r="3" fill="%s"/>`+"\n", p[0], p[1], color)
+		}
+		ly := marginRest + 10 + 16*i
+		fmt.Fprintf(b, `<rect x="%d" y="%d" width="12" height="4" fill="%s"/>`+"\n",
+			marginLeft+10, ly-4, color)
+		fmt.Fprintf(b, `<text x="%d" y="%d">%s</text>`+"\n", marginLeft+28, ly, escape(s.label))
+	}
+	b.WriteString("</svg>\n")
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+func escape(s string) string {
+	b := &bytes.Buffer{}
+	xml.EscapeText(b, []byte(s))
+	return b.String()
+}
@@ -3,17 +3,17 @@ package main
 import (
 	"bytes"
 	"errors"
+	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/dedis/cothority_template/measure"
+	"github.com/dedis/cothority_template/netem"
 	ots "github.com/dedis/cothority_template/ots"
 	ocs "github.com/dedis/onchain-secrets"
 
+	"github.com/dedis/cothority_template/ots/keystore"
 	"github.com/dedis/cothority_template/ots/util"
 	"github.com/dedis/cothority_template/otssc/protocol"
-	"gopkg.in/dedis/crypto.v0/abstract"
-	"gopkg.in/dedis/crypto.v0/ed25519"
-	"gopkg.in/dedis/crypto.v0/random"
-	"gopkg.in/dedis/crypto.v0/share/pvss"
 	"gopkg.in/dedis/onet.v1"
 	"gopkg.in/dedis/onet.v1/log"
 	"gopkg.in/dedis/onet.v1/network"
@@ -24,8 +24,54 @@ func init() {
 	onet.SimulationRegister("OTS", NewOTSSimulation)
 }
 
+// OTSSimulation runs OTS rounds. The access-control cothority (AC) holds
+// the skipchain, the secret-management cothority (SC) the PVSS shares. All
+// fields can be set in the TOML file; zero values take the defaults.
 type OTSSimulation struct {
 	onet.SimulationBFTree
+	// Config emulates a wide-area network between the nodes.
+	netem.Config
+	Suite string
+	// ACSize is the size of the AC, 10 by default.
+	ACSize int
+	// SCSize is the number of trustees in the SC, by default all hosts.
+	SCSize int
+	// Disjoint puts the AC on the hosts after the SC instead of on the
+	// first hosts, which are shared with the SC.
+	Disjoint bool
+	// RootIndex is the index of the trustee in the SC that runs the
+	// decryption protocol.
+	RootIndex int
+	// MesgSize is the size of the message in bytes, 1 MiB by default.
+	MesgSize int
+	// Threshold is the number of shares needed to recover the secret, by
+	// default 2/3 of the SC plus one.
+	Threshold int
+	// DummyTxn is the number of write/read pairs added to the skipchain
+	// before the first round.
+	DummyTxn int
+	// DummyConcurrency is the number of dummy pairs prepared at the same
+	// time, 8 by default.
+	DummyConcurrency int
+	// Readers switches to measuring throughput: every round, Readers
+	// readers send ReadRequests decryption requests each, all at the same
+	// time, to the OTSSCService of the SC.
+	Readers int
+	// ReadRequests is the number of decryption requests of every reader,
+	// 10 by default.
+	ReadRequests int
+	// Fault is the misbehaviour of the faulty trustees: "crash", "delay",
+	// "garbage" or "wrongindex".
+	Fault string
+	// FaultFraction is the fraction of the SC that is faulty. The root is
+	// always honest, the faulty trustees are the last other ones of the SC.
+	FaultFraction float64
+	// FaultDelay is how long trustees with the "delay" fault wait before
+	// replying, in milliseconds. 1000 by default.
+	FaultDelay int
+	// DecTimeout is how long the root waits for the shares, in
+	// milliseconds. 0 uses the default of the protocol.
+	DecTimeout int
 }
 
 func NewOTSSimulation(config string) (onet.Simulation, error) {
@@ -38,7 +84,18 @@ func NewOTSSimulation(config string) (onet.Simulation, error) {
 }
 
 func (otss *OTSSimulation) Setup(dir string, hosts []string) (*onet.SimulationConfig, error) {
-
+	if otss.ACSize < 0 || otss.SCSize < 0 || otss.MesgSize < 0 ||
+		otss.Threshold < 0 || otss.DummyTxn < 0 || otss.DummyConcurrency < 0 ||
+		otss.Readers < 0 || otss.ReadRequests < 0 || otss.FaultDelay < 0 ||
+		otss.DecTimeout < 0 {
+		return nil, errors.New("Negative simulation parameter")
+	}
+	if otss.FaultFraction < 0 || otss.FaultFraction > 1 {
+		return nil, errors.New("FaultFraction must be between 0 and 1")
+	}
+	if _, err := protocol.ParseFault(otss.Fault); err != nil {
+		return nil, err
+	}
 	sc := &onet.SimulationConfig{}
 	//TODO: 3rd parameter to CreateRoster is port #
 	otss.CreateRoster(sc, hosts, 2000)
@@ -49,27 +106,91 @@ func (otss *OTSSimulation) Setup(dir string, hosts []string) (*onet.SimulationCo
 	return sc, nil
 }
 
+// Node turns on the network emulation and makes the trustees of this node
+// that are chosen by FaultFraction misbehave.
 func (otss *OTSSimulation) Node(config *onet.SimulationConfig) error {
+	if err := netem.Set(otss.Config); err != nil {
+		return err
+	}
+	if otss.Config.Enabled() {
+		log.Lvl1("The network emulation only applies to DecReq and ValidateWriteTxn,",
+			"the other phases talk to the skipchain directly")
+	}
+	fault, err := protocol.ParseFault(otss.Fault)
+	if err != nil {
+		return err
+	}
+	if fault != protocol.FaultNone && otss.faulty() > 0 {
+		if otss.FaultDelay > 0 {
+			protocol.FaultDelayDuration = time.Duration(otss.FaultDelay) * time.Millisecond
+		}
+		_, scRoster, err := otss.committees(config)
+		if err != nil {
+			return err
+		}
+		// The faulty trustees are the last ones of the SC, skipping the
+		// root, which is the first host.
+		root := config.Roster.List[0].ID
+		own := config.Server.ServerIdentity.ID
+		list := scRoster.List
+		for i, f := len(list)-1, otss.faulty(); i >= 0 && f > 0; i-- {
+			if list[i].ID.Equal(root) {
+				continue
+			}
+			if list[i].ID.Equal(own) {
+				log.Lvl1(list[i].Address, "is a faulty trustee:", otss.Fault)
+				protocol.SetFault(own, fault)
+			}
+			f--
+		}
+	}
 	return otss.SimulationBFTree.Node(config)
 }
 
+// faulty returns the number of faulty trustees, which is at most the size of
+// the SC minus one for the root.
+func (otss *OTSSimulation) faulty() int {
+	if otss.Fault == "" || otss.Fault == "none" {
+		return 0
+	}
+	n := otss.SCSize
+	if n == 0 {
+		n = otss.Hosts
+	}
+	f := int(otss.FaultFraction*float64(n) + 0.5)
+	if f > n-1 {
+		f = n - 1
+	}
+	return f
+}
+
 func (otss *OTSSimulation) Run(config *onet.SimulationConfig) error {
 
 	log.Info("Total # of rounds:", otss.Rounds)
-	// HARD-CODING AC COTHORITY SIZE!
-	acSize := 10
-	acRoster := onet.NewRoster(config.Roster.List[:acSize])
-	scPubKeys := config.Roster.Publics()
-	log.Info("SC PubKeys Size", len(scPubKeys))
+	if !config.Roster.List[0].ID.Equal(config.Server.ServerIdentity.ID) {
+		return errors.New("The simulation doesn't run on the first host")
+	}
+	acRoster, scRoster, err := otss.committees(config)
+	if err != nil {
+		return err
+	}
+	scPubKeys := scRoster.Publics()
+	numTrustee := len(scPubKeys)
 	log.Info("AC Size:", len(acRoster.List))
-
-	numTrustee := config.Tree.Size()
 	log.Info("# of trustees:", numTrustee)
-	mesgSize := 1024 * 1024
-	mesg := make([]byte, mesgSize)
-	for i := 0; i < mesgSize; i++ {
-		mesg[i] = 'w'
+	// The root is at RootIndex in scRoster. The tree swaps it with the
+	// first trustee, which the protocol undoes with RootIndex. The list is
+	// copied, as the tree generation may swap in place.
+	scList := append([]*network.ServerIdentity{}, scRoster.List...)
+	scTree := onet.NewRoster(scList).GenerateNaryTreeWithRoot(otss.BF, config.Server.ServerIdentity)
+	if scTree == nil {
+		return errors.New("Couldn't create the tree of the SC")
+	}
+	mesgSize := otss.MesgSize
+	if mesgSize == 0 {
+		mesgSize = 1024 * 1024
 	}
+	mesg := bytes.Repeat([]byte{'w'}, mesgSize)
 
 	// create_sc := monitor.NewTimeMeasure("CreateSC")
 	scurl, err := ots.CreateSkipchain(acRoster)
@@ -77,44 +198,72 @@ func (otss *OTSSimulation) Run(config *onet.SimulationConfig) error {
 	if err != nil {
 		return err
 	}
-	// Transactions with trustee size = 10
-	// Total block # = 2 x dummyTxnCount
-	// dummyTxnCount := 32
-	// dummyerr := prepareDummyDP(scurl, acRoster, dummyTxnCount)
-	// if dummyerr != nil {
-	// 	log.Errorf("Dummy errors is: %v", dummyerr)
-	// 	return err
-	// }
+	// Total block # = 2 x DummyTxn
+	if otss.DummyTxn > 0 {
+		err = otss.prepareDummyDP(scurl, scRoster)
+		if err != nil {
+			log.Errorf("Dummy errors is: %v", err)
+			return err
+		}
+	}
+
+	if otss.Readers > 0 {
+		for round := 0; round < otss.Rounds; round++ {
+			log.Info("Round:", round)
+			if err := otss.runReaders(scurl, scRoster, mesg); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 
+	store := ots.NewMemStorage()
 	for round := 0; round < otss.Rounds; round++ {
 		log.Info("Round:", round)
 
-		dataPVSS := util.DataPVSS{
-			Suite:        ed25519.NewAES128SHA256Ed25519(false),
-			SCPublicKeys: scPubKeys,
-			NumTrustee:   numTrustee,
+		dataPVSS, err := util.NewDataPVSS(otss.Suite, scPubKeys, numTrustee)
+		if err != nil {
+			return err
 		}
+		dataPVSS.Threshold = otss.Threshold
 
-		wrPrivKey := dataPVSS.Suite.Scalar().Pick(random.Stream)
-		wrPubKey := dataPVSS.Suite.Point().Mul(nil, wrPrivKey)
-		// Reader's pk/sk pair
-		privKey := dataPVSS.Suite.Scalar().Pick(random.Stream)
-		pubKey := dataPVSS.Suite.Point().Mul(nil, privKey)
+		wrKey, err := keystore.NewKey(dataPVSS.SuiteID)
+		if err != nil {
+			return err
+		}
+		wrPubKey := wrKey.Public
+		// Reader's keys
+		key, err := keystore.NewKey(dataPVSS.SuiteID)
+		if err != nil {
+			return err
+		}
+		pubKey := key.Public
 
-		write_txn_prep := monitor.NewTimeMeasure("WriteTxnPrep")
-		err = ots.SetupPVSS(&dataPVSS, pubKey)
+		write_txn_prep := measure.Start(measure.WriteTxnPrep, config.Server)
+		err = ots.SetupPVSS(dataPVSS, pubKey)
 		if err != nil {
 			return err
 		}
 
-		encMesg, hashEnc, err := ots.EncryptMessage(&dataPVSS, mesg)
+		encMesg, hashEnc, err := ots.EncryptMessage(dataPVSS, mesg, nil)
 		write_txn_prep.Record()
 		if err != nil {
 			return err
 		}
+		_, err = ots.UploadEnvelope(store, encMesg)
+		if err != nil {
+			return err
+		}
 
-		create_wrt_txn := monitor.NewTimeMeasure("CreateWriteTxn")
-		writeSB, err := ots.CreateWriteTxn(scurl, &dataPVSS, hashEnc, pubKey, wrPrivKey)
+		validate_wrt_txn := measure.Start(measure.ValidateWriteTxn, config.Server)
+		att, err := ots.ValidateWriteTxn(scRoster, dataPVSS, pubKey)
+		validate_wrt_txn.Record()
+		if err != nil {
+			return err
+		}
+
+		create_wrt_txn := measure.Start(measure.CreateWriteTxn, config.Server)
+		writeSB, err := ots.CreateWriteTxn(scurl, dataPVSS, att, hashEnc, pubKey, wrKey)
 		create_wrt_txn.Record()
 		if err != nil {
 			return err
@@ -123,7 +272,7 @@ func (otss *OTSSimulation) Run(config *onet.SimulationConfig) error {
 		// Bob gets it from Alice
 		writeID := writeSB.Hash
 		// Get write transaction from skipchain
-		// get_write_txn_sb := monitor.NewTimeMeasure("GetWriteTxnSB")
+		// get_write_txn_sb := measure.Start(measure.GetWriteTxnSB, config.Server)
 		writeSB, writeTxnData, txnSig, err := ots.GetWriteTxnSB(scurl, writeID)
 		// get_write_txn_sb.Record()
 		if err != nil {
@@ -133,7 +282,7 @@ func (otss *OTSSimulation) Run(config *onet.SimulationConfig) error {
 		log.Info("Write index is:", writeSB.Index)
 
 		// ver_txn_sig := monitor.NewTimeMeasure("VerifyTxnSig")
-		sigVerErr := ots.VerifyTxnSignature(writeTxnData, txnSig, wrPubKey)
+		sigVerErr := ots.VerifyTxnSignature(dataPVSS.Suite, writeTxnData, txnSig, wrPubKey)
 		// ver_txn_sig.Record()
 		if sigVerErr != nil {
 			return sigVerErr
@@ -141,29 +290,29 @@ func (otss *OTSSimulation) Run(config *onet.SimulationConfig) error {
 
 		// log.Info("Signature verified on the retrieved write transaction")
 		// ver_enc_mesg := monitor.NewTimeMeasure("VerifyEncMesg")
-		validHash := ots.VerifyEncMesg(writeTxnData, encMesg)
+		encMesg, err = ots.FetchEnvelope(store, writeTxnData)
 		// ver_enc_mesg.Record()
-		if validHash != 0 {
-			return errors.New("Cannot verify encrypted message")
+		if err != nil {
+			return err
 		}
 
-		create_read_txn := monitor.NewTimeMeasure("CreateReadTxn")
-		readSB, err := ots.CreateReadTxn(scurl, writeID, privKey)
+		create_read_txn := measure.Start(measure.CreateReadTxn, config.Server)
+		readSB, err := ots.CreateReadTxn(scurl, writeID, key)
 		create_read_txn.Record()
 		if err != nil {
 			return err
 		}
 
-		// get_upd_wsb := monitor.NewTimeMeasure("GetUpdatedWriteSB")
+		// get_upd_wsb := measure.Start(measure.GetUpdatedWriteSB, config.Server)
 		updWriteSB, err := ots.GetUpdatedWriteTxnSB(scurl, writeID)
 		// get_upd_wsb.Record()
 		if err != nil {
 			return err
 		}
 
-		acPubKeys := readSB.Roster.Publics()
+		acPubKeys := updWriteSB.Roster.Publics()
 		readTxnSBF := readSB.SkipBlockFix
-		p, err := config.Overlay.CreateProtocol("otssc", config.Tree, onet.NilServiceID)
+		p, err := config.Overlay.CreateProtocol("otssc", scTree, onet.NilServiceID)
 		if err != nil {
 			return err
 		}
@@ -185,59 +334,55 @@ func (otss *OTSSimulation) Run(config *onet.SimulationConfig) error {
 			ReadTxnSBF:     readTxnSBF,
 			InclusionProof: inclusionProof,
 			ACPublicKeys:   acPubKeys,
+			SuiteID:        dataPVSS.SuiteID,
 		}
 		proto := p.(*protocol.OTSDecrypt)
 		proto.DecReqData = data
-		proto.RootIndex = 0
+		proto.RootIndex = otss.RootIndex
+		proto.Timeout = time.Duration(otss.DecTimeout) * time.Millisecond
 		// prep_decreq := monitor.NewTimeMeasure("PrepDecReq")
 		msg, err := network.Marshal(data)
 		if err != nil {
 			return err
 		}
 
-		sig, err := util.SignMessage(msg, privKey)
+		sig, err := key.Sign(msg)
 		if err != nil {
 			return err
 		}
 		// prep_decreq.Record()
 
 		proto.Signature = &sig
-		dec_req := monitor.NewTimeMeasure("DecReq")
+		dec_req := measure.Start(measure.DecReq, config.Server)
 		go p.Start()
 		reencShares := <-proto.DecShares
 		dec_req.Record()
 
 		// dec_reenc_shares := monitor.NewTimeMeasure("DecryptReencShares")
-		tmpDecShares, err := ots.ElGamalDecrypt(reencShares, privKey)
+		tmpDecShares, err := ots.ElGamalDecrypt(dataPVSS.Suite, reencShares, key.Private())
 		// dec_reenc_shares.Record()
 		if err != nil {
 			return err
 		}
 
-		size := len(tmpDecShares)
-		decShares := make([]*pvss.PubVerShare, size)
-		for i := 0; i < size; i++ {
-			decShares[tmpDecShares[i].S.I] = tmpDecShares[i]
-		}
-
-		recover_sec := monitor.NewTimeMeasure("RecoverSecret")
-		var validKeys []abstract.Point
-		var validEncShares []*pvss.PubVerShare
-		var validDecShares []*pvss.PubVerShare
-		for i := 0; i < size; i++ {
-			validKeys = append(validKeys, writeTxnData.SCPublicKeys[i])
-			validEncShares = append(validEncShares, writeTxnData.EncShares[i])
-			validDecShares = append(validDecShares, decShares[i])
-		}
-
-		// ver_recons_pvss := monitor.NewTimeMeasure("VerifyandReconstructPVSS")
-		recSecret, err := pvss.RecoverSecret(dataPVSS.Suite, writeTxnData.G, validKeys, validEncShares, validDecShares, dataPVSS.Threshold, dataPVSS.NumTrustee)
+		recover_sec := measure.Start(measure.RecoverSecret, config.Server)
+		validShares := len(ots.VerifyDecShares(dataPVSS.Suite, writeTxnData, tmpDecShares))
+		recSecret, err := ots.RecoverSecret(dataPVSS.Suite, writeTxnData, tmpDecShares, dataPVSS.Threshold)
 		recover_sec.Record()
+		monitor.RecordSingleMeasure("ValidShares", float64(validShares))
 		if err != nil {
+			if otss.faulty() > 0 {
+				// Too many faulty trustees is an outcome, not an error
+				// of the simulation.
+				log.Error("Couldn't recover the secret:", err)
+				monitor.RecordSingleMeasure("Recovered", 0)
+				continue
+			}
 			return err
 		}
+		monitor.RecordSingleMeasure("Recovered", 1)
 
-		dec_mesg := monitor.NewTimeMeasure("DecryptMessage")
+		dec_mesg := measure.Start(measure.DecryptMessage, config.Server)
 		recvMesg, err := ots.DecryptMessage(recSecret, encMesg, writeTxnData)
 		dec_mesg.Record()
 		// recover_sec.Record()
@@ -249,15 +394,55 @@ func (otss *OTSSimulation) Run(config *onet.SimulationConfig) error {
 	return nil
 }
 
-func prepareDummyDP(scurl *ocs.SkipChainURL, scRoster *onet.Roster, pairCount int) error {
-	scPubKeys := scRoster.Publics()
-	numTrustee := len(scPubKeys)
-	dp := util.DataPVSS{
-		Suite:        ed25519.NewAES128SHA256Ed25519(false),
-		SCPublicKeys: scPubKeys,
-		NumTrustee:   numTrustee,
+// committees returns the rosters of the AC and of the SC. The SC is made of
+// the first SCSize hosts, with the root of the simulation, which is the first
+// host, swapped to RootIndex.
+func (otss *OTSSimulation) committees(config *onet.SimulationConfig) (*onet.Roster, *onet.Roster, error) {
+	list := config.Roster.List
+	scSize := otss.SCSize
+	if scSize == 0 {
+		scSize = len(list)
+	}
+	acSize := otss.ACSize
+	if acSize == 0 {
+		acSize = 10
+	}
+	acStart := 0
+	if otss.Disjoint {
+		acStart = scSize
+	}
+	if scSize > len(list) || acStart+acSize > len(list) {
+		return nil, nil, errors.New("Not enough hosts for the committees")
+	}
+	if otss.Threshold > scSize {
+		return nil, nil, errors.New("Threshold is bigger than the SC")
 	}
+	if otss.RootIndex < 0 || otss.RootIndex >= scSize {
+		return nil, nil, errors.New("RootIndex is outside of the SC")
+	}
+	scList := append([]*network.ServerIdentity{}, list[:scSize]...)
+	scList[0], scList[otss.RootIndex] = scList[otss.RootIndex], scList[0]
+	return onet.NewRoster(list[acStart : acStart+acSize]), onet.NewRoster(scList), nil
+}
 
-	_, _ = ots.AddDummyTxnPairs(scurl, &dp, pairCount)
+// prepareDummyDP fills the skipchain with DummyTxn write/read pairs, so that
+// the rounds measure a chain of the given length.
+func (otss *OTSSimulation) prepareDummyDP(scurl *ocs.SkipChainURL, scRoster *onet.Roster) error {
+	dp, err := util.NewDataPVSS(otss.Suite, scRoster.Publics(), len(scRoster.List))
+	if err != nil {
+		return err
+	}
+	dp.Threshold = otss.Threshold
+	concurrency := otss.DummyConcurrency
+	if concurrency == 0 {
+		concurrency = 8
+	}
+	start := time.Now()
+	writes, _, err := ots.AddDummyTxnPairs(scurl, scRoster, dp, otss.DummyTxn, concurrency)
+	if err != nil {
+		return err
+	}
+	log.Infof("Added %d dummy pairs in %s, last write at index %d", len(writes),
+		time.Since(start), writes[len(writes)-1].Index)
 	return nil
 }
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dedis/cothority/skipchain"
+	ots "github.com/dedis/cothority_template/ots"
+	"github.com/dedis/cothority_template/ots/keystore"
+	"github.com/dedis/cothority_template/ots/util"
+	otssc "github.com/dedis/cothority_template/otssc/service"
+	ocs "github.com/dedis/onchain-secrets"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/simul/monitor"
+)
+
+// reader is one of the concurrent readers of runReaders.
+type reader struct {
+	key    *keystore.Key
+	readSB *skipchain.SkipBlock
+}
+
+// readResult is the outcome of one decryption request.
+type readResult struct {
+	latency float64
+	cpu     []float64
+	err     error
+}
+
+// runReaders writes one transaction, lets Readers readers read it, and then
+// sends all their decryption requests at the same time. It records:
+//   - DecReqThroughput: successful requests per second,
+//   - DecReqLatency_p50, _p90, _p99 and _max: latency of the successful
+//     requests in seconds,
+//   - DecReqFailed: number of failed requests,
+//   - TrusteeCPU: CPU seconds every trustee spent for the round, once per
+//     trustee, so that min, max and avg are over the trustees.
+func (otss *OTSSimulation) runReaders(scurl *ocs.SkipChainURL, scRoster *onet.Roster, mesg []byte) error {
+	dp, err := util.NewDataPVSS(otss.Suite, scRoster.Publics(), len(scRoster.List))
+	if err != nil {
+		return err
+	}
+	dp.Threshold = otss.Threshold
+	wrKey, err := keystore.NewKey(dp.SuiteID)
+	if err != nil {
+		return err
+	}
+	// All readers use the key the write is for, but each has its own read
+	// transaction.
+	key, err := keystore.NewKey(dp.SuiteID)
+	if err != nil {
+		return err
+	}
+	if err := ots.SetupPVSS(dp, key.Public); err != nil {
+		return err
+	}
+	encMesg, hashEnc, err := ots.EncryptMessage(dp, mesg, nil)
+	if err != nil {
+		return err
+	}
+	att, err := ots.ValidateWriteTxn(scRoster, dp, key.Public)
+	if err != nil {
+		return err
+	}
+	writeSB, err := ots.CreateWriteTxn(scurl, dp, att, hashEnc, key.Public, wrKey)
+	if err != nil {
+		return err
+	}
+	readers := make([]*reader, otss.Readers)
+	for i := range readers {
+		readSB, err := ots.CreateReadTxn(scurl, writeSB.Hash, key)
+		if err != nil {
+			return err
+		}
+		readers[i] = &reader{key: key, readSB: readSB}
+	}
+	updWriteSB, err := ots.GetUpdatedWriteTxnSB(scurl, writeSB.Hash)
+	if err != nil {
+		return err
+	}
+	_, wtd, _, err := ots.GetWriteTxnSB(scurl, writeSB.Hash)
+	if err != nil {
+		return err
+	}
+
+	requests := otss.ReadRequests
+	if requests == 0 {
+		requests = 10
+	}
+	results := make(chan *readResult, otss.Readers*requests)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for _, r := range readers {
+		wg.Add(1)
+		go func(r *reader) {
+			defer wg.Done()
+			cl := otssc.NewClient()
+			defer cl.Close()
+			for i := 0; i < requests; i++ {
+				results <- r.decrypt(cl, scRoster, updWriteSB, wtd, dp.Threshold, encMesg)
+			}
+		}(r)
+	}
+	wg.Wait()
+	close(results)
+	elapsed := time.Since(start).Seconds()
+
+	var latencies []float64
+	cpu := make([]float64, len(scRoster.List))
+	failed := 0
+	for res := range results {
+		for i, c := range res.cpu {
+			cpu[i] += c
+		}
+		if res.err != nil {
+			log.Error("Decryption request failed:", res.err)
+			failed++
+			continue
+		}
+		latencies = append(latencies, res.latency)
+	}
+	sort.Float64s(latencies)
+	log.Infof("%d requests in %fs, %d failed", otss.Readers*requests, elapsed, failed)
+	monitor.RecordSingleMeasure("DecReqThroughput", float64(len(latencies))/elapsed)
+	monitor.RecordSingleMeasure("DecReqFailed", float64(failed))
+	if len(latencies) > 0 {
+		for _, p := range []int{50, 90, 99} {
+			monitor.RecordSingleMeasure("DecReqLatency_p"+strconv.Itoa(p), percentile(latencies, p))
+		}
+		monitor.RecordSingleMeasure("DecReqLatency_max", latencies[len(latencies)-1])
+	}
+	for _, c := range cpu {
+		monitor.RecordSingleMeasure("TrusteeCPU", c)
+	}
+	return nil
+}
+
+// decrypt sends one decryption request and checks that the secret can be
+// recovered from the reply.
+func (r *reader) decrypt(cl *otssc.Client, scRoster *onet.Roster, writeSB *skipchain.SkipBlock,
+	wtd *util.WriteTxnData, threshold int, encMesg []byte) *readResult {
+	res := &readResult{}
+	idx := r.readSB.Index - writeSB.Index - 1
+	if idx < 0 {
+		res.err = errors.New("Forward-link index is negative")
+		return res
+	}
+	inclusionProof := writeSB.GetForward(idx)
+	if inclusionProof == nil {
+		res.err = errors.New("Forward-link does not exist")
+		return res
+	}
+	start := time.Now()
+	reply, cerr := cl.OTSDecryptWithLoad(scRoster, writeSB.SkipBlockFix, r.readSB.SkipBlockFix,
+		inclusionProof, writeSB.Roster.Publics(), r.key)
+	res.latency = time.Since(start).Seconds()
+	if cerr != nil {
+		res.err = cerr
+		return res
+	}
+	res.cpu = reply.CPU
+	tmpDecShares, err := ots.ElGamalDecrypt(r.key.Suite, reply.DecShares, r.key.Private())
+	if err != nil {
+		res.err = err
+		return res
+	}
+	recSecret, err := ots.RecoverSecret(r.key.Suite, wtd, tmpDecShares, threshold)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	_, res.err = ots.DecryptMessage(recSecret, encMesg, wtd)
+	return res
+}
+
+// percentile returns the p-th percentile of the sorted values, using the
+// nearest-rank method.
+func percentile(sorted []float64, p int) float64 {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
@@ -0,0 +1,160 @@
+/*
+Package erasure splits an envelope into n fragments so that any k of them
+are enough to rebuild it, and commits to the fragments with a Merkle tree.
+
+The code is a systematic Reed-Solomon code over GF(2^8): every byte position
+of the k data fragments defines a polynomial of degree k-1, and the n-k
+parity fragments hold its values at further points.
+*/
+package erasure
+
+import (
+	"errors"
+	"strconv"
+)
+
+// MaxFragments is the largest number of fragments, as every fragment needs
+// its own non-zero evaluation point in GF(2^8).
+const MaxFragments = 255
+
+var gfExp [510]byte
+var gfLog [256]int
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfExp[i+255] = byte(x)
+		gfLog[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[gfLog[a]+gfLog[b]]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[gfLog[a]+255-gfLog[b]]
+}
+
+// point returns the evaluation point of fragment i.
+func point(i int) byte {
+	return byte(i + 1)
+}
+
+func checkParams(k, n int) error {
+	if k < 1 || n < k || n > MaxFragments {
+		return errors.New("invalid erasure parameters k=" + strconv.Itoa(k) +
+			" n=" + strconv.Itoa(n))
+	}
+	return nil
+}
+
+// lagrange returns the coefficients that evaluate at x the polynomial
+// going through the points xs.
+func lagrange(xs []byte, x byte) []byte {
+	coefs := make([]byte, len(xs))
+	for i, xi := range xs {
+		c := byte(1)
+		for j, xj := range xs {
+			if i != j {
+				// Subtraction is xor in GF(2^8).
+				c = gfMul(c, gfDiv(x^xj, xi^xj))
+			}
+		}
+		coefs[i] = c
+	}
+	return coefs
+}
+
+// interpolate fills dst with the values at x of the polynomials going
+// through the fragments at points xs.
+func interpolate(dst []byte, frags [][]byte, xs []byte, x byte) {
+	coefs := lagrange(xs, x)
+	for b := range dst {
+		var v byte
+		for i, f := range frags {
+			v ^= gfMul(coefs[i], f[b])
+		}
+		dst[b] = v
+	}
+}
+
+// Encode splits data into n fragments of equal size, any k of which can
+// rebuild it with Decode.
+func Encode(data []byte, k, n int) ([][]byte, error) {
+	if err := checkParams(k, n); err != nil {
+		return nil, err
+	}
+	size := (len(data) + k - 1) / k
+	if size == 0 {
+		size = 1
+	}
+	frags := make([][]byte, n)
+	xs := make([]byte, k)
+	for i := 0; i < k; i++ {
+		frags[i] = make([]byte, size)
+		if i*size < len(data) {
+			copy(frags[i], data[i*size:])
+		}
+		xs[i] = point(i)
+	}
+	for i := k; i < n; i++ {
+		frags[i] = make([]byte, size)
+		interpolate(frags[i], frags[:k], xs, point(i))
+	}
+	return frags, nil
+}
+
+// Decode rebuilds the first length bytes of the data from frags, where
+// missing fragments are nil. At least k fragments must be present.
+func Decode(frags [][]byte, k, n, length int) ([]byte, error) {
+	if err := checkParams(k, n); err != nil {
+		return nil, err
+	}
+	if len(frags) != n {
+		return nil, errors.New("expected " + strconv.Itoa(n) + " fragments")
+	}
+	var present [][]byte
+	var xs []byte
+	size := -1
+	for i, f := range frags {
+		if f == nil || len(present) == k {
+			continue
+		}
+		if size >= 0 && len(f) != size {
+			return nil, errors.New("fragments have different sizes")
+		}
+		size = len(f)
+		present = append(present, f)
+		xs = append(xs, point(i))
+	}
+	if len(present) < k {
+		return nil, errors.New("only " + strconv.Itoa(len(present)) +
+			" fragments out of the " + strconv.Itoa(k) + " needed")
+	}
+	if length < 0 || length > k*size {
+		return nil, errors.New("invalid data length " + strconv.Itoa(length))
+	}
+
+	data := make([]byte, k*size)
+	for i := 0; i < k; i++ {
+		shard := data[i*size : (i+1)*size]
+		if frags[i] != nil {
+			copy(shard, frags[i])
+		} else {
+			interpolate(shard, present, xs, point(i))
+		}
+	}
+	return data[:length], nil
+}
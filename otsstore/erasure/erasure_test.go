@@ -0,0 +1,72 @@
+package erasure
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	for _, kn := range [][2]int{{1, 1}, {1, 3}, {2, 3}, {3, 5}, {5, 7}, {10, 30}} {
+		k, n := kn[0], kn[1]
+		for _, length := range []int{0, 1, k - 1, k, 1000} {
+			data := make([]byte, length)
+			rand.Read(data)
+			frags, err := Encode(data, k, n)
+			require.Nil(t, err)
+			require.Equal(t, n, len(frags))
+
+			// Drop n-k random fragments.
+			avail := make([][]byte, n)
+			for _, i := range rand.Perm(n)[:k] {
+				avail[i] = frags[i]
+			}
+			dec, err := Decode(avail, k, n, length)
+			require.Nil(t, err)
+			assert.True(t, bytes.Equal(data, dec), "k=%d n=%d length=%d", k, n, length)
+		}
+	}
+}
+
+func TestDecode_Errors(t *testing.T) {
+	frags, err := Encode([]byte("some data"), 3, 5)
+	require.Nil(t, err)
+	_, err = Decode([][]byte{frags[0], nil, nil, frags[3], nil}, 3, 5, 9)
+	assert.NotNil(t, err)
+	_, err = Decode(frags, 3, 5, 100)
+	assert.NotNil(t, err)
+	_, err = Decode(frags[:4], 3, 5, 9)
+	assert.NotNil(t, err)
+	_, err = Encode(nil, 4, 3)
+	assert.NotNil(t, err)
+	_, err = Encode(nil, 1, MaxFragments+1)
+	assert.NotNil(t, err)
+}
+
+func TestMerkleTree(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 5, 8, 13} {
+		k := (n + 1) / 2
+		data := make([]byte, 100)
+		rand.Read(data)
+		frags, err := Encode(data, k, n)
+		require.Nil(t, err)
+		p := Params{Required: k, Total: n, Length: len(data)}
+		root, proofs := MerkleTree(p, frags)
+		for i := range frags {
+			assert.True(t, VerifyProof(root, p, i, frags[i], proofs[i]), "n=%d i=%d", n, i)
+
+			bad := append([]byte{}, frags[i]...)
+			bad[0] ^= 1
+			assert.False(t, VerifyProof(root, p, i, bad, proofs[i]))
+			if n > 1 {
+				assert.False(t, VerifyProof(root, p, (i+1)%n, frags[i], proofs[i]))
+			}
+			wrongParams := p
+			wrongParams.Length++
+			assert.False(t, VerifyProof(root, wrongParams, i, frags[i], proofs[i]))
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package erasure
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// Params are the erasure parameters of a stored envelope. They are part of
+// every leaf, so a node can't lie about them without breaking its proof.
+type Params struct {
+	Required int
+	Total    int
+	Length   int
+}
+
+func leafHash(p Params, index int, frag []byte) []byte {
+	var buf [17]byte
+	buf[0] = 0
+	binary.BigEndian.PutUint32(buf[1:], uint32(p.Required))
+	binary.BigEndian.PutUint32(buf[5:], uint32(p.Total))
+	binary.BigEndian.PutUint32(buf[9:], uint32(p.Length))
+	binary.BigEndian.PutUint32(buf[13:], uint32(index))
+	h := sha256.New()
+	h.Write(buf[:])
+	h.Write(frag)
+	return h.Sum(nil)
+}
+
+func nodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// levels returns all levels of the tree, from the leaves to the root. A node
+// without a sibling moves up unchanged.
+func levels(p Params, frags [][]byte) [][][]byte {
+	level := make([][]byte, len(frags))
+	for i, f := range frags {
+		level[i] = leafHash(p, i, f)
+	}
+	all := [][][]byte{level}
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+			} else {
+				next = append(next, nodeHash(level[i], level[i+1]))
+			}
+		}
+		all = append(all, next)
+		level = next
+	}
+	return all
+}
+
+// MerkleTree returns the root over the fragments and the inclusion proof
+// of every fragment.
+func MerkleTree(p Params, frags [][]byte) ([]byte, [][][]byte) {
+	all := levels(p, frags)
+	proofs := make([][][]byte, len(frags))
+	for i := range frags {
+		idx := i
+		for _, level := range all[:len(all)-1] {
+			sibling := idx ^ 1
+			if sibling < len(level) {
+				proofs[i] = append(proofs[i], level[sibling])
+			}
+			idx /= 2
+		}
+	}
+	return all[len(all)-1][0], proofs
+}
+
+// VerifyProof checks that frag is the fragment at index of the tree with
+// the given root.
+func VerifyProof(root []byte, p Params, index int, frag []byte, proof [][]byte) bool {
+	if index < 0 || index >= p.Total || checkParams(p.Required, p.Total) != nil {
+		return false
+	}
+	h := leafHash(p, index, frag)
+	width := p.Total
+	for width > 1 {
+		sibling := index ^ 1
+		if sibling < width {
+			if len(proof) == 0 {
+				return false
+			}
+			if index%2 == 0 {
+				h = nodeHash(h, proof[0])
+			} else {
+				h = nodeHash(proof[0], h)
+			}
+			proof = proof[1:]
+		}
+		index /= 2
+		width = (width + 1) / 2
+	}
+	return len(proof) == 0 && bytes.Equal(h, root)
+}
@@ -0,0 +1,150 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"strconv"
+
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/cothority_template/ots/util"
+	"github.com/dedis/cothority_template/otsstore/erasure"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/crypto"
+	"gopkg.in/dedis/onet.v1/log"
+)
+
+// Client stores and retrieves envelopes on a roster.
+type Client struct {
+	*onet.Client
+}
+
+// NewClient instantiates a new Client.
+func NewClient() *Client {
+	return &Client{Client: onet.NewClient(ServiceName)}
+}
+
+// Fragments splits env into one fragment for each of n conodes, so that any
+// required of them can rebuild it. All fragments hold the Merkle root, to
+// which the write transaction of env has to commit.
+func Fragments(env []byte, required, n int) ([]*Fragment, error) {
+	frags, err := erasure.Encode(env, required, n)
+	if err != nil {
+		return nil, err
+	}
+	params := erasure.Params{Required: required, Total: n, Length: len(env)}
+	root, proofs := erasure.MerkleTree(params, frags)
+	fragments := make([]*Fragment, n)
+	for i := range frags {
+		fragments[i] = &Fragment{
+			Root:   root,
+			Params: params,
+			Index:  i,
+			Data:   frags[i],
+			Proof:  proofs[i],
+		}
+	}
+	return fragments, nil
+}
+
+// Store gives frags[i], as returned by Fragments, to the i-th conode of r.
+// write is the write transaction of the envelope and sig the signature of
+// the writer's key writer on it. Store fails if fewer conodes stored their
+// fragment than are required to rebuild the envelope.
+func (c *Client) Store(r *onet.Roster, frags []*Fragment, write *util.WriteTxnData, writer abstract.Point, sig *crypto.SchnorrSig) error {
+	if len(frags) == 0 || len(frags) != len(r.List) {
+		return errors.New("need one fragment for every conode")
+	}
+	required := frags[0].Params.Required
+	stored := 0
+	for i, si := range r.List {
+		req := &StoreFragmentReq{
+			Fragment:  frags[i],
+			Write:     write,
+			Writer:    writer,
+			Signature: sig,
+		}
+		cerr := c.SendProtobuf(si, req, &StoreFragmentResp{})
+		if cerr != nil {
+			log.Error("Couldn't store fragment on", si.Address, cerr)
+			continue
+		}
+		stored++
+	}
+	if stored < required {
+		return errors.New("only " + strconv.Itoa(stored) + " conodes stored their fragment")
+	}
+	return nil
+}
+
+// Confirm tells the conodes of r, which got frags from Store, that the
+// write transaction of the envelope is in the block writeID of the skipchain
+// on chain, so that they keep their fragments. Confirm fails if fewer conodes
+// confirmed their fragment than are required to rebuild the envelope.
+func (c *Client) Confirm(r *onet.Roster, frags []*Fragment, chain *onet.Roster, writeID skipchain.SkipBlockID) error {
+	if len(frags) == 0 {
+		return errors.New("no fragments to confirm")
+	}
+	req := &ConfirmFragmentReq{Root: frags[0].Root, Roster: chain, WriteID: writeID}
+	confirmed := 0
+	for _, si := range r.List {
+		cerr := c.SendProtobuf(si, req, &ConfirmFragmentResp{})
+		if cerr != nil {
+			log.Error("Couldn't confirm fragment on", si.Address, cerr)
+			continue
+		}
+		confirmed++
+	}
+	if confirmed < frags[0].Params.Required {
+		return errors.New("only " + strconv.Itoa(confirmed) + " conodes confirmed their fragment")
+	}
+	return nil
+}
+
+// Retrieve asks the conodes of r for their fragments until it can rebuild
+// the envelope committed to by root, and checks it against hashEnc.
+// Fragments with an invalid proof are ignored.
+func (c *Client) Retrieve(r *onet.Roster, root []byte, hashEnc []byte) ([]byte, error) {
+	var params *erasure.Params
+	var frags [][]byte
+	valid := 0
+	for _, si := range r.List {
+		reply := &GetFragmentResp{}
+		cerr := c.SendProtobuf(si, &GetFragmentReq{Root: root}, reply)
+		if cerr != nil {
+			log.Lvl2("Couldn't get fragment from", si.Address, cerr)
+			continue
+		}
+		f := reply.Fragment
+		if f == nil || !bytes.Equal(f.Root, root) || f.verify() != nil {
+			log.Error("Invalid fragment from", si.Address)
+			continue
+		}
+		if params == nil {
+			params = &f.Params
+			frags = make([][]byte, params.Total)
+		}
+		if frags[f.Index] != nil {
+			continue
+		}
+		frags[f.Index] = f.Data
+		valid++
+		if valid == params.Required {
+			break
+		}
+	}
+	if params == nil || valid < params.Required {
+		return nil, errors.New("not enough valid fragments to rebuild the envelope")
+	}
+
+	env, err := erasure.Decode(frags, params.Required, params.Total, params.Length)
+	if err != nil {
+		return nil, err
+	}
+	tmpHash := sha256.Sum256(env)
+	if !bytes.Equal(tmpHash[:], hashEnc) {
+		return nil, errors.New("rebuilt envelope doesn't match its hash")
+	}
+	return env, nil
+}
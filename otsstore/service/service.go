@@ -0,0 +1,501 @@
+package service
+
+/*
+The OTSStoreService keeps erasure-coded fragments of OTS envelopes, so that
+readers can get the encrypted payload of a write transaction from the same
+conodes that hold the PVSS shares. Every conode stores one fragment and
+only accepts it with a valid Merkle proof, for a write transaction signed by
+its writer, attested by its trustees and that lists the conode as the
+trustee of the fragment.
+
+A fragment is pending until the client shows the write block of its
+envelope on the access-control skipchain with ConfirmFragmentReq. Pending
+fragments are removed after PendingTimeout, so that the storage of a conode
+doesn't fill up with envelopes that never got a write transaction.
+*/
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/dedis/cothority/skipchain"
+	"github.com/dedis/cothority_template/ots/util"
+	"github.com/dedis/cothority_template/otsstore/erasure"
+	"github.com/dedis/cothority_template/persist"
+	ocs "github.com/dedis/onchain-secrets"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/crypto"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// ServiceName is used for registration on the onet.
+const ServiceName = "OTSStoreService"
+
+// MaxFragmentSize is the largest fragment a conode accepts.
+const MaxFragmentSize = 64 * 1024 * 1024
+
+// MaxStorage is the total size of the fragments a conode keeps. Once it is
+// reached, new fragments are refused.
+var MaxStorage = 1024 * 1024 * 1024
+
+// PendingTimeout is how long a conode keeps a fragment whose write
+// transaction is not confirmed.
+var PendingTimeout = time.Hour
+
+const (
+	// ErrorParse indicates an error while parsing the protobuf-file.
+	ErrorParse = iota + 4100
+	// ErrorInvalidFragment is returned for fragments that don't match
+	// their Merkle root.
+	ErrorInvalidFragment
+	// ErrorNotFound is returned when no fragment is stored for a root.
+	ErrorNotFound
+	// ErrorRefused is returned for fragments of write transactions that
+	// are not signed, not attested or not for this conode, and when the
+	// storage is full.
+	ErrorRefused
+	// ErrorNotConfirmed is returned when the write block given to confirm
+	// a fragment doesn't hold its write transaction.
+	ErrorNotConfirmed
+)
+
+// Used for tests
+var storeID onet.ServiceID
+
+func init() {
+	var err error
+	storeID, err = onet.RegisterNewService(ServiceName, newService)
+	log.ErrFatal(err)
+	for _, msg := range []interface{}{
+		&Fragment{}, &storage{},
+		&StoreFragmentReq{}, &StoreFragmentResp{},
+		&ConfirmFragmentReq{}, &ConfirmFragmentResp{},
+		&GetFragmentReq{}, &GetFragmentResp{},
+	} {
+		network.RegisterMessage(msg)
+	}
+}
+
+// Fragment is the part of an envelope stored on one conode, together with
+// the proof that it belongs to Root.
+type Fragment struct {
+	Root   []byte
+	Params erasure.Params
+	Index  int
+	Data   []byte
+	Proof  [][]byte
+}
+
+// verify checks the Merkle proof of the fragment.
+func (f *Fragment) verify() error {
+	if len(f.Data) > MaxFragmentSize {
+		return errors.New("fragment too big")
+	}
+	if !erasure.VerifyProof(f.Root, f.Params, f.Index, f.Data, f.Proof) {
+		return errors.New("fragment doesn't match its Merkle root")
+	}
+	return nil
+}
+
+// StoreFragmentReq asks a conode to keep a fragment of the envelope of
+// Write. Write has to hold the Merkle root of the fragment, the attestation
+// of its trustees and list the conode at the index of the fragment in its
+// SCPublicKeys. Signature is the writer's signature on Write, with a key of
+// the suite of Write.
+type StoreFragmentReq struct {
+	Fragment  *Fragment
+	Write     *util.WriteTxnData
+	Writer    abstract.Point
+	Signature *crypto.SchnorrSig
+}
+
+// StoreFragmentResp is returned once the fragment is saved.
+type StoreFragmentResp struct {
+}
+
+// ConfirmFragmentReq tells a conode that the write transaction of the
+// fragment with the given Merkle root is in the block WriteID of the
+// skipchain on Roster, so that the fragment is kept.
+type ConfirmFragmentReq struct {
+	Root    []byte
+	Roster  *onet.Roster
+	WriteID skipchain.SkipBlockID
+}
+
+// ConfirmFragmentResp is returned once the fragment is confirmed.
+type ConfirmFragmentResp struct {
+}
+
+// GetFragmentReq asks a conode for its fragment of the envelope with the
+// given Merkle root.
+type GetFragmentReq struct {
+	Root []byte
+}
+
+// GetFragmentResp holds the stored fragment.
+type GetFragmentResp struct {
+	Fragment *Fragment
+}
+
+// Service stores the fragments of this conode.
+type Service struct {
+	*onet.ServiceProcessor
+
+	storage *storage
+	store   *persist.Store
+	// fragments holds the stored fragments by root, and used their total
+	// size. Both are protected by the lock of storage.
+	fragments map[string]*Fragment
+	used      int
+	// expireScheduled is set while a call of expire is scheduled. It is
+	// protected by the lock of storage.
+	expireScheduled bool
+}
+
+const storageID = "fragments"
+
+// storage is the index of the stored fragments. Every fragment is saved on
+// its own, under fragmentID, so that storing one doesn't write the others.
+type storage struct {
+	// Fragments is only set in data of version 1, which saved all
+	// fragments in the index.
+	Fragments []*Fragment
+	// Roots lists the Merkle roots of the stored fragments.
+	Roots [][]byte
+	// Pending lists the fragments that are not confirmed yet.
+	Pending []*PendingFragment
+	sync.Mutex
+}
+
+// PendingFragment is a fragment that is removed at Expires, in
+// nanoseconds since the epoch, unless it is confirmed before.
+type PendingFragment struct {
+	Root    []byte
+	Expires int64
+}
+
+// storageSchema lists the versions of storage. Version 0 is the storage
+// saved before it was versioned, which has the same fields as version 1.
+// Version 2 moved the fragments out of the index, which tryLoad does.
+// Version 3 added Pending: the fragments stored before are confirmed.
+var storageSchema = &persist.Schema{
+	Version: 3,
+	Migrations: map[int]persist.Migration{0: persist.Unchanged, 1: persist.Unchanged,
+		2: persist.Unchanged},
+}
+
+// fragmentSchema lists the versions of a saved fragment.
+var fragmentSchema = &persist.Schema{Version: 1}
+
+// fragmentID is where the fragment of root is saved.
+func fragmentID(root []byte) string {
+	return storageID + "-" + hex.EncodeToString(root)
+}
+
+// StoreFragmentReq verifies and saves a fragment.
+func (s *Service) StoreFragmentReq(req *StoreFragmentReq) (*StoreFragmentResp, onet.ClientError) {
+	if req.Fragment == nil || req.Write == nil || req.Writer == nil || req.Signature == nil {
+		return nil, onet.NewClientErrorCode(ErrorParse, "missing fragment, write transaction or signature")
+	}
+	f := req.Fragment
+	if err := f.verify(); err != nil {
+		return nil, onet.NewClientErrorCode(ErrorInvalidFragment, err.Error())
+	}
+	if err := s.verifyWrite(req); err != nil {
+		return nil, onet.NewClientErrorCode(ErrorRefused, err.Error())
+	}
+
+	s.storage.Lock()
+	defer s.storage.Unlock()
+	if s.fragments[string(f.Root)] != nil {
+		return &StoreFragmentResp{}, nil
+	}
+	if s.used+len(f.Data) > MaxStorage {
+		return nil, onet.NewClientErrorCode(ErrorRefused, "storage is full")
+	}
+	if err := persist.NewStore(s.ServiceProcessor, fragmentID(f.Root), fragmentSchema).Save(f); err != nil {
+		log.Error("Couldn't save fragment:", err)
+		return nil, onet.NewClientError(err)
+	}
+	s.add(f)
+	s.storage.Pending = append(s.storage.Pending, &PendingFragment{
+		Root:    f.Root,
+		Expires: time.Now().Add(PendingTimeout).UnixNano(),
+	})
+	s.scheduleExpire()
+	if err := s.store.Save(s.storage); err != nil {
+		log.Error("Couldn't save file:", err)
+	}
+	return &StoreFragmentResp{}, nil
+}
+
+// ConfirmFragmentReq keeps a pending fragment once its write transaction
+// is on the skipchain.
+func (s *Service) ConfirmFragmentReq(req *ConfirmFragmentReq) (*ConfirmFragmentResp, onet.ClientError) {
+	if req.Roster == nil || len(req.WriteID) == 0 {
+		return nil, onet.NewClientErrorCode(ErrorParse, "missing roster or write block")
+	}
+	s.storage.Lock()
+	stored := s.fragments[string(req.Root)] != nil
+	s.storage.Unlock()
+	if !stored {
+		return nil, onet.NewClientErrorCode(ErrorNotFound, "no fragment for this root")
+	}
+	if err := verifyWriteBlock(req); err != nil {
+		return nil, onet.NewClientErrorCode(ErrorNotConfirmed, err.Error())
+	}
+
+	s.storage.Lock()
+	defer s.storage.Unlock()
+	for i, p := range s.storage.Pending {
+		if bytes.Equal(p.Root, req.Root) {
+			s.storage.Pending = append(s.storage.Pending[:i], s.storage.Pending[i+1:]...)
+			if err := s.store.Save(s.storage); err != nil {
+				log.Error("Couldn't save file:", err)
+			}
+			break
+		}
+	}
+	return &ConfirmFragmentResp{}, nil
+}
+
+// verifyWriteBlock checks that the block WriteID of the request holds a
+// write transaction for the envelope with the Merkle root of the request.
+func verifyWriteBlock(req *ConfirmFragmentReq) error {
+	cl := skipchain.NewClient()
+	defer cl.Close()
+	sb, cerr := cl.GetSingleBlock(req.Roster, req.WriteID)
+	if cerr != nil {
+		return cerr
+	}
+	if sb == nil || !sb.CalculateHash().Equal(req.WriteID) {
+		return errors.New("got another block than the write block")
+	}
+	_, msg, err := network.Unmarshal(sb.Data)
+	if err != nil {
+		return err
+	}
+	data, ok := msg.(*ocs.DataOCS)
+	if !ok || data.WriteTxn == nil || data.WriteTxn.Data == nil {
+		return errors.New("block holds no write transaction")
+	}
+	if !bytes.Equal(data.WriteTxn.Data.MerkleRoot, req.Root) {
+		return errors.New("write transaction is for another envelope")
+	}
+	return nil
+}
+
+// verifyWrite checks that the writer signed the write transaction of the
+// request, and that the fragment is this conode's part of its envelope.
+func (s *Service) verifyWrite(req *StoreFragmentReq) error {
+	f, w := req.Fragment, req.Write
+	if !bytes.Equal(w.MerkleRoot, f.Root) {
+		return errors.New("write transaction is for another envelope")
+	}
+	if f.Params.Total != len(w.SCPublicKeys) || f.Index < 0 || f.Index >= len(w.SCPublicKeys) ||
+		w.SCPublicKeys[f.Index] == nil || !w.SCPublicKeys[f.Index].Equal(s.ServerIdentity().Public) {
+		return errors.New("fragment is not for this conode")
+	}
+	suite, err := util.GetSuite(w.SuiteID)
+	if err != nil {
+		return err
+	}
+	buf, err := network.Marshal(w)
+	if err != nil {
+		return err
+	}
+	tmpHash := sha256.Sum256(buf)
+	if crypto.VerifySchnorr(suite, req.Writer, tmpHash[:], *req.Signature) != nil {
+		return errors.New("invalid signature of the writer")
+	}
+	// The writer's key is the caller's own, the trustees only attest
+	// shares they checked.
+	if err := util.VerifyWriteAttestation(w.Attestation, w.ValidateData()); err != nil {
+		return errors.New("write transaction is not attested: " + err.Error())
+	}
+	return nil
+}
+
+// GetFragmentReq returns the fragment stored for a root.
+func (s *Service) GetFragmentReq(req *GetFragmentReq) (*GetFragmentResp, onet.ClientError) {
+	s.storage.Lock()
+	defer s.storage.Unlock()
+	f := s.fragments[string(req.Root)]
+	if f == nil {
+		return nil, onet.NewClientErrorCode(ErrorNotFound, "no fragment for this root")
+	}
+	return &GetFragmentResp{Fragment: f}, nil
+}
+
+// NewProtocol is not used, as the service doesn't run any protocol.
+func (s *Service) NewProtocol(tn *onet.TreeNodeInstance, conf *onet.GenericConfig) (onet.ProtocolInstance, error) {
+	return nil, nil
+}
+
+// Tries to load the index and then the stored fragments.
+func (s *Service) tryLoad() error {
+	s.storage = &storage{}
+	s.fragments = map[string]*Fragment{}
+	msg, err := s.store.Load()
+	if err != nil || msg == nil {
+		return err
+	}
+	st, ok := msg.(*storage)
+	if !ok {
+		return errors.New("Data of wrong type")
+	}
+	return s.restore(st)
+}
+
+// restore replaces the stored fragments with those of st: the ones listed
+// in its Roots are loaded, the ones in its Fragments, from version 1 or an
+// export, are saved on their own. The pending ones expire as in st. The
+// caller must hold the storage lock.
+func (s *Service) restore(st *storage) error {
+	s.storage.Roots = nil
+	s.storage.Pending = st.Pending
+	s.fragments = map[string]*Fragment{}
+	s.used = 0
+	defer s.scheduleExpire()
+	for _, root := range st.Roots {
+		msg, err := persist.NewStore(s.ServiceProcessor, fragmentID(root), fragmentSchema).Load()
+		f, ok := msg.(*Fragment)
+		if err != nil || !ok {
+			log.Error("Couldn't load fragment", hex.EncodeToString(root), err)
+			continue
+		}
+		s.add(f)
+	}
+	if len(st.Fragments) == 0 {
+		return nil
+	}
+	for _, f := range st.Fragments {
+		if f == nil || s.fragments[string(f.Root)] != nil {
+			continue
+		}
+		if err := persist.NewStore(s.ServiceProcessor, fragmentID(f.Root), fragmentSchema).Save(f); err != nil {
+			return err
+		}
+		s.add(f)
+	}
+	return s.store.Save(s.storage)
+}
+
+// add keeps f in memory and in the index. The caller must hold the
+// storage lock.
+func (s *Service) add(f *Fragment) {
+	s.fragments[string(f.Root)] = f
+	s.used += len(f.Data)
+	s.storage.Roots = append(s.storage.Roots, f.Root)
+}
+
+// remove drops the fragment of root from memory and from the index. As
+// onet can't delete saved data, an empty fragment is saved in its place.
+// The caller must hold the storage lock.
+func (s *Service) remove(root []byte) {
+	f := s.fragments[string(root)]
+	if f == nil {
+		return
+	}
+	delete(s.fragments, string(root))
+	s.used -= len(f.Data)
+	for i, r := range s.storage.Roots {
+		if bytes.Equal(r, root) {
+			s.storage.Roots = append(s.storage.Roots[:i], s.storage.Roots[i+1:]...)
+			break
+		}
+	}
+	if err := persist.NewStore(s.ServiceProcessor, fragmentID(root), fragmentSchema).Save(&Fragment{}); err != nil {
+		log.Error("Couldn't remove fragment:", err)
+	}
+}
+
+// expire removes the pending fragments that expired and schedules itself
+// for the next one.
+func (s *Service) expire() {
+	s.storage.Lock()
+	defer s.storage.Unlock()
+	s.expireScheduled = false
+	now := time.Now().UnixNano()
+	var pending []*PendingFragment
+	for _, p := range s.storage.Pending {
+		if p.Expires > now {
+			pending = append(pending, p)
+			continue
+		}
+		log.Lvl2("Removing unconfirmed fragment", hex.EncodeToString(p.Root))
+		s.remove(p.Root)
+	}
+	if len(pending) < len(s.storage.Pending) {
+		s.storage.Pending = pending
+		if err := s.store.Save(s.storage); err != nil {
+			log.Error("Couldn't save file:", err)
+		}
+	}
+	s.scheduleExpire()
+}
+
+// scheduleExpire calls expire when the first pending fragment expires,
+// unless a call is already scheduled. The caller must hold the storage
+// lock.
+func (s *Service) scheduleExpire() {
+	if s.expireScheduled || len(s.storage.Pending) == 0 {
+		return
+	}
+	next := s.storage.Pending[0].Expires
+	for _, p := range s.storage.Pending {
+		if p.Expires < next {
+			next = p.Expires
+		}
+	}
+	s.expireScheduled = true
+	time.AfterFunc(time.Duration(next-time.Now().UnixNano()), s.expire)
+}
+
+// ExportStorage implements persist.Backup. The fragments are part of the
+// exported index, so that the backup holds all of them.
+func (s *Service) ExportStorage() ([]byte, error) {
+	s.storage.Lock()
+	defer s.storage.Unlock()
+	st := &storage{Pending: s.storage.Pending}
+	for _, root := range s.storage.Roots {
+		st.Fragments = append(st.Fragments, s.fragments[string(root)])
+	}
+	return s.store.Encode(st)
+}
+
+// ImportStorage implements persist.Backup.
+func (s *Service) ImportStorage(buf []byte) error {
+	s.storage.Lock()
+	defer s.storage.Unlock()
+	msg, err := s.store.Import(buf)
+	if err != nil {
+		return err
+	}
+	st, ok := msg.(*storage)
+	if !ok {
+		return errors.New("Data of wrong type")
+	}
+	return s.restore(st)
+}
+
+func newService(c *onet.Context) onet.Service {
+	s := &Service{
+		ServiceProcessor: onet.NewServiceProcessor(c),
+	}
+	s.store = persist.NewStore(s.ServiceProcessor, storageID, storageSchema)
+	exp, imp := persist.Handlers(ServiceName, s.ServerIdentity().Public, s)
+	if err := s.RegisterHandlers(s.StoreFragmentReq, s.ConfirmFragmentReq, s.GetFragmentReq, exp, imp); err != nil {
+		log.ErrFatal(err, "Couldn't register messages")
+	}
+	if err := s.tryLoad(); err != nil {
+		log.Error(err)
+	}
+	return s
+}
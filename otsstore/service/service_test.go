@@ -0,0 +1,269 @@
+package service
+
+import (
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/dedis/cothority_template/ots/keystore"
+	"github.com/dedis/cothority_template/ots/util"
+	"github.com/dedis/cothority_template/persist"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/crypto.v0/random"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/crypto"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+func TestMain(m *testing.M) {
+	log.MainTest(m)
+}
+
+// write is a write transaction for the fragments of an envelope, signed
+// by its writer.
+type write struct {
+	frags []*Fragment
+	wtd   *util.WriteTxnData
+	key   *keystore.Key
+	sig   *crypto.SchnorrSig
+}
+
+// newWrite returns the write transaction of env, attested by the first
+// required conodes of roster.
+func newWrite(t *testing.T, local *onet.LocalTest, hosts []*onet.Server, roster *onet.Roster, env []byte, required int) *write {
+	frags, err := Fragments(env, required, len(roster.List))
+	require.Nil(t, err)
+	key, err := keystore.NewKey(util.SuiteEd25519)
+	require.Nil(t, err)
+	tmpHash := sha256.Sum256(env)
+	w := &write{
+		frags: frags,
+		wtd: &util.WriteTxnData{
+			G:            key.Suite.Point().Base(),
+			SCPublicKeys: roster.Publics(),
+			HashEnc:      tmpHash[:],
+			ReaderPk:     key.Public,
+			Threshold:    required,
+			SuiteID:      util.SuiteEd25519,
+			MerkleRoot:   frags[0].Root,
+		},
+		key: key,
+	}
+	msg, err := util.AttestationMessage(w.wtd.ValidateData())
+	require.Nil(t, err)
+	w.wtd.Attestation = &util.WriteAttestation{Threshold: required}
+	for i := 0; i < required; i++ {
+		sig, err := crypto.SignSchnorr(key.Suite, local.GetPrivate(hosts[i]), msg)
+		require.Nil(t, err)
+		w.wtd.Attestation.Signatures = append(w.wtd.Attestation.Signatures,
+			&util.TrusteeSignature{Index: i, Signature: &sig})
+	}
+	w.sign(t)
+	return w
+}
+
+func (w *write) sign(t *testing.T) {
+	buf, err := network.Marshal(w.wtd)
+	require.Nil(t, err)
+	sig, err := w.key.Sign(buf)
+	require.Nil(t, err)
+	w.sig = &sig
+}
+
+func (w *write) req(i int) *StoreFragmentReq {
+	return &StoreFragmentReq{Fragment: w.frags[i], Write: w.wtd, Writer: w.key.Public, Signature: w.sig}
+}
+
+func TestClient_StoreRetrieve(t *testing.T) {
+	local := onet.NewTCPTest()
+	hosts, roster, _ := local.GenTree(5, true)
+	defer local.CloseAll()
+
+	env := random.Bytes(10000, random.Stream)
+	w := newWrite(t, local, hosts, roster, env, 3)
+	root := w.wtd.MerkleRoot
+
+	c := NewClient()
+	defer c.Close()
+	require.Nil(t, c.Store(roster, w.frags, w.wtd, w.key.Public, w.sig))
+
+	got, err := c.Retrieve(roster, root, w.wtd.HashEnc)
+	require.Nil(t, err)
+	assert.Equal(t, env, got)
+
+	// Two broken conodes can't prevent the retrieval.
+	services := local.GetServices(hosts, storeID)
+	for _, s := range services[:2] {
+		f := *s.(*Service).fragments[string(root)]
+		f.Data = append([]byte{}, f.Data...)
+		f.Data[0] ^= 1
+		s.(*Service).fragments[string(root)] = &f
+	}
+	got, err = c.Retrieve(roster, root, w.wtd.HashEnc)
+	require.Nil(t, err)
+	assert.Equal(t, env, got)
+
+	// With three of them, there aren't enough valid fragments left.
+	s := services[2].(*Service)
+	delete(s.fragments, string(root))
+	_, err = c.Retrieve(roster, root, w.wtd.HashEnc)
+	assert.NotNil(t, err)
+}
+
+func TestService_StoreFragmentReq(t *testing.T) {
+	local := onet.NewTCPTest()
+	hosts, roster, _ := local.GenTree(3, true)
+	defer local.CloseAll()
+	s := local.GetServices(hosts, storeID)[0].(*Service)
+	idx, _ := roster.Search(s.ServerIdentity().ID)
+	w := newWrite(t, local, hosts, roster, []byte("envelope"), 2)
+	other := newWrite(t, local, hosts, roster, []byte("other envelope"), 2)
+
+	// A fragment whose proof doesn't match is refused.
+	f := *w.frags[idx]
+	f.Root = []byte("another root")
+	req := w.req(idx)
+	req.Fragment = &f
+	_, cerr := s.StoreFragmentReq(req)
+	assert.NotNil(t, cerr)
+
+	// So are fragments for other conodes, for other write transactions or
+	// not signed by the writer.
+	req = w.req((idx + 1) % 3)
+	_, cerr = s.StoreFragmentReq(req)
+	require.NotNil(t, cerr)
+	assert.Equal(t, ErrorRefused, cerr.ErrorCode())
+	req = w.req(idx)
+	req.Write = other.wtd
+	_, cerr = s.StoreFragmentReq(req)
+	require.NotNil(t, cerr)
+	assert.Equal(t, ErrorRefused, cerr.ErrorCode())
+	req = w.req(idx)
+	req.Signature = other.sig
+	_, cerr = s.StoreFragmentReq(req)
+	require.NotNil(t, cerr)
+	assert.Equal(t, ErrorRefused, cerr.ErrorCode())
+	// A writer's signature alone isn't enough, the trustees have to
+	// attest the write transaction.
+	unattested := newWrite(t, local, hosts, roster, []byte("envelope"), 2)
+	unattested.wtd.Attestation.Signatures = unattested.wtd.Attestation.Signatures[:1]
+	unattested.sign(t)
+	_, cerr = s.StoreFragmentReq(unattested.req(idx))
+	require.NotNil(t, cerr)
+	assert.Equal(t, ErrorRefused, cerr.ErrorCode())
+	_, cerr = s.GetFragmentReq(&GetFragmentReq{Root: w.wtd.MerkleRoot})
+	assert.NotNil(t, cerr)
+
+	_, cerr = s.StoreFragmentReq(w.req(idx))
+	require.Nil(t, cerr)
+	resp, cerr := s.GetFragmentReq(&GetFragmentReq{Root: w.wtd.MerkleRoot})
+	require.Nil(t, cerr)
+	assert.Equal(t, w.frags[idx].Data, resp.Fragment.Data)
+
+	// A full conode refuses new fragments.
+	defer func(max int) { MaxStorage = max }(MaxStorage)
+	MaxStorage = s.used
+	_, cerr = s.StoreFragmentReq(other.req(idx))
+	require.NotNil(t, cerr)
+	assert.Equal(t, ErrorRefused, cerr.ErrorCode())
+
+	// The fragments are still there after a restart.
+	require.Nil(t, s.tryLoad())
+	_, cerr = s.GetFragmentReq(&GetFragmentReq{Root: w.wtd.MerkleRoot})
+	assert.Nil(t, cerr)
+}
+
+func TestService_Expire(t *testing.T) {
+	defer func(d time.Duration) { PendingTimeout = d }(PendingTimeout)
+	PendingTimeout = 100 * time.Millisecond
+	local := onet.NewTCPTest()
+	hosts, roster, _ := local.GenTree(3, true)
+	defer local.CloseAll()
+	s := local.GetServices(hosts, storeID)[0].(*Service)
+	idx, _ := roster.Search(s.ServerIdentity().ID)
+	w := newWrite(t, local, hosts, roster, []byte("envelope"), 2)
+	get := &GetFragmentReq{Root: w.wtd.MerkleRoot}
+
+	// A fragment whose write transaction is never confirmed is removed,
+	// and its space is free again.
+	_, cerr := s.StoreFragmentReq(w.req(idx))
+	require.Nil(t, cerr)
+	_, cerr = s.GetFragmentReq(get)
+	require.Nil(t, cerr)
+	time.Sleep(3 * PendingTimeout)
+	_, cerr = s.GetFragmentReq(get)
+	assert.NotNil(t, cerr)
+	s.storage.Lock()
+	assert.Equal(t, 0, s.used)
+	assert.Equal(t, 0, len(s.storage.Pending))
+	s.storage.Unlock()
+
+	// It can't be confirmed with a block that isn't on the skipchain.
+	_, cerr = s.StoreFragmentReq(w.req(idx))
+	require.Nil(t, cerr)
+	_, cerr = s.ConfirmFragmentReq(&ConfirmFragmentReq{Root: w.wtd.MerkleRoot, Roster: roster,
+		WriteID: []byte("unknown block")})
+	require.NotNil(t, cerr)
+	assert.Equal(t, ErrorNotConfirmed, cerr.ErrorCode())
+
+	// The deadline survives a restart.
+	require.Nil(t, s.tryLoad())
+	_, cerr = s.GetFragmentReq(get)
+	require.Nil(t, cerr)
+	time.Sleep(3 * PendingTimeout)
+	_, cerr = s.GetFragmentReq(get)
+	assert.NotNil(t, cerr)
+}
+
+func TestService_Migrate(t *testing.T) {
+	local := onet.NewTCPTest()
+	hosts, roster, _ := local.GenTree(3, true)
+	defer local.CloseAll()
+	s := local.GetServices(hosts, storeID)[0].(*Service)
+	idx, _ := roster.Search(s.ServerIdentity().ID)
+	w := newWrite(t, local, hosts, roster, []byte("envelope"), 2)
+
+	// Version 1 saved all fragments in the index.
+	v1 := persist.NewStore(s.ServiceProcessor, storageID, &persist.Schema{Version: 1})
+	require.Nil(t, v1.Save(&storage{Fragments: []*Fragment{w.frags[idx]}}))
+	require.Nil(t, s.tryLoad())
+	_, cerr := s.GetFragmentReq(&GetFragmentReq{Root: w.wtd.MerkleRoot})
+	require.Nil(t, cerr)
+
+	msg, err := s.store.Load()
+	require.Nil(t, err)
+	st := msg.(*storage)
+	assert.Equal(t, 0, len(st.Fragments))
+	assert.Equal(t, 1, len(st.Roots))
+	require.Nil(t, s.tryLoad())
+	_, cerr = s.GetFragmentReq(&GetFragmentReq{Root: w.wtd.MerkleRoot})
+	assert.Nil(t, cerr)
+}
+
+func TestService_ExportImport(t *testing.T) {
+	local := onet.NewTCPTest()
+	hosts, roster, _ := local.GenTree(3, true)
+	defer local.CloseAll()
+	s := local.GetServices(hosts, storeID)[0].(*Service)
+	idx, _ := roster.Search(s.ServerIdentity().ID)
+	w := newWrite(t, local, hosts, roster, []byte("envelope"), 2)
+	_, cerr := s.StoreFragmentReq(w.req(idx))
+	require.Nil(t, cerr)
+
+	// The backup holds the fragments, not only their index.
+	c := persist.NewClient(ServiceName)
+	buf, err := c.Export(hosts[0].ServerIdentity, local.GetPrivate(hosts[0]))
+	require.Nil(t, err)
+	s.storage.Lock()
+	require.Nil(t, s.restore(&storage{}))
+	s.storage.Unlock()
+	_, cerr = s.GetFragmentReq(&GetFragmentReq{Root: w.wtd.MerkleRoot})
+	assert.NotNil(t, cerr)
+
+	require.Nil(t, c.Import(hosts[0].ServerIdentity, local.GetPrivate(hosts[0]), buf))
+	_, cerr = s.GetFragmentReq(&GetFragmentReq{Root: w.wtd.MerkleRoot})
+	assert.Nil(t, cerr)
+	assert.Equal(t, len(w.frags[idx].Data), s.used)
+}
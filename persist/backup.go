@@ -0,0 +1,197 @@
+package persist
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/crypto.v0/random"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/crypto"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+func init() {
+	for _, msg := range []interface{}{
+		&ExportRequest{}, &ExportResponse{},
+		&ImportRequest{}, &ImportResponse{},
+	} {
+		network.RegisterMessage(msg)
+	}
+}
+
+// ErrorRefused is returned for export and import requests that are not
+// signed by the conode.
+const ErrorRefused = 4900
+
+// MaxSkew is how far the time of a signed export or import request may be
+// from the clock of the conode.
+var MaxSkew = time.Minute
+
+// nonceSize is the length of the nonce of a signed request.
+const nonceSize = 16
+
+// Backup is a service whose storage can be exported and imported.
+type Backup interface {
+	// ExportStorage returns the data of the service as a Record.
+	ExportStorage() ([]byte, error)
+	// ImportStorage replaces the data of the service with a Record
+	// returned by ExportStorage, possibly of an older version.
+	ImportStorage(buf []byte) error
+}
+
+// ExportRequest asks a service for a backup of its storage. The storage is
+// not meant for clients, so the request has to be signed with the private
+// key of the conode.
+type ExportRequest struct {
+	// Time is when the request was signed, in Unix seconds.
+	Time int64
+	// Nonce is random and accepted only once, so the request can't be
+	// replayed within MaxSkew.
+	Nonce     []byte
+	Signature crypto.SchnorrSig
+}
+
+// ExportResponse holds the Record returned by ExportStorage.
+type ExportResponse struct {
+	Data []byte
+}
+
+// ImportRequest asks a service to replace its storage with Data, a Record
+// returned by an ExportRequest. It has to be signed with the private key of
+// the conode.
+type ImportRequest struct {
+	Data      []byte
+	Time      int64
+	Nonce     []byte
+	Signature crypto.SchnorrSig
+}
+
+// ImportResponse is returned once the data is imported.
+type ImportResponse struct {
+}
+
+// backupHash is what the conode signs for an export or import of the
+// service name. It binds the request to the service, its time, its nonce
+// and the imported data.
+func backupHash(kind, name string, t int64, nonce, data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(kind))
+	h.Write([]byte{0})
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	binary.Write(h, binary.BigEndian, t)
+	h.Write(nonce)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// replayGuard remembers the nonces of the accepted requests until their
+// time is older than MaxSkew, after which verifyBackup refuses them anyway.
+type replayGuard struct {
+	sync.Mutex
+	seen map[string]time.Time
+}
+
+// verifyBackup checks that the request was signed by pub recently and was
+// not seen before.
+func (g *replayGuard) verifyBackup(pub abstract.Point, kind, name string, t int64, nonce, data []byte, sig crypto.SchnorrSig) error {
+	now := time.Now()
+	skew := now.Sub(time.Unix(t, 0))
+	if skew > MaxSkew || skew < -MaxSkew {
+		return errors.New("Request too old or from the future")
+	}
+	if len(nonce) != nonceSize {
+		return errors.New("Request without a valid nonce")
+	}
+	if crypto.VerifySchnorr(network.Suite, pub, backupHash(kind, name, t, nonce, data), sig) != nil {
+		return errors.New("Request not signed by the conode")
+	}
+	g.Lock()
+	defer g.Unlock()
+	for n, exp := range g.seen {
+		if now.After(exp) {
+			delete(g.seen, n)
+		}
+	}
+	if _, ok := g.seen[string(nonce)]; ok {
+		return errors.New("Request already seen")
+	}
+	g.seen[string(nonce)] = time.Unix(t, 0).Add(MaxSkew)
+	return nil
+}
+
+// Handlers returns the handlers of ExportRequest and ImportRequest for b,
+// the service name of the conode with the public key pub. Services register
+// them together with their own handlers.
+func Handlers(name string, pub abstract.Point, b Backup) (
+	func(*ExportRequest) (*ExportResponse, onet.ClientError),
+	func(*ImportRequest) (*ImportResponse, onet.ClientError)) {
+	g := &replayGuard{seen: map[string]time.Time{}}
+	exp := func(req *ExportRequest) (*ExportResponse, onet.ClientError) {
+		if err := g.verifyBackup(pub, "export", name, req.Time, req.Nonce, nil, req.Signature); err != nil {
+			return nil, onet.NewClientErrorCode(ErrorRefused, err.Error())
+		}
+		buf, err := b.ExportStorage()
+		if err != nil {
+			return nil, onet.NewClientError(err)
+		}
+		return &ExportResponse{Data: buf}, nil
+	}
+	imp := func(req *ImportRequest) (*ImportResponse, onet.ClientError) {
+		if err := g.verifyBackup(pub, "import", name, req.Time, req.Nonce, req.Data, req.Signature); err != nil {
+			return nil, onet.NewClientErrorCode(ErrorRefused, err.Error())
+		}
+		if err := b.ImportStorage(req.Data); err != nil {
+			return nil, onet.NewClientError(err)
+		}
+		return &ImportResponse{}, nil
+	}
+	return exp, imp
+}
+
+// Client exports and imports the storage of a service of a conode. It
+// needs the private key of the conode.
+type Client struct {
+	*onet.Client
+	name string
+}
+
+// NewClient returns a client for the service name.
+func NewClient(name string) *Client {
+	return &Client{Client: onet.NewClient(name), name: name}
+}
+
+// Export returns the storage of the service on si, whose private key is
+// priv.
+func (c *Client) Export(si *network.ServerIdentity, priv abstract.Scalar) ([]byte, error) {
+	req := &ExportRequest{Time: time.Now().Unix(), Nonce: random.Bytes(nonceSize, random.Stream)}
+	sig, err := crypto.SignSchnorr(network.Suite, priv, backupHash("export", c.name, req.Time, req.Nonce, nil))
+	if err != nil {
+		return nil, err
+	}
+	req.Signature = sig
+	resp := &ExportResponse{}
+	if cerr := c.SendProtobuf(si, req, resp); cerr != nil {
+		return nil, cerr
+	}
+	return resp.Data, nil
+}
+
+// Import replaces the storage of the service on si, whose private key is
+// priv, with buf.
+func (c *Client) Import(si *network.ServerIdentity, priv abstract.Scalar, buf []byte) error {
+	req := &ImportRequest{Data: buf, Time: time.Now().Unix(), Nonce: random.Bytes(nonceSize, random.Stream)}
+	sig, err := crypto.SignSchnorr(network.Suite, priv, backupHash("import", c.name, req.Time, req.Nonce, buf))
+	if err != nil {
+		return err
+	}
+	req.Signature = sig
+	if cerr := c.SendProtobuf(si, req, &ImportResponse{}); cerr != nil {
+		return cerr
+	}
+	return nil
+}
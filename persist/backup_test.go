@@ -0,0 +1,84 @@
+package persist
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/crypto.v0/config"
+	"gopkg.in/dedis/crypto.v0/random"
+	"gopkg.in/dedis/onet.v1/crypto"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// memBackup is a Backup of one Store.
+type memBackup struct {
+	st *Store
+}
+
+func (m *memBackup) ExportStorage() ([]byte, error) {
+	return m.st.Export()
+}
+
+func (m *memBackup) ImportStorage(buf []byte) error {
+	_, err := m.st.Import(buf)
+	return err
+}
+
+func TestHandlers(t *testing.T) {
+	kp := config.NewKeyPair(network.Suite)
+	other := config.NewKeyPair(network.Suite)
+	b := &memBackup{NewStore(memBackend{}, "main", schema)}
+	require.Nil(t, b.st.Save(&counterV2{Count: 2}))
+	exp, imp := Handlers("Template", kp.Public, b)
+
+	sign := func(priv abstract.Scalar, kind, name string, t int64, nonce, data []byte) crypto.SchnorrSig {
+		sig, err := crypto.SignSchnorr(network.Suite, priv, backupHash(kind, name, t, nonce, data))
+		require.Nil(t, err)
+		return sig
+	}
+	now := time.Now().Unix()
+	nonce := random.Bytes(nonceSize, random.Stream)
+	req := &ExportRequest{Time: now, Nonce: nonce, Signature: sign(kp.Secret, "export", "Template", now, nonce, nil)}
+	resp, cerr := exp(req)
+	require.Nil(t, cerr)
+	buf := resp.Data
+
+	// Requests not signed by the conode, for another service, another
+	// kind, too old, without a nonce or replayed are refused.
+	n := random.Bytes(nonceSize, random.Stream)
+	for _, req := range []*ExportRequest{
+		{Time: now, Nonce: n, Signature: sign(other.Secret, "export", "Template", now, n, nil)},
+		{Time: now, Nonce: n, Signature: sign(kp.Secret, "export", "OTSStoreService", now, n, nil)},
+		{Time: now, Nonce: n, Signature: sign(kp.Secret, "import", "Template", now, n, nil)},
+		{Time: now - 3600, Nonce: n, Signature: sign(kp.Secret, "export", "Template", now-3600, n, nil)},
+		{Time: now, Signature: sign(kp.Secret, "export", "Template", now, nil, nil)},
+		req,
+	} {
+		_, cerr = exp(req)
+		require.NotNil(t, cerr)
+		assert.Equal(t, ErrorRefused, cerr.ErrorCode())
+	}
+
+	require.Nil(t, b.st.Save(&counterV2{Count: 5}))
+	nonce = random.Bytes(nonceSize, random.Stream)
+	_, cerr = imp(&ImportRequest{Data: buf, Time: now, Nonce: nonce, Signature: sign(kp.Secret, "import", "Template", now, nonce, []byte("other data"))})
+	require.NotNil(t, cerr)
+	ireq := &ImportRequest{Data: buf, Time: now, Nonce: nonce, Signature: sign(kp.Secret, "import", "Template", now, nonce, buf)}
+	_, cerr = imp(ireq)
+	require.Nil(t, cerr)
+	msg, err := b.st.Load()
+	require.Nil(t, err)
+	assert.Equal(t, 2, msg.(*counterV2).Count)
+
+	// Replaying the import after a change doesn't roll the storage back.
+	require.Nil(t, b.st.Save(&counterV2{Count: 7}))
+	_, cerr = imp(ireq)
+	require.NotNil(t, cerr)
+	assert.Equal(t, ErrorRefused, cerr.ErrorCode())
+	msg, err = b.st.Load()
+	require.Nil(t, err)
+	assert.Equal(t, 7, msg.(*counterV2).Count)
+}
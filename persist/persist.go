@@ -0,0 +1,169 @@
+// Package persist adds versions to the data that services save through their
+// onet.Context. Every save writes a Record holding the schema version, and
+// loading migrates older records step by step to the current version. Data
+// that was saved before a service used this package has no Record around it
+// and is treated as version 0.
+package persist
+
+import (
+	"errors"
+	"strconv"
+
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+func init() {
+	network.RegisterMessage(&Record{})
+}
+
+// Record is what gets saved: the version of the schema and the encoded data
+// of that version.
+type Record struct {
+	Version int
+	Data    []byte
+}
+
+// Backend is where a Store saves its record. The ServiceProcessor of every
+// service implements it.
+type Backend interface {
+	Save(id string, data interface{}) error
+	Load(id string) (interface{}, error)
+	DataAvailable(id string) bool
+}
+
+// Migration turns the data of one version into the data of the next one.
+type Migration func(old network.Message) (network.Message, error)
+
+// Unchanged is the migration of a version whose data is still read the same
+// way by the next one, such as the data saved before a service used this
+// package.
+func Unchanged(old network.Message) (network.Message, error) {
+	return old, nil
+}
+
+// Schema describes the versions of the data of a store.
+type Schema struct {
+	// Version is the current version. Versions start at 1, as 0 stands
+	// for data saved without a Record.
+	Version int
+	// Migrations[v] migrates the data from version v to v+1. It must be
+	// present for every version from 0 to Version-1 that can be found on
+	// disk.
+	Migrations map[int]Migration
+}
+
+// Store saves and loads the data of one id of a backend.
+type Store struct {
+	backend Backend
+	id      string
+	schema  *Schema
+}
+
+// NewStore returns a store for the data saved under id in backend.
+func NewStore(backend Backend, id string, schema *Schema) *Store {
+	return &Store{backend: backend, id: id, schema: schema}
+}
+
+// Save stores msg with the current version.
+func (st *Store) Save(msg network.Message) error {
+	rec, err := st.record(msg)
+	if err != nil {
+		return err
+	}
+	return st.backend.Save(st.id, rec)
+}
+
+// Load returns the stored data, migrated to the current version. It returns
+// nil if nothing has been saved yet.
+func (st *Store) Load() (network.Message, error) {
+	if !st.backend.DataAvailable(st.id) {
+		return nil, nil
+	}
+	stored, err := st.backend.Load(st.id)
+	if err != nil {
+		return nil, err
+	}
+	if rec, ok := stored.(*Record); ok {
+		return st.open(rec)
+	}
+	return st.migrate(0, stored)
+}
+
+// Export returns the stored data as a self-describing Record in the current
+// version, or nil if nothing has been saved yet.
+func (st *Store) Export() ([]byte, error) {
+	msg, err := st.Load()
+	if err != nil || msg == nil {
+		return nil, err
+	}
+	return st.Encode(msg)
+}
+
+// Encode returns msg as Export would if it was stored. Services that keep
+// changes in memory for a while use it to export what they hold.
+func (st *Store) Encode(msg network.Message) ([]byte, error) {
+	rec, err := st.record(msg)
+	if err != nil {
+		return nil, err
+	}
+	return network.Marshal(rec)
+}
+
+// Import replaces the stored data with the exported buf, which may be of an
+// older version, and returns it migrated to the current version.
+func (st *Store) Import(buf []byte) (network.Message, error) {
+	_, msg, err := network.Unmarshal(buf)
+	if err != nil {
+		return nil, err
+	}
+	rec, ok := msg.(*Record)
+	if !ok {
+		return nil, errors.New("Not an exported record")
+	}
+	data, err := st.open(rec)
+	if err != nil {
+		return nil, err
+	}
+	if err := st.Save(data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (st *Store) record(msg network.Message) (*Record, error) {
+	data, err := network.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	return &Record{Version: st.schema.Version, Data: data}, nil
+}
+
+// open decodes the data of rec and migrates it.
+func (st *Store) open(rec *Record) (network.Message, error) {
+	if rec.Version > st.schema.Version {
+		return nil, errors.New("Data of version " + strconv.Itoa(rec.Version) +
+			" is newer than " + strconv.Itoa(st.schema.Version))
+	}
+	_, msg, err := network.Unmarshal(rec.Data)
+	if err != nil {
+		return nil, err
+	}
+	return st.migrate(rec.Version, msg)
+}
+
+// migrate applies the migrations from version to the current version.
+func (st *Store) migrate(version int, msg network.Message) (network.Message, error) {
+	for v := version; v < st.schema.Version; v++ {
+		m, ok := st.schema.Migrations[v]
+		if !ok {
+			return nil, errors.New("No migration from version " + strconv.Itoa(v))
+		}
+		var err error
+		msg, err = m(msg)
+		if err != nil {
+			return nil, errors.New("Migration from version " + strconv.Itoa(v) +
+				" failed: " + err.Error())
+		}
+	}
+	return msg, nil
+}
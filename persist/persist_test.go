@@ -0,0 +1,130 @@
+package persist
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+func init() {
+	network.RegisterMessage(&counterV1{})
+	network.RegisterMessage(&counterV2{})
+}
+
+func TestMain(m *testing.M) {
+	log.MainTest(m)
+}
+
+type counterV1 struct {
+	Count int
+}
+
+type counterV2 struct {
+	Count int
+	Names []string
+}
+
+// memBackend keeps the saved data in a map.
+type memBackend map[string]interface{}
+
+func (m memBackend) Save(id string, data interface{}) error {
+	// Going through the encoding makes sure that nothing is shared
+	// with the caller, as with the files of onet.
+	buf, err := network.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, msg, err := network.Unmarshal(buf)
+	m[id] = msg
+	return err
+}
+
+func (m memBackend) Load(id string) (interface{}, error) {
+	return m[id], nil
+}
+
+func (m memBackend) DataAvailable(id string) bool {
+	_, ok := m[id]
+	return ok
+}
+
+var schema = &Schema{
+	Version: 2,
+	Migrations: map[int]Migration{
+		0: func(old network.Message) (network.Message, error) {
+			return old, nil
+		},
+		1: func(old network.Message) (network.Message, error) {
+			c, ok := old.(*counterV1)
+			if !ok {
+				return nil, errors.New("wrong type")
+			}
+			return &counterV2{Count: c.Count, Names: []string{"migrated"}}, nil
+		},
+	},
+}
+
+func TestStore(t *testing.T) {
+	b := memBackend{}
+	st := NewStore(b, "main", schema)
+	msg, err := st.Load()
+	require.Nil(t, err)
+	assert.Nil(t, msg)
+
+	// Data saved without a Record is version 0.
+	b["main"] = &counterV1{Count: 3}
+	msg, err = st.Load()
+	require.Nil(t, err)
+	assert.Equal(t, &counterV2{Count: 3, Names: []string{"migrated"}}, msg)
+
+	require.Nil(t, NewStore(b, "main", &Schema{Version: 1, Migrations: schema.Migrations}).
+		Save(&counterV1{Count: 4}))
+	msg, err = st.Load()
+	require.Nil(t, err)
+	assert.Equal(t, 4, msg.(*counterV2).Count)
+
+	require.Nil(t, st.Save(&counterV2{Count: 5}))
+	msg, err = st.Load()
+	require.Nil(t, err)
+	assert.Equal(t, 5, msg.(*counterV2).Count)
+
+	// A newer version can't be read.
+	_, err = NewStore(b, "main", &Schema{Version: 1, Migrations: schema.Migrations}).Load()
+	assert.NotNil(t, err)
+
+	// A missing migration is reported.
+	b["main"] = &counterV1{Count: 3}
+	_, err = NewStore(b, "main", &Schema{Version: 2}).Load()
+	assert.NotNil(t, err)
+}
+
+func TestStore_ExportImport(t *testing.T) {
+	old := NewStore(memBackend{}, "main", &Schema{Version: 1, Migrations: schema.Migrations})
+	buf, err := old.Export()
+	require.Nil(t, err)
+	assert.Nil(t, buf)
+
+	require.Nil(t, old.Save(&counterV1{Count: 7}))
+	buf, err = old.Export()
+	require.Nil(t, err)
+
+	b := memBackend{}
+	st := NewStore(b, "main", schema)
+	msg, err := st.Import(buf)
+	require.Nil(t, err)
+	assert.Equal(t, &counterV2{Count: 7, Names: []string{"migrated"}}, msg)
+	msg, err = st.Load()
+	require.Nil(t, err)
+	assert.Equal(t, 7, msg.(*counterV2).Count)
+
+	_, err = st.Import([]byte("not a record"))
+	assert.NotNil(t, err)
+	buf, err = network.Marshal(&counterV1{})
+	require.Nil(t, err)
+	_, err = st.Import(buf)
+	assert.NotNil(t, err)
+}
@@ -12,7 +12,10 @@ node will only use the `Handle`-methods, and not call `Start` again.
 
 import (
 	"errors"
+	"sync"
+	"time"
 
+	"github.com/dedis/cothority_template/netem"
 	"gopkg.in/dedis/onet.v1"
 	"gopkg.in/dedis/onet.v1/log"
 	"gopkg.in/dedis/onet.v1/network"
@@ -24,6 +27,10 @@ func init() {
 	onet.GlobalProtocolRegister(Name, NewProtocol)
 }
 
+// DefaultTimeout is how long a node waits for each level of its subtree if
+// the Announce-message doesn't give a timeout.
+const DefaultTimeout = 5 * time.Second
+
 // Template just holds a message that is passed to all children. It
 // also defines a channel that will receive the number of children. Only the
 // root-node will write to the channel.
@@ -31,13 +38,41 @@ type Template struct {
 	*onet.TreeNodeInstance
 	Message    string
 	ChildCount chan int
+	// Timings receives the timings of all nodes, root first, just before
+	// ChildCount is written.
+	Timings chan []NodeTiming
+	// Missing receives the nodes that didn't answer in time, just before
+	// ChildCount is written.
+	Missing chan []network.ServerIdentityID
+	// Timeout is set by the root before Start and is passed on in the
+	// Announce-message. Every node waits Timeout for each level of its
+	// subtree, so that a node gives up later than its children.
+	Timeout time.Duration
+
+	sync.Mutex
+	announceAt time.Time
+	sentAt     time.Time
+	processing time.Duration
+	expected   int
+	replies    []childReply
+	finished   bool
+	timer      *time.Timer
+}
+
+// childReply is a Reply together with its sender and the time it arrived.
+type childReply struct {
+	Reply
+	from *onet.TreeNode
+	at   time.Time
 }
 
 // NewProtocol initialises the structure for use in one round
 func NewProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
 	t := &Template{
 		TreeNodeInstance: n,
-		ChildCount:       make(chan int),
+		ChildCount:       make(chan int, 1),
+		Timings:          make(chan []NodeTiming, 1),
+		Missing:          make(chan []network.ServerIdentityID, 1),
 	}
 	for _, handler := range []interface{}{t.HandleAnnounce, t.HandleReply} {
 		if err := t.RegisterHandler(handler); err != nil {
@@ -51,38 +86,157 @@ func NewProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
 func (p *Template) Start() error {
 	log.Lvl3("Starting Template")
 	return p.HandleAnnounce(StructAnnounce{p.TreeNode(),
-		Announce{"cothority rulez!"}})
+		Announce{"cothority rulez!", int64(p.Timeout)}})
 }
 
 // HandleAnnounce is the first message and is used to send an ID that
 // is stored in all nodes.
 func (p *Template) HandleAnnounce(msg StructAnnounce) error {
+	start := time.Now()
+	p.Lock()
+	p.announceAt = start
 	p.Message = msg.Message
-	if !p.IsLeaf() {
-		// If we have children, send the same message to all of them
-		p.SendToChildren(&msg.Announce)
-	} else {
+	p.Unlock()
+	if p.IsLeaf() {
 		// If we're the leaf, start to reply
-		p.HandleReply(nil)
+		return p.finish(start)
+	}
+
+	timeout := time.Duration(msg.Timeout)
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	p.Lock()
+	p.timer = time.AfterFunc(timeout*time.Duration(height(p.TreeNode())), func() {
+		log.Lvl2(p.ServerIdentity().Address, "timed out waiting for its children")
+		p.finish(time.Now())
+	})
+	p.sentAt = time.Now()
+	p.Unlock()
+	// If we have children, send the same message to all of them. A child
+	// we can't reach is reported as missing right away.
+	sent := 0
+	for _, c := range p.Children() {
+		if err := netem.SendTo(p.TreeNodeInstance, c, &msg.Announce); err != nil {
+			log.Lvl2(p.ServerIdentity().Address, "couldn't reach", c.ServerIdentity.Address, err)
+			continue
+		}
+		sent++
+	}
+	p.Lock()
+	p.expected = sent
+	p.processing += time.Since(start)
+	done := len(p.replies) >= sent
+	p.Unlock()
+	if done {
+		return p.finish(time.Now())
 	}
 	return nil
 }
 
 // HandleReply is the message going up the tree and holding a counter
-// to verify the number of nodes.
-func (p *Template) HandleReply(reply []StructReply) error {
+// to verify the number of nodes. Once all children replied, the node sends
+// its own reply. Replies arriving after the timeout are ignored.
+func (p *Template) HandleReply(reply StructReply) error {
+	start := time.Now()
+	p.Lock()
+	if p.finished {
+		p.Unlock()
+		return nil
+	}
+	p.replies = append(p.replies, childReply{reply.Reply, reply.TreeNode, start})
+	done := p.expected > 0 && len(p.replies) >= p.expected
+	if !done {
+		p.processing += time.Since(start)
+	}
+	p.Unlock()
+	if !done {
+		return nil
+	}
+	return p.finish(start)
+}
+
+// finish adds up the replies of the children and sends the result to the
+// parent, or to the channels for the root. Only the first call does
+// anything.
+func (p *Template) finish(start time.Time) error {
+	p.Lock()
+	if p.finished {
+		p.Unlock()
+		return nil
+	}
+	p.finished = true
 	defer p.Done()
+	if p.timer != nil {
+		p.timer.Stop()
+	}
 
 	children := 1
-	for _, c := range reply {
-		children += c.ChildrenCount
+	var subtree []NodeTiming
+	var missing []network.ServerIdentityID
+	replied := map[onet.TreeNodeID]bool{}
+	for _, r := range p.replies {
+		replied[r.from.ID] = true
+		children += r.ChildrenCount
+		missing = append(missing, r.Missing...)
+		if len(r.Timings) == 0 {
+			continue
+		}
+		// What we waited for the reply minus the time the child needed
+		// is the round-trip time to the child, half of which passed
+		// until the child got the Announce-message.
+		rtt := r.at.Sub(p.sentAt).Seconds() - r.Timings[0].Reply
+		if rtt < 0 {
+			rtt = 0
+		}
+		offset := p.sentAt.Sub(p.announceAt).Seconds() + rtt/2
+		for _, t := range r.Timings {
+			t.Announce += offset
+			t.Reply += offset
+			subtree = append(subtree, t)
+		}
 	}
+	for _, c := range p.Children() {
+		if !replied[c.ID] {
+			missing = append(missing, subtreeIDs(c)...)
+		}
+	}
+	p.processing += time.Since(start)
+	timings := append([]NodeTiming{{
+		ID:         p.ServerIdentity().ID,
+		Processing: p.processing.Seconds(),
+		Reply:      time.Since(p.announceAt).Seconds(),
+	}}, subtree...)
+	p.Unlock()
+
 	log.Lvl3(p.ServerIdentity().Address, "is done with total of", children)
 	if !p.IsRoot() {
 		log.Lvl3("Sending to parent")
-		return p.SendTo(p.Parent(), &Reply{children})
+		return netem.SendTo(p.TreeNodeInstance, p.Parent(), &Reply{children, timings, missing})
 	}
 	log.Lvl3("Root-node is done - nbr of children found:", children)
+	p.Timings <- timings
+	p.Missing <- missing
 	p.ChildCount <- children
 	return nil
 }
+
+// height returns the number of levels below tn.
+func height(tn *onet.TreeNode) int {
+	h := 0
+	for _, c := range tn.Children {
+		if ch := height(c) + 1; ch > h {
+			h = ch
+		}
+	}
+	return h
+}
+
+// subtreeIDs returns the identities of tn and all nodes below it.
+func subtreeIDs(tn *onet.TreeNode) []network.ServerIdentityID {
+	ids := []network.ServerIdentityID{tn.ServerIdentity.ID}
+	for _, c := range tn.Children {
+		ids = append(ids, subtreeIDs(c)...)
+	}
+	return ids
+}
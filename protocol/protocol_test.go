@@ -41,9 +41,53 @@ func TestNode(t *testing.T) {
 			if children != nbrNodes {
 				t.Fatal("Didn't get a child-cound of", nbrNodes)
 			}
+			timings := <-protocol.Timings
+			if len(timings) != nbrNodes {
+				t.Fatal("Didn't get the timings of", nbrNodes, "nodes")
+			}
+			if !timings[0].ID.Equal(tree.Root.ServerIdentity.ID) || timings[0].Announce != 0 {
+				t.Fatal("First timing isn't the one of the root")
+			}
+			for _, tim := range timings[1:] {
+				if tim.Announce < 0 || tim.Reply < tim.Announce || tim.Reply > timings[0].Reply {
+					t.Fatal("Timing out of order:", tim)
+				}
+			}
 		case <-time.After(timeout):
 			t.Fatal("Didn't finish in time")
 		}
 		local.CloseAll()
 	}
 }
+
+// Tests that the root reports a node that can't be reached instead of
+// waiting forever.
+func TestMissingNode(t *testing.T) {
+	local := onet.NewLocalTest()
+	defer local.CloseAll()
+	_, _, tree := local.GenTree(5, true)
+	leaf := tree.Root.Children[0].Children[0]
+	srv := local.Servers[leaf.ServerIdentity.ID]
+	delete(local.Servers, leaf.ServerIdentity.ID)
+	log.ErrFatal(srv.Close())
+
+	pi, err := local.CreateProtocol("Template", tree)
+	if err != nil {
+		t.Fatal("Couldn't create protocol:", err)
+	}
+	p := pi.(*protocol.Template)
+	p.Timeout = 500 * time.Millisecond
+	go p.Start()
+	select {
+	case children := <-p.ChildCount:
+		if children != 4 {
+			t.Fatal("Expected 4 children, got", children)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Root didn't give up on the missing node")
+	}
+	missing := <-p.Missing
+	if len(missing) != 1 || !missing[0].Equal(leaf.ServerIdentity.ID) {
+		t.Fatal("Didn't report the missing node:", missing)
+	}
+}
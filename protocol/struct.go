@@ -7,7 +7,10 @@ with the `*onet.TreeNode` embedded. The latter is used in the handler-function
 so that it can find out who sent the message.
 */
 
-import "gopkg.in/dedis/onet.v1"
+import (
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/network"
+)
 
 // Name can be used from other packages to refer to this protocol.
 const Name = "Template"
@@ -15,6 +18,8 @@ const Name = "Template"
 // Announce is used to pass a message to all children.
 type Announce struct {
 	Message string
+	// Timeout per level of the subtree in nanoseconds.
+	Timeout int64
 }
 
 // StructAnnounce just contains Announce and the data necessary to identify and
@@ -27,6 +32,24 @@ type StructAnnounce struct {
 // Reply returns the count of all children.
 type Reply struct {
 	ChildrenCount int
+	// Timings of the subtree, the sending node first. They are relative to
+	// the moment the sending node got the Announce-message.
+	Timings []NodeTiming
+	// Missing lists the nodes of the subtree that didn't answer in time.
+	Missing []network.ServerIdentityID
+}
+
+// NodeTiming holds the timing of one node in seconds. Announce and Reply are
+// estimated from the round-trip times between the nodes, as their clocks
+// aren't synchronised.
+type NodeTiming struct {
+	ID network.ServerIdentityID
+	// Announce is when the node got the Announce-message.
+	Announce float64
+	// Processing is the time spent in the handlers of the node.
+	Processing float64
+	// Reply is when the node sent its Reply-message.
+	Reply float64
 }
 
 // StructReply just contains Reply and the data necessary to identify and
@@ -6,12 +6,14 @@ runs on the node.
 */
 
 import (
+	"math"
 	"time"
 
 	"errors"
 	"sync"
 
 	"github.com/dedis/cothority_template"
+	"github.com/dedis/cothority_template/persist"
 	"github.com/dedis/cothority_template/protocol"
 	"gopkg.in/dedis/onet.v1"
 	"gopkg.in/dedis/onet.v1/log"
@@ -28,6 +30,19 @@ func init() {
 	network.RegisterMessage(&storage{})
 }
 
+// MaxRunning is the number of protocols a node runs at the same time for
+// ClockRequests. Further requests wait for a free slot.
+var MaxRunning = 16
+
+// MaxQueued is the number of ClockRequests that can wait for a free slot.
+// Requests beyond that are refused with ErrorQueueFull.
+var MaxQueued = 256
+
+// SaveInterval is how long a changed counter waits before it is saved, so
+// that a busy node doesn't write its storage for every request. A crash
+// loses the requests of the last interval.
+var SaveInterval = 10 * time.Second
+
 // Service is our template-service
 type Service struct {
 	// We need to embed the ServiceProcessor, so that incoming messages
@@ -35,6 +50,14 @@ type Service struct {
 	*onet.ServiceProcessor
 
 	storage *storage
+	store   *persist.Store
+	// savePending is set while a save of the storage is scheduled. It is
+	// protected by the lock of storage.
+	savePending bool
+	// queue holds a token for every ClockRequest being handled, running
+	// holds one for every protocol being run.
+	queue   chan struct{}
+	running chan struct{}
 }
 
 // storageID reflects the data we're storing - we could store more
@@ -47,29 +70,160 @@ type storage struct {
 	sync.Mutex
 }
 
-// ClockRequest starts a template-protocol and returns the run-time.
+// storageSchema lists the versions of storage. Version 0 is the storage
+// saved before it was versioned, which has the same fields as version 1.
+var storageSchema = &persist.Schema{
+	Version:    1,
+	Migrations: map[int]persist.Migration{0: persist.Unchanged},
+}
+
+// ClockRequest starts a template-protocol and returns the run-time. Every
+// request gets its own protocol instance, so requests from different clients
+// can run concurrently.
 func (s *Service) ClockRequest(req *template.ClockRequest) (*template.ClockResponse, onet.ClientError) {
+	select {
+	case s.queue <- struct{}{}:
+		defer func() { <-s.queue }()
+	default:
+		return nil, onet.NewClientErrorCode(template.ErrorQueueFull, "too many requests waiting")
+	}
+	s.running <- struct{}{}
+	defer func() { <-s.running }()
+
 	s.storage.Lock()
 	s.storage.Count++
+	if !s.savePending {
+		s.savePending = true
+		time.AfterFunc(SaveInterval, s.save)
+	}
 	s.storage.Unlock()
-	s.save()
-	tree := req.Roster.GenerateNaryTreeWithRoot(2, s.ServerIdentity())
-	if tree == nil {
-		return nil, onet.NewClientErrorCode(template.ErrorParse, "couldn't create tree")
+	tree, bf, err := s.clockTree(req)
+	if err != nil {
+		return nil, onet.NewClientErrorCode(template.ErrorParse, err.Error())
 	}
 	pi, err := s.CreateProtocol(protocol.Name, tree)
 	if err != nil {
 		return nil, onet.NewClientError(err)
 	}
+	proto := pi.(*protocol.Template)
+	proto.Timeout = time.Duration(req.Timeout * float64(time.Second))
 	start := time.Now()
 	pi.Start()
 	resp := &template.ClockResponse{
-		Children: <-pi.(*protocol.Template).ChildCount,
+		Children:        <-proto.ChildCount,
+		BranchingFactor: bf,
 	}
 	resp.Time = time.Now().Sub(start).Seconds()
+	resp.Tree, resp.Depth = describeTree(tree, req.Roster)
+	addTimings(resp.Tree, <-proto.Timings, req.Roster)
+	for _, id := range <-proto.Missing {
+		if i, _ := req.Roster.Search(id); i >= 0 {
+			resp.Missing = append(resp.Missing, i)
+		}
+	}
 	return resp, nil
 }
 
+// addTimings copies the timings of the protocol to the nodes of the tree.
+func addTimings(nodes []template.ClockNode, timings []protocol.NodeTiming, roster *onet.Roster) {
+	for _, t := range timings {
+		for i := range nodes {
+			idx := nodes[i].Index
+			if idx >= 0 && roster.List[idx].ID.Equal(t.ID) {
+				nodes[i].Announce = t.Announce
+				nodes[i].Processing = t.Processing
+				nodes[i].Reply = t.Reply
+			}
+		}
+	}
+}
+
+// clockTree returns the tree asked for in req, with this node as root, and
+// its branching factor.
+func (s *Service) clockTree(req *template.ClockRequest) (*onet.Tree, int, error) {
+	if req.Roster == nil || len(req.Roster.List) == 0 {
+		return nil, 0, errors.New("empty roster")
+	}
+	bf := req.BranchingFactor
+	if bf <= 0 {
+		bf = 2
+	}
+	list := req.Roster.List
+	if len(req.Subset) > 0 {
+		list = nil
+		seen := map[int]bool{}
+		for _, i := range req.Subset {
+			if i < 0 || i >= len(req.Roster.List) {
+				return nil, 0, errors.New("subset index out of roster")
+			}
+			if !seen[i] {
+				seen[i] = true
+				list = append(list, req.Roster.List[i])
+			}
+		}
+	}
+
+	// The root goes first, so that the depth limit never removes it.
+	own := -1
+	for i, si := range list {
+		if si.ID.Equal(s.ServerIdentity().ID) {
+			own = i
+		}
+	}
+	if own < 0 {
+		return nil, 0, errors.New("this node is not part of the roster")
+	}
+	ordered := append([]*network.ServerIdentity{list[own]}, list[:own]...)
+	ordered = append(ordered, list[own+1:]...)
+	if req.MaxDepth > 0 {
+		if max := treeCapacity(bf, req.MaxDepth); len(ordered) > max {
+			ordered = ordered[:max]
+		}
+	}
+	tree := onet.NewRoster(ordered).GenerateNaryTreeWithRoot(bf, s.ServerIdentity())
+	if tree == nil {
+		return nil, 0, errors.New("couldn't create tree")
+	}
+	return tree, bf, nil
+}
+
+// treeCapacity returns how many nodes fit into a tree with branching factor
+// bf and the given depth.
+func treeCapacity(bf, depth int) int {
+	total, level := 1, 1
+	for d := 0; d < depth && total < math.MaxInt32; d++ {
+		level *= bf
+		total += level
+	}
+	return total
+}
+
+// describeTree returns the nodes of tree, root first, with their indexes in
+// roster, and the depth of the tree.
+func describeTree(tree *onet.Tree, roster *onet.Roster) ([]template.ClockNode, int) {
+	var nodes []template.ClockNode
+	depth := 0
+	var walk func(tn *onet.TreeNode, parent, d int)
+	walk = func(tn *onet.TreeNode, parent, d int) {
+		index := -1
+		for i, si := range roster.List {
+			if si.ID.Equal(tn.ServerIdentity.ID) {
+				index = i
+				break
+			}
+		}
+		nodes = append(nodes, template.ClockNode{Index: index, Parent: parent, Depth: d})
+		if d > depth {
+			depth = d
+		}
+		for _, c := range tn.Children {
+			walk(c, index, d+1)
+		}
+	}
+	walk(tree.Root, -1, 0)
+	return nodes, depth
+}
+
 // CountRequest returns the number of instantiations of the protocol.
 func (s *Service) CountRequest(req *template.CountRequest) (*template.CountResponse, onet.ClientError) {
 	s.storage.Lock()
@@ -89,11 +243,12 @@ func (s *Service) NewProtocol(tn *onet.TreeNodeInstance, conf *onet.GenericConfi
 	return nil, nil
 }
 
-// saves all skipblocks.
+// saves the storage.
 func (s *Service) save() {
 	s.storage.Lock()
 	defer s.storage.Unlock()
-	err := s.Save(storageID, s.storage)
+	s.savePending = false
+	err := s.store.Save(s.storage)
 	if err != nil {
 		log.Error("Couldn't save file:", err)
 	}
@@ -103,18 +258,40 @@ func (s *Service) save() {
 // if it finds a valid config-file.
 func (s *Service) tryLoad() error {
 	s.storage = &storage{}
-	if !s.DataAvailable(storageID) {
-		return nil
-	}
-	msg, err := s.Load(storageID)
-	if err != nil {
+	msg, err := s.store.Load()
+	if err != nil || msg == nil {
 		return err
 	}
 	var ok bool
 	s.storage, ok = msg.(*storage)
+	if !ok {
+		s.storage = &storage{}
+		return errors.New("Data of wrong type")
+	}
+	return nil
+}
+
+// ExportStorage implements persist.Backup. It includes the requests that
+// are not saved yet.
+func (s *Service) ExportStorage() ([]byte, error) {
+	s.storage.Lock()
+	defer s.storage.Unlock()
+	return s.store.Encode(&storage{Count: s.storage.Count})
+}
+
+// ImportStorage implements persist.Backup.
+func (s *Service) ImportStorage(buf []byte) error {
+	s.storage.Lock()
+	defer s.storage.Unlock()
+	msg, err := s.store.Import(buf)
+	if err != nil {
+		return err
+	}
+	st, ok := msg.(*storage)
 	if !ok {
 		return errors.New("Data of wrong type")
 	}
+	s.storage.Count = st.Count
 	return nil
 }
 
@@ -124,8 +301,12 @@ func (s *Service) tryLoad() error {
 func newService(c *onet.Context) onet.Service {
 	s := &Service{
 		ServiceProcessor: onet.NewServiceProcessor(c),
+		queue:            make(chan struct{}, MaxRunning+MaxQueued),
+		running:          make(chan struct{}, MaxRunning),
 	}
-	if err := s.RegisterHandlers(s.ClockRequest, s.CountRequest); err != nil {
+	s.store = persist.NewStore(s.ServiceProcessor, storageID, storageSchema)
+	exp, imp := persist.Handlers(template.ServiceName, s.ServerIdentity().Public, s)
+	if err := s.RegisterHandlers(s.ClockRequest, s.CountRequest, exp, imp); err != nil {
 		log.ErrFatal(err, "Couldn't register messages")
 	}
 	if err := s.tryLoad(); err != nil {
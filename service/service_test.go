@@ -1,12 +1,18 @@
 package service
 
 import (
+	"errors"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/dedis/cothority_template"
+	"github.com/dedis/cothority_template/persist"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"gopkg.in/dedis/onet.v1"
 	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
 )
 
 func TestMain(m *testing.M) {
@@ -29,6 +35,11 @@ func TestService_ClockRequest(t *testing.T) {
 		)
 		log.ErrFatal(err)
 		assert.Equal(t, resp.Children, len(roster.List))
+		assert.Equal(t, len(roster.List), len(resp.Tree))
+		for _, n := range resp.Tree {
+			assert.True(t, n.Reply >= n.Announce)
+			assert.True(t, n.Reply <= resp.Tree[0].Reply)
+		}
 	}
 }
 
@@ -53,3 +64,154 @@ func TestService_CountRequest(t *testing.T) {
 		assert.Equal(t, 1, count.Count)
 	}
 }
+
+func TestService_ClockRequestTopology(t *testing.T) {
+	local := onet.NewTCPTest()
+	hosts, roster, _ := local.GenTree(7, true)
+	defer local.CloseAll()
+
+	s := local.GetServices(hosts, templateID)[0].(*Service)
+
+	// A depth of 1 with a branching factor of 3 only keeps 4 nodes.
+	resp, err := s.ClockRequest(&template.ClockRequest{
+		Roster:          roster,
+		BranchingFactor: 3,
+		MaxDepth:        1,
+	})
+	log.ErrFatal(err)
+	assert.Equal(t, 4, resp.Children)
+	assert.Equal(t, 3, resp.BranchingFactor)
+	assert.Equal(t, 1, resp.Depth)
+	assert.Equal(t, 4, len(resp.Tree))
+	assert.Equal(t, template.ClockNode{Index: 0, Parent: -1, Depth: 0}, resp.Tree[0])
+
+	// A chain of the nodes 0, 2 and 5.
+	resp, err = s.ClockRequest(&template.ClockRequest{
+		Roster:          roster,
+		BranchingFactor: 1,
+		Subset:          []int{5, 0, 2},
+	})
+	log.ErrFatal(err)
+	assert.Equal(t, 3, resp.Children)
+	assert.Equal(t, 2, resp.Depth)
+	for i, n := range resp.Tree {
+		assert.Equal(t, i, n.Depth)
+		assert.Contains(t, []int{0, 2, 5}, n.Index)
+	}
+
+	// The node receiving the request must be part of the subset.
+	_, err = s.ClockRequest(&template.ClockRequest{
+		Roster: roster,
+		Subset: []int{1, 2},
+	})
+	assert.NotNil(t, err)
+}
+
+// Runs many requests at the same time through the API, so that the race
+// detector can look at concurrent protocol runs.
+func TestService_ClockRequestConcurrent(t *testing.T) {
+	local := onet.NewTCPTest()
+	_, roster, _ := local.GenTree(5, true)
+	defer local.CloseAll()
+
+	const requests = 200
+	var wg sync.WaitGroup
+	errs := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := template.NewClient()
+			defer c.Close()
+			resp, err := c.Clock(roster)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if resp.Children != len(roster.List) || len(resp.Missing) != 0 {
+				errs <- errors.New("incomplete response")
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestService_ClockRequestQueueFull(t *testing.T) {
+	local := onet.NewTCPTest()
+	hosts, roster, _ := local.GenTree(2, true)
+	defer local.CloseAll()
+	s := local.GetServices(hosts, templateID)[0].(*Service)
+
+	// Pretend that the queue is full.
+	for i := 0; i < cap(s.queue); i++ {
+		s.queue <- struct{}{}
+	}
+	_, err := s.ClockRequest(&template.ClockRequest{Roster: roster})
+	require.NotNil(t, err)
+	assert.Equal(t, template.ErrorQueueFull, err.ErrorCode())
+
+	<-s.queue
+	_, err = s.ClockRequest(&template.ClockRequest{Roster: roster})
+	assert.Nil(t, err)
+}
+
+func TestService_Storage(t *testing.T) {
+	local := onet.NewLocalTest()
+	hosts, _, _ := local.GenTree(1, true)
+	defer local.CloseAll()
+
+	s := local.GetServices(hosts, templateID)[0].(*Service)
+
+	// Data saved before the storage was versioned.
+	require.Nil(t, s.Save(storageID, &storage{Count: 3}))
+	require.Nil(t, s.tryLoad())
+	assert.Equal(t, 3, s.storage.Count)
+
+	s.save()
+	buf, err := s.ExportStorage()
+	require.Nil(t, err)
+	s.storage.Count = 0
+	s.save()
+	require.Nil(t, s.ImportStorage(buf))
+	assert.Equal(t, 3, s.storage.Count)
+	require.Nil(t, s.tryLoad())
+	assert.Equal(t, 3, s.storage.Count)
+
+	// Through the network, only the conode itself can do the same.
+	c := persist.NewClient(template.ServiceName)
+	si := hosts[0].ServerIdentity
+	buf, err = c.Export(si, local.GetPrivate(hosts[0]))
+	require.Nil(t, err)
+	s.storage.Count = 0
+	require.Nil(t, c.Import(si, local.GetPrivate(hosts[0]), buf))
+	assert.Equal(t, 3, s.storage.Count)
+	_, err = c.Export(si, network.Suite.Scalar().One())
+	assert.NotNil(t, err)
+}
+
+func TestService_SaveInterval(t *testing.T) {
+	defer func(d time.Duration) { SaveInterval = d }(SaveInterval)
+	SaveInterval = 100 * time.Millisecond
+	local := onet.NewLocalTest()
+	hosts, roster, _ := local.GenTree(1, true)
+	defer local.CloseAll()
+	s := local.GetServices(hosts, templateID)[0].(*Service)
+
+	// The requests are counted at once, but saved together later.
+	for i := 0; i < 3; i++ {
+		_, cerr := s.ClockRequest(&template.ClockRequest{Roster: roster})
+		require.Nil(t, cerr)
+	}
+	msg, err := s.store.Load()
+	require.Nil(t, err)
+	assert.Nil(t, msg)
+	time.Sleep(2 * SaveInterval)
+	msg, err = s.store.Load()
+	require.Nil(t, err)
+	require.NotNil(t, msg)
+	assert.Equal(t, 3, msg.(*storage).Count)
+}
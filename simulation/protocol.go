@@ -24,6 +24,7 @@ import (
 	"strconv"
 
 	"github.com/BurntSushi/toml"
+	"github.com/dedis/cothority_template/netem"
 	"github.com/dedis/cothority_template/protocol"
 	"gopkg.in/dedis/onet.v1"
 	"gopkg.in/dedis/onet.v1/log"
@@ -37,6 +38,8 @@ func init() {
 // SimulationProtocol implements onet.Simulation.
 type SimulationProtocol struct {
 	onet.SimulationBFTree
+	// Config emulates a wide-area network between the nodes.
+	netem.Config
 }
 
 // NewSimulationProtocol is used internally to register the simulation (see the init()
@@ -72,6 +75,9 @@ func (s *SimulationProtocol) Node(config *onet.SimulationConfig) error {
 		log.Fatal("Didn't find this node in roster")
 	}
 	log.Lvl3("Initializing node-index", index)
+	if err := netem.Set(s.Config); err != nil {
+		return err
+	}
 	return s.SimulationBFTree.Node(config)
 }
 
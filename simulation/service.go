@@ -3,6 +3,7 @@ package main
 import (
 	"github.com/BurntSushi/toml"
 	"github.com/dedis/cothority_template"
+	"github.com/dedis/cothority_template/netem"
 	"gopkg.in/dedis/onet.v1"
 	"gopkg.in/dedis/onet.v1/log"
 	"gopkg.in/dedis/onet.v1/simul/monitor"
@@ -19,6 +20,8 @@ func init() {
 // SimulationService only holds the BFTree simulation
 type SimulationService struct {
 	onet.SimulationBFTree
+	// Config emulates a wide-area network between the nodes.
+	netem.Config
 }
 
 // NewSimulationService returns the new simulation, where all fields are
@@ -54,6 +57,9 @@ func (s *SimulationService) Node(config *onet.SimulationConfig) error {
 		log.Fatal("Didn't find this node in roster")
 	}
 	log.Lvl3("Initializing node-index", index)
+	if err := netem.Set(s.Config); err != nil {
+		return err
+	}
 	return s.SimulationBFTree.Node(config)
 }
 
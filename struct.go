@@ -13,7 +13,7 @@ import (
 func init() {
 	for _, msg := range []interface{}{
 		CountRequest{}, CountResponse{},
-		ClockRequest{}, ClockResponse{},
+		ClockRequest{}, ClockResponse{}, ClockNode{},
 	} {
 		network.RegisterMessage(msg)
 	}
@@ -22,18 +22,59 @@ func init() {
 const (
 	// ErrorParse indicates an error while parsing the protobuf-file.
 	ErrorParse = iota + 4000
+	// ErrorQueueFull is returned when a node already has too many
+	// requests waiting to run the protocol.
+	ErrorQueueFull
 )
 
 // ClockRequest will run the tepmlate-protocol on the roster and return
 // the time spent doing so.
 type ClockRequest struct {
 	Roster *onet.Roster
+	// BranchingFactor of the tree, 2 if not set.
+	BranchingFactor int
+	// MaxDepth limits the depth of the tree, the root being at depth 0.
+	// The nodes that don't fit into the tree are left out. No limit if
+	// not set.
+	MaxDepth int
+	// Subset holds the indexes in Roster of the nodes to use, which must
+	// include the node receiving the request. All nodes if empty.
+	Subset []int
+	// Timeout in seconds that a node waits for each level of its
+	// subtree, 5 seconds if not set. Nodes that don't answer in time are
+	// reported in ClockResponse.Missing.
+	Timeout float64
 }
 
 // ClockResponse returns the time spent for the protocol-run.
 type ClockResponse struct {
 	Time     float64
 	Children int
+	// BranchingFactor and Depth of the tree that was used.
+	BranchingFactor int
+	Depth           int
+	// Tree lists the nodes of the tree that was used, root first.
+	Tree []ClockNode
+	// Missing holds the indexes in the roster of the request of the nodes
+	// that didn't answer in time.
+	Missing []int
+}
+
+// ClockNode is a node of the tree used by the protocol.
+type ClockNode struct {
+	// Index of the node in the roster of the request.
+	Index int
+	// Parent is the index of the parent in the roster of the request, -1
+	// for the root.
+	Parent int
+	Depth  int
+	// Announce is the estimated time in seconds from the start of the
+	// protocol until the node got the Announce-message, Reply until it
+	// sent its Reply-message. Processing is the time the node spent in its
+	// handlers.
+	Announce   float64
+	Processing float64
+	Reply      float64
 }
 
 // CountRequest will return how many times the protocol has been run.